@@ -2,30 +2,230 @@ package archive
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/ap-pauloafonso/investor-chat/eventbus"
 	"github.com/ap-pauloafonso/investor-chat/user"
+	"log/slog"
 	"time"
 )
 
+var (
+	ErrForbidden         = errors.New("the channel is private")
+	ErrMissingReference  = errors.New("the channel, user or parent of the message doesn't exist")
+	errUnknownChangeType = errors.New("unknown message change type")
+)
+
 type Repository interface {
-	SaveMessage(ctx context.Context, channel, user, msg string, timestamp time.Time) error
+	// SaveMessage stores the message unless its id is already stored, saved reports which one happened.
+	// It returns ErrMissingReference when the channel, the user or the parent isn't stored.
+	SaveMessage(ctx context.Context, id, parentID, channel, user, msg string, timestamp time.Time) (saved bool, err error)
+	// GetRecentMessages returns the last messages of the channel that aren't replies, the threads are loaded apart
 	GetRecentMessages(ctx context.Context, channel string, maxMessages int) ([]user.Message, error)
+	// GetMessagesAfter returns up to maxMessages messages archived after afterID in the channel, oldest first,
+	// found is false when afterID isn't archived in the channel
+	GetMessagesAfter(ctx context.Context, channel, afterID string, maxMessages int) (msgs []user.Message, found bool, err error)
+	// GetMessagesBefore returns the last maxMessages messages of the channel that aren't replies and came before
+	// beforeID, the newest ones when it is empty. Oldest first, found is false when beforeID isn't archived in the channel.
+	GetMessagesBefore(ctx context.Context, channel, beforeID string, maxMessages int) (msgs []user.Message, found bool, err error)
+	GetMessage(ctx context.Context, id string) (msg user.Message, found bool, err error)
+	// GetThread returns up to maxMessages replies to parentID, oldest first
+	GetThread(ctx context.Context, parentID string, maxMessages int) ([]user.Message, error)
+	// EditMessage and DeleteMessage keep the previous text in the edit history, both ignore deleted messages
+	EditMessage(ctx context.Context, id, text, by string, at time.Time) error
+	DeleteMessage(ctx context.Context, id, by string, at time.Time) error
+	// ToggleReaction adds the reaction or removes it when the user already reacted with the emoji,
+	// count is the new total for the emoji and found is false when the message doesn't exist or is deleted
+	ToggleReaction(ctx context.Context, id, username, emoji string, at time.Time) (added bool, count int, found bool, err error)
+	// CanRead reports whether the user can read the channel, private channels are only readable by their members
+	CanRead(ctx context.Context, channel, username string) (bool, error)
+}
+
+// Mentions records the users mentioned in the archived messages
+type Mentions interface {
+	Record(ctx context.Context, messageID, channel, by, text string, t time.Time) error
 }
 
 type Service struct {
 	r        Repository
 	eventbus *eventbus.Eventbus
+	mentions Mentions
 }
 
-func NewService(r Repository, eventbus *eventbus.Eventbus) *Service {
-	return &Service{r: r, eventbus: eventbus}
+func NewService(r Repository, eventbus *eventbus.Eventbus, mentions Mentions) *Service {
+	return &Service{r: r, eventbus: eventbus, mentions: mentions}
 }
 
-func (s *Service) SaveMessage(ctx context.Context, channel, user, message string, timestamp time.Time) error {
-	return s.r.SaveMessage(ctx, channel, user, message, timestamp)
+// SaveMessage archives the message, a message whose id is already archived (e.g. a client retry) is dropped.
+// parentID is set on replies to a thread.
+func (s *Service) SaveMessage(ctx context.Context, id, parentID, channel, user, message string, timestamp time.Time) error {
+	saved, err := s.r.SaveMessage(ctx, id, parentID, channel, user, message, timestamp)
+	if err != nil {
+		return err
+	}
+
+	if !saved {
+		slog.Info("[duplicate message dropped]", "id", id, "channel", channel, "user", user)
+	}
+
+	// also done for duplicates, the mentions of a message whose first delivery failed halfway are still recorded
+	if s.mentions != nil {
+		return s.mentions.Record(ctx, id, channel, user, message, timestamp)
+	}
+
+	return nil
 }
 
-func (s *Service) GetRecentMessages(ctx context.Context, channel string) ([]user.Message, error) {
+// GetRecentMessages returns the last messages of the channel, ErrForbidden when username can't read it
+func (s *Service) GetRecentMessages(ctx context.Context, username, channel string) ([]user.Message, error) {
 	const max = 50
+
+	if err := s.checkRead(ctx, username, channel); err != nil {
+		return nil, err
+	}
+
 	return s.r.GetRecentMessages(ctx, channel, max)
 }
+
+func (s *Service) checkRead(ctx context.Context, username, channel string) error {
+	ok, err := s.r.CanRead(ctx, channel, username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// GetMessagesAfter returns the messages archived after afterID, for clients catching up after a reconnect.
+// hasMore is true when more than maxMessages are left, found is false when afterID is unknown.
+// maxMessages is capped at 500. It returns ErrForbidden when username can't read the channel.
+func (s *Service) GetMessagesAfter(ctx context.Context, username, channel, afterID string, maxMessages int) (msgs []user.Message, found, hasMore bool, err error) {
+	const limit = 500
+	if maxMessages <= 0 || maxMessages > limit {
+		maxMessages = limit
+	}
+
+	if err := s.checkRead(ctx, username, channel); err != nil {
+		return nil, false, false, err
+	}
+
+	// one extra message tells whether there are more left
+	msgs, found, err = s.r.GetMessagesAfter(ctx, channel, afterID, maxMessages+1)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	if len(msgs) > maxMessages {
+		return msgs[:maxMessages], found, true, nil
+	}
+
+	return msgs, found, false, nil
+}
+
+// GetMessagesBefore returns a page of the history of the channel, for clients scrolling back. The next page is the
+// one before the first message, hasMore is false once the start of the channel was reached. found is false when
+// beforeID is unknown. maxMessages defaults to 50 and is capped at 100. It returns ErrForbidden when username
+// can't read the channel.
+func (s *Service) GetMessagesBefore(ctx context.Context, username, channel, beforeID string, maxMessages int) (msgs []user.Message, found, hasMore bool, err error) {
+	const (
+		defaultLimit = 50
+		limit        = 100
+	)
+	if maxMessages <= 0 {
+		maxMessages = defaultLimit
+	}
+	if maxMessages > limit {
+		maxMessages = limit
+	}
+
+	if err := s.checkRead(ctx, username, channel); err != nil {
+		return nil, false, false, err
+	}
+
+	// one extra message tells whether there are more left, it is the oldest one
+	msgs, found, err = s.r.GetMessagesBefore(ctx, channel, beforeID, maxMessages+1)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	if len(msgs) > maxMessages {
+		return msgs[1:], found, true, nil
+	}
+
+	return msgs, found, false, nil
+}
+
+// GetMessage returns the message, found is false when it isn't archived or when username can't read its channel
+func (s *Service) GetMessage(ctx context.Context, username, id string) (user.Message, bool, error) {
+	msg, found, err := s.r.GetMessage(ctx, id)
+	if err != nil || !found {
+		return user.Message{}, false, err
+	}
+
+	ok, err := s.r.CanRead(ctx, msg.Channel, username)
+	if err != nil || !ok {
+		return user.Message{}, false, err
+	}
+
+	return msg, true, nil
+}
+
+// GetThread returns the message that started the thread and its replies, oldest first. found is false when parentID
+// isn't archived or username can't read it, hasMore is true when there are more than maxMessages replies.
+// maxMessages is capped at 500.
+func (s *Service) GetThread(ctx context.Context, username, parentID string, maxMessages int) (parent user.Message, replies []user.Message, found, hasMore bool, err error) {
+	const limit = 500
+	if maxMessages <= 0 || maxMessages > limit {
+		maxMessages = limit
+	}
+
+	parent, found, err = s.GetMessage(ctx, username, parentID)
+	if err != nil || !found {
+		return user.Message{}, nil, false, false, err
+	}
+
+	// one extra reply tells whether there are more left
+	replies, err = s.r.GetThread(ctx, parentID, maxMessages+1)
+	if err != nil {
+		return user.Message{}, nil, false, false, err
+	}
+
+	if len(replies) > maxMessages {
+		return parent, replies[:maxMessages], true, true, nil
+	}
+
+	return parent, replies, true, false, nil
+}
+
+// ApplyChange applies an edit or a delete that was already authorized by the server that published it
+func (s *Service) ApplyChange(ctx context.Context, change eventbus.MessageChangeCommand) error {
+	switch change.Type {
+	case eventbus.MessageEdit:
+		return s.r.EditMessage(ctx, change.ID, change.Text, change.By, change.Time)
+	case eventbus.MessageDelete:
+		return s.r.DeleteMessage(ctx, change.ID, change.By, change.Time)
+	default:
+		return fmt.Errorf("%w: %s", errUnknownChangeType, change.Type)
+	}
+}
+
+// ToggleReaction applies the reaction command and returns the event to fan out to the servers,
+// found is false when the message can't have reactions (unknown or deleted), there is nothing to fan out then
+func (s *Service) ToggleReaction(ctx context.Context, cmd eventbus.ReactionCommand) (eventbus.ReactionEvent, bool, error) {
+	added, count, found, err := s.r.ToggleReaction(ctx, cmd.MessageID, cmd.Username, cmd.Emoji, cmd.Time)
+	if err != nil || !found {
+		return eventbus.ReactionEvent{}, false, err
+	}
+
+	return eventbus.ReactionEvent{
+		MessageID: cmd.MessageID,
+		Channel:   cmd.Channel,
+		Emoji:     cmd.Emoji,
+		Username:  cmd.Username,
+		Added:     added,
+		Count:     count,
+	}, true, nil
+}
@@ -3,7 +3,10 @@ package archive
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
 	"github.com/ap-pauloafonso/investor-chat/user"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,10 +14,33 @@ import (
 type mockRepository struct {
 	recentMessagesErr error
 	recentMsgs        map[string][]user.Message
+	savedIDs          map[string]bool
+	reactions         map[string]bool     // message id/user/emoji
+	private           map[string][]string // private channel -> members
 	errToReturn       error
 }
 
-func (m *mockRepository) SaveMessage(_ context.Context, c, u, msg string, timestamp time.Time) error {
+func (m *mockRepository) CanRead(_ context.Context, channel, username string) (bool, error) {
+	members, private := m.private[channel]
+	if !private {
+		return true, nil
+	}
+	for _, member := range members {
+		if member == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *mockRepository) SaveMessage(_ context.Context, id, parentID, c, u, msg string, timestamp time.Time) (bool, error) {
+	if m.savedIDs[id] {
+		return false, m.errToReturn
+	}
+	if m.savedIDs == nil {
+		m.savedIDs = map[string]bool{}
+	}
+	m.savedIDs[id] = true
 	if m.recentMsgs == nil {
 		m.recentMsgs = map[string][]user.Message{}
 	}
@@ -22,12 +48,26 @@ func (m *mockRepository) SaveMessage(_ context.Context, c, u, msg string, timest
 		m.recentMsgs[c] = []user.Message{}
 	}
 	m.recentMsgs[c] = append(m.recentMsgs[c], user.Message{
+		ID:        id,
+		ParentID:  parentID,
 		Channel:   c,
 		User:      u,
 		Text:      msg,
 		Timestamp: timestamp,
 	})
-	return m.errToReturn
+	return true, m.errToReturn
+}
+
+func (m *mockRepository) GetThread(_ context.Context, parentID string, maxMessages int) ([]user.Message, error) {
+	replies := []user.Message{}
+	for _, msgs := range m.recentMsgs {
+		for _, msg := range msgs {
+			if msg.ParentID == parentID && len(replies) < maxMessages {
+				replies = append(replies, msg)
+			}
+		}
+	}
+	return replies, m.errToReturn
 }
 
 func (m *mockRepository) GetRecentMessages(_ context.Context, channel string, maxMessages int) ([]user.Message, error) {
@@ -37,29 +77,141 @@ func (m *mockRepository) GetRecentMessages(_ context.Context, channel string, ma
 	return m.recentMsgs[channel], m.recentMessagesErr
 }
 
+func (m *mockRepository) GetMessagesAfter(_ context.Context, channel, afterID string, maxMessages int) ([]user.Message, bool, error) {
+	for i, msg := range m.recentMsgs[channel] {
+		if msg.ID != afterID {
+			continue
+		}
+		r := m.recentMsgs[channel][i+1:]
+		if len(r) > maxMessages {
+			r = r[:maxMessages]
+		}
+		return r, true, m.errToReturn
+	}
+	return nil, false, m.errToReturn
+}
+
+func (m *mockRepository) GetMessagesBefore(_ context.Context, channel, beforeID string, maxMessages int) ([]user.Message, bool, error) {
+	var top []user.Message
+	found := beforeID == ""
+	for _, msg := range m.recentMsgs[channel] {
+		if msg.ID == beforeID {
+			found = true
+			break
+		}
+		if msg.ParentID == "" {
+			top = append(top, msg)
+		}
+	}
+	if !found {
+		return nil, false, m.errToReturn
+	}
+	if len(top) > maxMessages {
+		top = top[len(top)-maxMessages:]
+	}
+	return top, true, m.errToReturn
+}
+
+func (m *mockRepository) GetMessage(_ context.Context, id string) (user.Message, bool, error) {
+	for _, msgs := range m.recentMsgs {
+		for _, msg := range msgs {
+			if msg.ID == id {
+				return msg, true, m.errToReturn
+			}
+		}
+	}
+	return user.Message{}, false, m.errToReturn
+}
+
+func (m *mockRepository) EditMessage(_ context.Context, id, text, _ string, at time.Time) error {
+	m.change(id, func(msg *user.Message) {
+		msg.Text = text
+		msg.EditedAt = at
+	})
+	return m.errToReturn
+}
+
+func (m *mockRepository) DeleteMessage(_ context.Context, id, _ string, _ time.Time) error {
+	m.change(id, func(msg *user.Message) {
+		msg.Text = ""
+		msg.Deleted = true
+	})
+	return m.errToReturn
+}
+
+func (m *mockRepository) ToggleReaction(_ context.Context, id, username, emoji string, _ time.Time) (bool, int, bool, error) {
+	msg, found, _ := m.GetMessage(context.Background(), id)
+	if !found || msg.Deleted {
+		return false, 0, false, m.errToReturn
+	}
+	if m.reactions == nil {
+		m.reactions = map[string]bool{}
+	}
+
+	key := id + "/" + username + "/" + emoji
+	m.reactions[key] = !m.reactions[key]
+
+	count := 0
+	for k, on := range m.reactions {
+		if on && strings.HasPrefix(k, id+"/") && strings.HasSuffix(k, "/"+emoji) {
+			count++
+		}
+	}
+
+	return m.reactions[key], count, true, m.errToReturn
+}
+
+func (m *mockRepository) change(id string, fn func(msg *user.Message)) {
+	for _, msgs := range m.recentMsgs {
+		for i := range msgs {
+			if msgs[i].ID == id && !msgs[i].Deleted {
+				fn(&msgs[i])
+			}
+		}
+	}
+}
+
 func TestSaveMessage(t *testing.T) {
 
 	t.Run("Save Message Successfully", func(t *testing.T) {
 		repo := &mockRepository{}
 
-		service := NewService(repo, nil)
+		service := NewService(repo, nil, nil)
 
 		timestamp := time.Now()
-		err := service.SaveMessage(context.Background(), "channel1", "user1", "Hello", timestamp)
+		err := service.SaveMessage(context.Background(), "m1", "", "channel1", "user1", "Hello", timestamp)
 		if err != nil {
 			t.Errorf("Expected no error, got %v", err)
 		}
 	})
 
+	t.Run("Duplicate Message Is Dropped", func(t *testing.T) {
+		repo := &mockRepository{}
+
+		service := NewService(repo, nil, nil)
+
+		timestamp := time.Now()
+		for i := 0; i < 2; i++ {
+			err := service.SaveMessage(context.Background(), "m1", "", "channel1", "user1", "Hello", timestamp)
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}
+
+		if n := len(repo.recentMsgs["channel1"]); n != 1 {
+			t.Errorf("Expected 1 archived message, got %d", n)
+		}
+	})
+
 	t.Run("Error Saving Message", func(t *testing.T) {
 
 		repo := &mockRepository{}
 
-		service := NewService(repo, nil)
+		service := NewService(repo, nil, nil)
 
 		repo.errToReturn = errors.New("mock repository error")
 		timestamp := time.Now()
-		err := service.SaveMessage(context.Background(), "channel1", "user1", "Hello", timestamp)
+		err := service.SaveMessage(context.Background(), "m1", "", "channel1", "user1", "Hello", timestamp)
 		if !errors.Is(err, repo.errToReturn) {
 			t.Errorf("Expected %v, got %v", repo.errToReturn, err)
 		}
@@ -71,7 +223,7 @@ func TestGetRecentMessages(t *testing.T) {
 	t.Run("Get Recent Messages Successfully", func(t *testing.T) {
 		repo := &mockRepository{}
 
-		service := NewService(repo, nil)
+		service := NewService(repo, nil, nil)
 
 		repo.recentMsgs = map[string][]user.Message{
 			"channel1": {
@@ -80,7 +232,7 @@ func TestGetRecentMessages(t *testing.T) {
 			},
 		}
 
-		messages, err := service.GetRecentMessages(context.Background(), "channel1")
+		messages, err := service.GetRecentMessages(context.Background(), "user1", "channel1")
 		if err != nil {
 			t.Errorf("Expected no error, got %v", err)
 		}
@@ -93,10 +245,10 @@ func TestGetRecentMessages(t *testing.T) {
 		errStore := errors.New("some error")
 		repo := &mockRepository{recentMessagesErr: errStore}
 
-		service := NewService(repo, nil)
+		service := NewService(repo, nil, nil)
 
 		repo.errToReturn = errors.New("mock repository error")
-		messages, err := service.GetRecentMessages(context.Background(), "channel1")
+		messages, err := service.GetRecentMessages(context.Background(), "user1", "channel1")
 		if !errors.Is(err, errStore) {
 			t.Errorf("Expected %v, got %v", repo.errToReturn, err)
 		}
@@ -105,3 +257,271 @@ func TestGetRecentMessages(t *testing.T) {
 		}
 	})
 }
+
+func TestGetMessagesAfter(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo, nil, nil)
+
+	for _, id := range []string{"m1", "m2", "m3", "m4"} {
+		if err := service.SaveMessage(context.Background(), id, "", "channel1", "user1", "text "+id, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Gap Bigger Than The Page", func(t *testing.T) {
+		msgs, found, hasMore, err := service.GetMessagesAfter(context.Background(), "user1", "channel1", "m1", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !hasMore || len(msgs) != 2 || msgs[0].ID != "m2" || msgs[1].ID != "m3" {
+			t.Errorf("unexpected page found=%v hasMore=%v %v", found, hasMore, msgs)
+		}
+	})
+
+	t.Run("Whole Gap", func(t *testing.T) {
+		msgs, found, hasMore, err := service.GetMessagesAfter(context.Background(), "user1", "channel1", "m3", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || hasMore || len(msgs) != 1 || msgs[0].ID != "m4" {
+			t.Errorf("unexpected page found=%v hasMore=%v %v", found, hasMore, msgs)
+		}
+	})
+
+	t.Run("Unknown ID", func(t *testing.T) {
+		msgs, found, _, err := service.GetMessagesAfter(context.Background(), "user1", "channel1", "nope", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found || len(msgs) != 0 {
+			t.Errorf("expected nothing to be found, got %v", msgs)
+		}
+	})
+}
+
+func TestApplyChange(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo, nil, nil)
+
+	for _, id := range []string{"m1", "m2"} {
+		if err := service.SaveMessage(context.Background(), id, "", "channel1", "user1", "text "+id, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Edit", func(t *testing.T) {
+		err := service.ApplyChange(context.Background(), eventbus.MessageChangeCommand{Type: eventbus.MessageEdit, ID: "m1", Text: "fixed", By: "user1", Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _, _ := service.GetMessage(context.Background(), "user1", "m1")
+		if msg.Text != "fixed" || msg.EditedAt.IsZero() {
+			t.Errorf("expected the edited text, got %+v", msg)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := service.ApplyChange(context.Background(), eventbus.MessageChangeCommand{Type: eventbus.MessageDelete, ID: "m2", By: "mod", Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _, _ := service.GetMessage(context.Background(), "user1", "m2")
+		if !msg.Deleted || msg.Text != "" {
+			t.Errorf("expected a tombstone, got %+v", msg)
+		}
+	})
+
+	t.Run("Unknown Type", func(t *testing.T) {
+		err := service.ApplyChange(context.Background(), eventbus.MessageChangeCommand{Type: "pin", ID: "m1"})
+		if !errors.Is(err, errUnknownChangeType) {
+			t.Errorf("expected %v, got %v", errUnknownChangeType, err)
+		}
+	})
+}
+
+func TestToggleReaction(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo, nil, nil)
+
+	if err := service.SaveMessage(context.Background(), "m1", "", "channel1", "user1", "TSLA to the moon", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	toggle := func(username, id string) (eventbus.ReactionEvent, bool) {
+		t.Helper()
+		e, found, err := service.ToggleReaction(context.Background(), eventbus.ReactionCommand{MessageID: id, Channel: "channel1", Emoji: "🚀", Username: username, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e, found
+	}
+
+	t.Run("Add", func(t *testing.T) {
+		toggle("user1", "m1")
+		e, found := toggle("user2", "m1")
+		if !found || !e.Added || e.Count != 2 || e.Username != "user2" || e.Channel != "channel1" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		e, _ := toggle("user1", "m1")
+		if e.Added || e.Count != 1 {
+			t.Errorf("expected the reaction to be removed, got %+v", e)
+		}
+	})
+
+	t.Run("Unknown Message", func(t *testing.T) {
+		if _, found := toggle("user1", "nope"); found {
+			t.Error("expected nothing to fan out")
+		}
+	})
+}
+
+func TestGetThread(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo, nil, nil)
+
+	save := func(id, parentID string) {
+		t.Helper()
+		if err := service.SaveMessage(context.Background(), id, parentID, "channel1", "user1", "text "+id, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("root", "")
+	for _, id := range []string{"r1", "r2", "r3"} {
+		save(id, "root")
+	}
+
+	t.Run("Parent And Replies", func(t *testing.T) {
+		parent, replies, found, hasMore, err := service.GetThread(context.Background(), "user1", "root", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || hasMore || parent.ID != "root" || len(replies) != 3 || replies[0].ID != "r1" {
+			t.Errorf("unexpected thread %+v %+v (found %v, hasMore %v)", parent, replies, found, hasMore)
+		}
+	})
+
+	t.Run("Has More", func(t *testing.T) {
+		_, replies, _, hasMore, err := service.GetThread(context.Background(), "user1", "root", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasMore || len(replies) != 2 {
+			t.Errorf("expected 2 replies and more left, got %d (hasMore %v)", len(replies), hasMore)
+		}
+	})
+
+	t.Run("Unknown Parent", func(t *testing.T) {
+		_, _, found, _, err := service.GetThread(context.Background(), "user1", "nope", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Error("expected the thread not to be found")
+		}
+	})
+}
+
+func TestPrivateChannels(t *testing.T) {
+	repo := &mockRepository{private: map[string][]string{"dm:1": {"user1", "user2"}}}
+	service := NewService(repo, nil, nil)
+
+	if err := service.SaveMessage(context.Background(), "m1", "", "dm:1", "user1", "psst", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Members Read", func(t *testing.T) {
+		messages, err := service.GetRecentMessages(context.Background(), "user2", "dm:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 {
+			t.Errorf("expected 1 message, got %d", len(messages))
+		}
+	})
+
+	t.Run("Others Don't", func(t *testing.T) {
+		if _, err := service.GetRecentMessages(context.Background(), "user3", "dm:1"); !errors.Is(err, ErrForbidden) {
+			t.Errorf("expected %v, got %v", ErrForbidden, err)
+		}
+		if _, _, _, err := service.GetMessagesAfter(context.Background(), "user3", "dm:1", "m1", 10); !errors.Is(err, ErrForbidden) {
+			t.Errorf("expected %v, got %v", ErrForbidden, err)
+		}
+		if _, _, _, err := service.GetMessagesBefore(context.Background(), "user3", "dm:1", "", 10); !errors.Is(err, ErrForbidden) {
+			t.Errorf("expected %v, got %v", ErrForbidden, err)
+		}
+		if _, found, _ := service.GetMessage(context.Background(), "user3", "m1"); found {
+			t.Error("expected the message to be hidden")
+		}
+		if _, _, found, _, _ := service.GetThread(context.Background(), "user3", "m1", 0); found {
+			t.Error("expected the thread to be hidden")
+		}
+	})
+}
+
+func TestGetMessagesBefore(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo, nil, nil)
+
+	now := time.Now()
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("m%d", i)
+		if err := service.SaveMessage(context.Background(), id, "", "channel1", "user1", id, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := service.SaveMessage(context.Background(), "r1", "m2", "channel1", "user2", "reply", now.Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(msgs []user.Message) string {
+		var r []string
+		for _, msg := range msgs {
+			r = append(r, msg.ID)
+		}
+		return strings.Join(r, ",")
+	}
+
+	t.Run("Latest Page", func(t *testing.T) {
+		msgs, found, hasMore, err := service.GetMessagesBefore(context.Background(), "user1", "channel1", "", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || !hasMore {
+			t.Errorf("expected found and more, got %v and %v", found, hasMore)
+		}
+		if got := ids(msgs); got != "m4,m5" {
+			t.Errorf("expected m4,m5, got %s", got)
+		}
+	})
+
+	t.Run("Scroll Back", func(t *testing.T) {
+		msgs, _, hasMore, err := service.GetMessagesBefore(context.Background(), "user1", "channel1", "m4", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(msgs); got != "m2,m3" || !hasMore {
+			t.Errorf("expected m2,m3 with more, got %s and %v", got, hasMore)
+		}
+
+		msgs, _, hasMore, err = service.GetMessagesBefore(context.Background(), "user1", "channel1", "m2", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(msgs); got != "m1" || hasMore {
+			t.Errorf("expected m1 and no more, got %s and %v", got, hasMore)
+		}
+	})
+
+	t.Run("Unknown Cursor", func(t *testing.T) {
+		_, found, _, err := service.GetMessagesBefore(context.Background(), "user1", "channel1", "nope", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Error("expected the cursor not to be found")
+		}
+	})
+}
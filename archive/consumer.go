@@ -3,8 +3,11 @@ package archive
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
 	"github.com/ap-pauloafonso/investor-chat/utils"
 	"github.com/ap-pauloafonso/investor-chat/websocket"
+	"log/slog"
 )
 
 func (s *Service) InitConsumer(ctx context.Context) {
@@ -15,7 +18,12 @@ func (s *Service) InitConsumer(ctx context.Context) {
 			return err
 		}
 
-		err = s.SaveMessage(ctx, obj.Channel, obj.Username, obj.Message, obj.Time)
+		err = s.SaveMessage(ctx, obj.ID, obj.ParentID, obj.Channel, obj.Username, obj.Message, obj.Time)
+		if errors.Is(err, ErrMissingReference) {
+			// it can never be stored, requeueing it would stall the queue
+			slog.Error("[message dropped]", "id", obj.ID, "channel", obj.Channel, "user", obj.Username, "err", err)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -25,4 +33,40 @@ func (s *Service) InitConsumer(ctx context.Context) {
 	if err != nil {
 		utils.LogErrorFatal(err)
 	}
+
+	err = s.eventbus.ConsumeMessageChangeCommandForStorage(func(payload []byte) error {
+		var obj eventbus.MessageChangeCommand
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		return s.ApplyChange(ctx, obj)
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeReactionCommandForStorage(func(payload []byte) error {
+		var obj eventbus.ReactionCommand
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		event, found, err := s.ToggleReaction(ctx, obj)
+		if err != nil || !found {
+			return err
+		}
+
+		j, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		return s.eventbus.PublishReactionEvent(string(j))
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
 }
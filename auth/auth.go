@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const minSecretLength = 32 // bytes, shorter HMAC secrets can be brute forced
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	errNoKeys       = errors.New("no JWT keys configured, set JWT_KEYS or JWT_KEYS_FILE")
+	errUnknownKey   = errors.New("unknown key id")
+)
+
+// KeySpec describes a key as configured: the HMAC secret or the PEM encoded key, inline or in a file.
+// An RS256 or EdDSA key given by its public half can only verify tokens, e.g. one signed by another service.
+type KeySpec struct {
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`            // HS256, RS256 or EdDSA
+	Key       string `json:"key,omitempty"`  // the secret or the PEM itself
+	File      string `json:"file,omitempty"` // or a file with it
+}
+
+// Key is a key ready to sign or verify tokens, the tokens signed with it carry its ID in their kid header
+type Key struct {
+	ID        string
+	method    jwt.SigningMethod
+	signKey   interface{} // nil when the key can only verify
+	verifyKey interface{}
+}
+
+// ParseKeySpecs reads the JSON list of keys given inline and the one in the file, either can be empty
+func ParseKeySpecs(inline, file string) ([]KeySpec, error) {
+	var specs []KeySpec
+	if inline != "" {
+		if err := json.Unmarshal([]byte(inline), &specs); err != nil {
+			return nil, fmt.Errorf("error parsing JWT keys: %w", err)
+		}
+	}
+
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading JWT keys: %w", err)
+		}
+		var fromFile []KeySpec
+		if err := json.Unmarshal(b, &fromFile); err != nil {
+			return nil, fmt.Errorf("error parsing JWT keys in %s: %w", file, err)
+		}
+		specs = append(specs, fromFile...)
+	}
+
+	return specs, nil
+}
+
+// LoadKeys loads every key of the JSON lists given inline and in the file
+func LoadKeys(inline, file string) ([]Key, error) {
+	specs, err := ParseKeySpecs(inline, file)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]Key, 0, len(specs))
+	for _, spec := range specs {
+		k, err := NewKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// NewKey loads the key described by spec
+func NewKey(spec KeySpec) (Key, error) {
+	if spec.ID == "" {
+		return Key{}, errors.New("JWT key without kid")
+	}
+
+	material := []byte(spec.Key)
+	if spec.File != "" {
+		b, err := os.ReadFile(spec.File)
+		if err != nil {
+			return Key{}, fmt.Errorf("error reading JWT key %s: %w", spec.ID, err)
+		}
+		material = b
+	}
+	if len(material) == 0 {
+		return Key{}, fmt.Errorf("JWT key %s has neither key nor file", spec.ID)
+	}
+
+	k := Key{ID: spec.ID}
+	switch spec.Algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		secret := []byte(strings.TrimSpace(string(material)))
+		if len(secret) < minSecretLength {
+			return Key{}, fmt.Errorf("JWT key %s: HS256 secrets need at least %d bytes", spec.ID, minSecretLength)
+		}
+		k.method, k.signKey, k.verifyKey = jwt.SigningMethodHS256, secret, secret
+	case jwt.SigningMethodRS256.Alg():
+		k.method = jwt.SigningMethodRS256
+		if private, err := jwt.ParseRSAPrivateKeyFromPEM(material); err == nil {
+			k.signKey, k.verifyKey = private, &private.PublicKey
+		} else if public, err := jwt.ParseRSAPublicKeyFromPEM(material); err == nil {
+			k.verifyKey = public
+		} else {
+			return Key{}, fmt.Errorf("JWT key %s is not a PEM encoded RSA key", spec.ID)
+		}
+	case jwt.SigningMethodEdDSA.Alg():
+		k.method = jwt.SigningMethodEdDSA
+		if private, err := jwt.ParseEdPrivateKeyFromPEM(material); err == nil {
+			k.signKey, k.verifyKey = private, private.(ed25519.PrivateKey).Public()
+		} else if public, err := jwt.ParseEdPublicKeyFromPEM(material); err == nil {
+			k.verifyKey = public
+		} else {
+			return Key{}, fmt.Errorf("JWT key %s is not a PEM encoded Ed25519 key", spec.ID)
+		}
+	default:
+		return Key{}, fmt.Errorf("JWT key %s: unsupported algorithm %q", spec.ID, spec.Algorithm)
+	}
+
+	return k, nil
+}
+
+// Lifetimes are how long the tokens are valid for. Authenticate checks the login of an access token on every
+// request, so a logout revokes it right away; access tokens are kept short so that a stolen one stops working soon
+// even without that, the refresh token of the login gets new ones.
+type Lifetimes struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+// Claims are what a valid access token tells about its bearer
+type Claims struct {
+	Username string
+	Login    string // the login the token was issued for, logging out of it revokes the token
+}
+
+// Service signs the access tokens with one key and verifies them with any of the configured ones. Keys rotate
+// without logging anyone out: a new key is added and made the signing one, the previous one stays configured
+// until the tokens it signed have expired.
+// It also keeps the logins, each one with the chain of refresh tokens it was given, see Login.
+type Service struct {
+	r         Repository
+	signing   Key
+	keys      map[string]Key
+	lifetimes Lifetimes
+	now       func() time.Time
+}
+
+// NewService uses the key with id signingKeyID to sign, the first one when it is empty
+func NewService(r Repository, keys []Key, signingKeyID string, lifetimes Lifetimes) (*Service, error) {
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+	if signingKeyID == "" {
+		signingKeyID = keys[0].ID
+	}
+
+	s := &Service{r: r, keys: make(map[string]Key, len(keys)), lifetimes: lifetimes, now: time.Now}
+	for _, k := range keys {
+		if _, dup := s.keys[k.ID]; dup {
+			return nil, fmt.Errorf("JWT key %s is configured twice", k.ID)
+		}
+		s.keys[k.ID] = k
+	}
+
+	signing, ok := s.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("signing JWT key %s: %w", signingKeyID, errUnknownKey)
+	}
+	if signing.signKey == nil {
+		return nil, fmt.Errorf("signing JWT key %s has no private key", signingKeyID)
+	}
+	s.signing = signing
+
+	return s, nil
+}
+
+// sign returns an access token for the user's login, signed with the signing key
+func (s *Service) sign(username, login string) (string, time.Time, error) {
+	now := s.now()
+	expires := now.Add(s.lifetimes.Access)
+	token := jwt.NewWithClaims(s.signing.method, jwt.MapClaims{
+		"username": username,
+		"sid":      login,
+		"iat":      now.Unix(),
+		"exp":      expires.Unix(),
+	})
+	token.Header["kid"] = s.signing.ID
+
+	tokenString, err := token.SignedString(s.signing.signKey)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error signing token: %w", err)
+	}
+
+	return tokenString, expires, nil
+}
+
+// Verify checks the access token against the key named in its kid header and its expiry. It doesn't know whether
+// the login was logged out since, Authenticate does.
+func (s *Service) Verify(tokenString string) (Claims, error) {
+	// the claims are checked below against s.now, jwt would only check exp when it is there
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		k, ok := s.keys[kid]
+		if !ok {
+			return nil, errUnknownKey
+		}
+
+		// the algorithm is the key's, never the token's: an RSA public key must not pass for an HMAC secret
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+
+		return k.verifyKey, nil
+	})
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return Claims{}, ErrInvalidToken
+	}
+
+	// a token without exp would never expire
+	if !claims.VerifyExpiresAt(s.now().Unix(), true) {
+		return Claims{}, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	username, _ := claims["username"].(string)
+	login, _ := claims["sid"].(string)
+	if username == "" || login == "" {
+		return Claims{}, ErrInvalidToken
+	}
+
+	return Claims{Username: username, Login: login}, nil
+}
@@ -0,0 +1,464 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const secret = "0123456789abcdef0123456789abcdef"
+
+var lifetimes = Lifetimes{Access: 15 * time.Minute, Refresh: 24 * time.Hour}
+
+func pemBlock(t *testing.T, typ string, der []byte, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}))
+}
+
+// rsaKeys returns a new RSA key pair, PEM encoded
+func rsaKeys(t *testing.T) (private, public string) {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	return pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k), nil), pemBlock(t, "PUBLIC KEY", der, err)
+}
+
+// edKeys returns a new Ed25519 key pair, PEM encoded
+func edKeys(t *testing.T) (private, public string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	private = pemBlock(t, "PRIVATE KEY", privDER, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	return private, pemBlock(t, "PUBLIC KEY", pubDER, err)
+}
+
+func newKey(t *testing.T, spec KeySpec) Key {
+	t.Helper()
+	k, err := NewKey(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSignAndVerify(t *testing.T) {
+	rsaPrivate, _ := rsaKeys(t)
+	edPrivate, _ := edKeys(t)
+
+	for _, spec := range []KeySpec{
+		{ID: "hs", Algorithm: "HS256", Key: secret},
+		{ID: "rs", Algorithm: "RS256", Key: rsaPrivate},
+		{ID: "ed", Algorithm: "EdDSA", Key: edPrivate},
+	} {
+		t.Run(spec.Algorithm, func(t *testing.T) {
+			service, err := NewService(nil, []Key{newKey(t, spec)}, "", lifetimes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, _, err := service.sign("paulo", "l1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Header["kid"] != spec.ID || parsed.Header["alg"] != spec.Algorithm {
+				t.Errorf("expected kid %s and alg %s, got %v", spec.ID, spec.Algorithm, parsed.Header)
+			}
+
+			claims, err := service.Verify(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims != (Claims{Username: "paulo", Login: "l1"}) {
+				t.Errorf("expected paulo's login l1, got %+v", claims)
+			}
+
+			if _, err := service.Verify(token[:len(token)-2]); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected a tampered token to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	rsaPrivate, rsaPublic := rsaKeys(t)
+	old := newKey(t, KeySpec{ID: "2023", Algorithm: "HS256", Key: secret})
+	current := newKey(t, KeySpec{ID: "2024", Algorithm: "RS256", Key: rsaPrivate})
+
+	before, err := NewService(nil, []Key{old}, "", lifetimes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _, err := before.sign("paulo", "l1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new key signs, the old one still verifies what it signed
+	after, err := NewService(nil, []Key{old, current}, "2024", lifetimes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := after.Verify(oldToken); err != nil || claims.Username != "paulo" {
+		t.Errorf("expected the old token to be valid, got %+v and %v", claims, err)
+	}
+	newToken, _, err := after.sign("ana", "l2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Retired Key", func(t *testing.T) {
+		retired, err := NewService(nil, []Key{current}, "", lifetimes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := retired.Verify(oldToken); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the token of the retired key to be rejected, got %v", err)
+		}
+		if _, err := retired.Verify(newToken); err != nil {
+			t.Errorf("expected the token of the current key to be valid, got %v", err)
+		}
+	})
+
+	t.Run("Verification Only", func(t *testing.T) {
+		public := newKey(t, KeySpec{ID: "2024", Algorithm: "RS256", Key: rsaPublic})
+		if _, err := NewService(nil, []Key{public}, "", lifetimes); err == nil {
+			t.Error("expected a public key to be refused as the signing key")
+		}
+
+		verifier, err := NewService(nil, []Key{old, public}, "2023", lifetimes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifier.Verify(newToken); err != nil {
+			t.Errorf("expected the public key to verify, got %v", err)
+		}
+	})
+}
+
+func TestRejectedTokens(t *testing.T) {
+	_, rsaPublic := rsaKeys(t)
+	service, err := NewService(nil, []Key{
+		newKey(t, KeySpec{ID: "hs", Algorithm: "HS256", Key: secret}),
+		newKey(t, KeySpec{ID: "rs", Algorithm: "RS256", Key: rsaPublic}),
+	}, "hs", lifetimes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := jwt.MapClaims{"username": "mallory", "sid": "l1", "exp": time.Now().Add(time.Minute).Unix()}
+	sign := func(kid string, key []byte, claims jwt.MapClaims) string {
+		t.Helper()
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if _, err := service.Verify(sign("hs", []byte(secret), valid)); err != nil {
+		t.Fatalf("expected the valid token to pass, got %v", err)
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{"No Kid", sign("", []byte(secret), valid)},
+		{"Unknown Kid", sign("nope", []byte(secret), valid)},
+		{"Wrong Secret", sign("hs", []byte(strings.Repeat("x", 32)), valid)},
+		// HS256 with the RSA public key as the secret, which anyone can get
+		{"Algorithm Confusion", sign("rs", []byte(rsaPublic), valid)},
+		{"Expired", sign("hs", []byte(secret), jwt.MapClaims{"username": "mallory", "sid": "l1", "exp": time.Now().Add(-time.Second).Unix()})},
+		{"No Expiry", sign("hs", []byte(secret), jwt.MapClaims{"username": "mallory", "sid": "l1"})},
+		{"No Login", sign("hs", []byte(secret), jwt.MapClaims{"username": "mallory", "exp": time.Now().Add(time.Minute).Unix()})},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := service.Verify(tc.token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected %v, got %v", ErrInvalidToken, err)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	edPrivate, _ := edKeys(t)
+	if err := os.WriteFile(filepath.Join(dir, "ed.pem"), []byte(edPrivate), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fileSpecs, _ := json.Marshal([]KeySpec{{ID: "ed", Algorithm: "EdDSA", File: filepath.Join(dir, "ed.pem")}})
+	if err := os.WriteFile(filepath.Join(dir, "keys.json"), fileSpecs, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeys(`[{"kid":"hs","alg":"HS256","key":"`+secret+`"}]`, filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "hs" || keys[1].ID != "ed" {
+		t.Fatalf("expected the inline key then the one in the file, got %+v", keys)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, inline := range map[string]string{
+			"Short Secret":  `[{"kid":"hs","alg":"HS256","key":"short"}]`,
+			"Unknown Alg":   `[{"kid":"x","alg":"none","key":"` + secret + `"}]`,
+			"Missing Kid":   `[{"alg":"HS256","key":"` + secret + `"}]`,
+			"Not A PEM":     `[{"kid":"rs","alg":"RS256","key":"` + secret + `"}]`,
+			"Missing File":  `[{"kid":"hs","alg":"HS256","file":"` + filepath.Join(dir, "nope") + `"}]`,
+			"Not JSON":      `kid=hs`,
+			"Neither Given": `[{"kid":"hs","alg":"HS256"}]`,
+		} {
+			if _, err := LoadKeys(inline, ""); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+
+		if _, err := NewService(nil, nil, "", lifetimes); err == nil {
+			t.Error("expected an error without keys")
+		}
+		if _, err := NewService(nil, keys, "nope", lifetimes); err == nil {
+			t.Error("expected an error for an unknown signing key")
+		}
+		if _, err := NewService(nil, append(keys, keys[0]), "", lifetimes); err == nil {
+			t.Error("expected an error for a key configured twice")
+		}
+	})
+}
+
+// mockRepository keeps the logins in memory, now is the clock of the "database"
+type mockRepository struct {
+	now    func() time.Time
+	logins map[string]mockLogin
+	tokens map[string]RefreshToken
+}
+
+type mockLogin struct {
+	username  string
+	expiresAt time.Time
+}
+
+func newMockRepository(now func() time.Time) *mockRepository {
+	return &mockRepository{now: now, logins: map[string]mockLogin{}, tokens: map[string]RefreshToken{}}
+}
+
+func (m *mockRepository) CreateLogin(_ context.Context, id, username, tokenHash string, expiresAt time.Time) error {
+	m.logins[id] = mockLogin{username: username, expiresAt: expiresAt}
+	m.tokens[tokenHash] = RefreshToken{Login: id, Username: username, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (m *mockRepository) LoginExists(_ context.Context, id string) (bool, error) {
+	l, ok := m.logins[id]
+	return ok && l.expiresAt.After(m.now()), nil
+}
+
+func (m *mockRepository) GetRefreshToken(_ context.Context, tokenHash string) (RefreshToken, bool, error) {
+	t, ok := m.tokens[tokenHash]
+	if _, exists := m.logins[t.Login]; !exists {
+		return RefreshToken{}, false, nil
+	}
+	return t, ok, nil
+}
+
+func (m *mockRepository) UseRefreshToken(ctx context.Context, tokenHash string) (RefreshToken, bool, error) {
+	t, ok, _ := m.GetRefreshToken(ctx, tokenHash)
+	if ok && t.UsedAt == nil {
+		now := m.now()
+		used := t
+		used.UsedAt = &now
+		m.tokens[tokenHash] = used
+	}
+	return t, ok, nil
+}
+
+func (m *mockRepository) AddRefreshToken(_ context.Context, login, tokenHash string, expiresAt time.Time) error {
+	l := m.logins[login]
+	l.expiresAt = expiresAt
+	m.logins[login] = l
+	m.tokens[tokenHash] = RefreshToken{Login: login, Username: l.username, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (m *mockRepository) DeleteLogin(_ context.Context, id string) error {
+	delete(m.logins, id)
+	return nil
+}
+
+func (m *mockRepository) DeleteUserLogins(_ context.Context, username string) error {
+	for id, l := range m.logins {
+		if l.username == username {
+			delete(m.logins, id)
+		}
+	}
+	return nil
+}
+
+func (m *mockRepository) PruneLogins(_ context.Context) error {
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	repo := newMockRepository(clock)
+	service, err := NewService(repo, []Key{newKey(t, KeySpec{ID: "hs", Algorithm: "HS256", Key: secret})}, "", lifetimes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.now = clock
+
+	login := func(t *testing.T, username string) Tokens {
+		t.Helper()
+		tokens, err := service.Login(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens.Username != username || tokens.Login == "" {
+			t.Fatalf("expected a login of %s, got %+v", username, tokens)
+		}
+		return tokens
+	}
+
+	t.Run("Access Token Expires", func(t *testing.T) {
+		tokens := login(t, "paulo")
+		if claims, err := service.Authenticate(ctx, tokens.Access); err != nil || claims.Login != tokens.Login {
+			t.Fatalf("expected the access token of %s, got %+v and %v", tokens.Login, claims, err)
+		}
+		if !tokens.AccessExpires.Equal(now.Add(lifetimes.Access)) || !tokens.RefreshExpires.Equal(now.Add(lifetimes.Refresh)) {
+			t.Errorf("unexpected expiry %v and %v", tokens.AccessExpires, tokens.RefreshExpires)
+		}
+
+		now = now.Add(lifetimes.Access + time.Second)
+		if _, err := service.Authenticate(ctx, tokens.Access); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the expired access token to be rejected, got %v", err)
+		}
+
+		refreshed, err := service.Refresh(ctx, tokens.Refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refreshed.Login != tokens.Login || refreshed.Refresh == tokens.Refresh {
+			t.Errorf("expected a new refresh token for the same login, got %+v", refreshed)
+		}
+		if _, err := service.Authenticate(ctx, refreshed.Access); err != nil {
+			t.Errorf("expected the new access token to be valid, got %v", err)
+		}
+	})
+
+	t.Run("Refresh Token Expires", func(t *testing.T) {
+		tokens := login(t, "paulo")
+		now = now.Add(lifetimes.Refresh)
+		if _, err := service.Refresh(ctx, tokens.Refresh); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the expired refresh token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Reuse", func(t *testing.T) {
+		tokens := login(t, "paulo")
+		refreshed, err := service.Refresh(ctx, tokens.Refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// another tab refreshing at the same time
+		now = now.Add(refreshReuseGrace / 2)
+		if _, err := service.Refresh(ctx, tokens.Refresh); err != nil {
+			t.Errorf("expected the token to be reusable right after, got %v", err)
+		}
+
+		// someone else with a copy of it
+		now = now.Add(refreshReuseGrace)
+		_, err = service.Refresh(ctx, tokens.Refresh)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the reused token to be rejected, got %v", err)
+		}
+		var reused *ReusedTokenError
+		if !errors.As(err, &reused) || reused.Claims != (Claims{Username: "paulo", Login: tokens.Login}) {
+			t.Errorf("expected the login of the reused token to be reported, got %v", err)
+		}
+		if _, err := service.Authenticate(ctx, refreshed.Access); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the login to be logged out, got %v", err)
+		}
+		if _, err := service.Refresh(ctx, refreshed.Refresh); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the newer refresh token to be rejected too, got %v", err)
+		}
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		phone := login(t, "paulo")
+		desktop := login(t, "paulo")
+
+		claims, err := service.Logout(ctx, phone.Refresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims != (Claims{Username: "paulo", Login: phone.Login}) {
+			t.Errorf("expected the login of the phone, got %+v", claims)
+		}
+
+		if _, err := service.Authenticate(ctx, phone.Access); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the access token of the phone to be revoked, got %v", err)
+		}
+		if _, err := service.Refresh(ctx, phone.Refresh); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the refresh token of the phone to be revoked, got %v", err)
+		}
+		if _, err := service.Authenticate(ctx, desktop.Access); err != nil {
+			t.Errorf("expected the desktop to stay logged in, got %v", err)
+		}
+		if _, err := service.Logout(ctx, phone.Refresh); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected the second logout to find nothing, got %v", err)
+		}
+	})
+
+	t.Run("Logout All", func(t *testing.T) {
+		phone := login(t, "paulo")
+		desktop := login(t, "paulo")
+		other := login(t, "ana")
+
+		if err := service.LogoutAll(ctx, "paulo"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tokens := range []Tokens{phone, desktop} {
+			if _, err := service.Authenticate(ctx, tokens.Access); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected %s to be logged out, got %v", tokens.Login, err)
+			}
+		}
+		if _, err := service.Authenticate(ctx, other.Access); err != nil {
+			t.Errorf("expected ana to stay logged in, got %v", err)
+		}
+	})
+}
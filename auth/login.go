@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/utils"
+)
+
+// refreshReuseGrace is how long a refresh token can still be exchanged after it was, the tabs of a browser share
+// the cookie and refresh at the same time when their access token expires
+const refreshReuseGrace = 10 * time.Second
+
+var errLoggedOut = fmt.Errorf("%w: logged out", ErrInvalidToken)
+
+// ReusedTokenError is returned by Refresh for a refresh token used again, the login it belongs to was ended so
+// what was opened with it should be closed too. It is an ErrInvalidToken.
+type ReusedTokenError struct {
+	Claims Claims
+}
+
+func (e *ReusedTokenError) Error() string {
+	return fmt.Sprintf("%v: refresh token of login %s reused", ErrInvalidToken, e.Claims.Login)
+}
+
+func (e *ReusedTokenError) Unwrap() error {
+	return ErrInvalidToken
+}
+
+type Repository interface {
+	// CreateLogin saves a login of the user with its first refresh token
+	CreateLogin(ctx context.Context, id, username, tokenHash string, expiresAt time.Time) error
+	// LoginExists reports whether the login wasn't logged out and its refresh tokens haven't expired
+	LoginExists(ctx context.Context, id string) (bool, error)
+	// GetRefreshToken returns the refresh token with the hash, found is false when there is none
+	GetRefreshToken(ctx context.Context, tokenHash string) (t RefreshToken, found bool, err error)
+	// UseRefreshToken marks the refresh token as used and returns it as it was before, the calls for the same token
+	// are serialized so only one of them sees it unused
+	UseRefreshToken(ctx context.Context, tokenHash string) (t RefreshToken, found bool, err error)
+	// AddRefreshToken adds a refresh token to the login, which lasts until the token expires
+	AddRefreshToken(ctx context.Context, login, tokenHash string, expiresAt time.Time) error
+	// DeleteLogin deletes the login with its refresh tokens
+	DeleteLogin(ctx context.Context, id string) error
+	// DeleteUserLogins deletes every login of the user with their refresh tokens
+	DeleteUserLogins(ctx context.Context, username string) error
+	// PruneLogins deletes the logins whose refresh tokens have all expired
+	PruneLogins(ctx context.Context) error
+}
+
+// RefreshToken is a refresh token as stored, only its hash is kept
+type RefreshToken struct {
+	Login     string
+	Username  string
+	ExpiresAt time.Time
+	UsedAt    *time.Time // nil until it is exchanged for new tokens
+}
+
+// Tokens are what a login, or a refresh, gives the client
+type Tokens struct {
+	Username       string
+	Login          string
+	Access         string
+	AccessExpires  time.Time
+	Refresh        string
+	RefreshExpires time.Time
+}
+
+// Login starts a login of the user, the refresh token of the tokens returned keeps it going
+func (s *Service) Login(ctx context.Context, username string) (Tokens, error) {
+	login := utils.NewID()
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	expires := s.now().Add(s.lifetimes.Refresh)
+	if err := s.r.CreateLogin(ctx, login, username, hash, expires); err != nil {
+		return Tokens{}, err
+	}
+
+	return s.tokens(username, login, refresh, expires)
+}
+
+// Authenticate verifies the access token and checks its login wasn't logged out
+func (s *Service) Authenticate(ctx context.Context, tokenString string) (Claims, error) {
+	claims, err := s.Verify(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	ok, err := s.r.LoginExists(ctx, claims.Login)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !ok {
+		return Claims{}, errLoggedOut
+	}
+
+	return claims, nil
+}
+
+// Refresh exchanges the refresh token for new tokens, the refresh token can't be used again. A token exchanged
+// twice was likely stolen, so the login is logged out: whoever has the other copy can't keep it going. That is
+// reported with a ReusedTokenError.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	t, found, err := s.r.UseRefreshToken(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		return Tokens{}, err
+	}
+	if !found {
+		return Tokens{}, ErrInvalidToken
+	}
+
+	now := s.now()
+	if !t.ExpiresAt.After(now) {
+		return Tokens{}, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if t.UsedAt != nil && now.Sub(*t.UsedAt) > refreshReuseGrace {
+		slog.Warn("[refresh token reused]", "user", t.Username, "login", t.Login)
+		if err := s.r.DeleteLogin(ctx, t.Login); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, &ReusedTokenError{Claims: Claims{Username: t.Username, Login: t.Login}}
+	}
+
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	expires := now.Add(s.lifetimes.Refresh)
+	if err := s.r.AddRefreshToken(ctx, t.Login, hash, expires); err != nil {
+		return Tokens{}, err
+	}
+
+	return s.tokens(t.Username, t.Login, refresh, expires)
+}
+
+// Logout ends the login of the refresh token, its access tokens stop working. It returns the login, to close what
+// was opened with it.
+func (s *Service) Logout(ctx context.Context, refreshToken string) (Claims, error) {
+	t, found, err := s.r.GetRefreshToken(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		return Claims{}, err
+	}
+	if !found {
+		return Claims{}, ErrInvalidToken
+	}
+
+	if err := s.r.DeleteLogin(ctx, t.Login); err != nil {
+		return Claims{}, err
+	}
+
+	return Claims{Username: t.Username, Login: t.Login}, nil
+}
+
+// LogoutAll ends every login of the user
+func (s *Service) LogoutAll(ctx context.Context, username string) error {
+	return s.r.DeleteUserLogins(ctx, username)
+}
+
+// Run deletes the expired logins every interval until ctx is done
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.r.PruneLogins(ctx); err != nil {
+				slog.Error("error pruning logins", "err", err)
+			}
+		}
+	}
+}
+
+func (s *Service) tokens(username, login, refresh string, refreshExpires time.Time) (Tokens, error) {
+	access, accessExpires, err := s.sign(username, login)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		Username:       username,
+		Login:          login,
+		Access:         access,
+		AccessExpires:  accessExpires,
+		Refresh:        refresh,
+		RefreshExpires: refreshExpires,
+	}, nil
+}
+
+// newRefreshToken returns a random refresh token and the hash it is stored by
+func newRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("error generating refresh token: %w", err)
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+// hashRefreshToken is what the refresh tokens are stored by, a leak of the table doesn't give away working tokens
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -40,7 +40,12 @@ func (b *Bot) Process() error {
 
 		var result eventbus.BotCommandResponse
 
+		if obj.MessageID != "" {
+			// derived from the request, so the answers to a retried command are dropped as duplicates
+			result.ID = obj.MessageID + "-bot"
+		}
 		result.GeneratedMessage = message
+		result.ParentID = obj.ParentID
 		result.Channel = obj.Channel
 		result.Time = obj.Time
 
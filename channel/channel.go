@@ -8,6 +8,7 @@ import (
 )
 
 var (
+	ErrChannelNotFound    = errors.New("channel not found")
 	errChannelExists      = errors.New("channel already exists")
 	errChannelNameShort   = errors.New("invalid channel name: needs to have at least 3 characters")
 	errChannelNameLong    = errors.New("invalid channel name: exceed the max amount of 100 characters")
@@ -25,9 +26,15 @@ func NewService(chatRepository Repository, eventbus Eventbus, w WebSocket) *Serv
 }
 
 type Repository interface {
+	// GetChannels returns the public channels, direct ones are listed per user with GetDirectChannels
 	GetChannels(ctx context.Context) ([]string, error)
 	SaveChannel(ctx context.Context, name string) error
 	GetChannel(ctx context.Context, name string) (string, error)
+	// SaveDirectChannel creates the private channel with its members unless it exists already, created reports which
+	// one happened. It returns ErrUserNotFound when a member isn't registered.
+	SaveDirectChannel(ctx context.Context, name string, members []string) (created bool, err error)
+	GetDirectChannels(ctx context.Context, username string) ([]DirectChannel, error)
+	IsMember(ctx context.Context, channel, username string) (bool, error)
 }
 
 func (s *Service) GetAllChannels(ctx context.Context) ([]string, error) {
@@ -36,10 +43,10 @@ func (s *Service) GetAllChannels(ctx context.Context) ([]string, error) {
 
 type Eventbus interface {
 	PublishUpdateChannelsCommand() error
+	PublishDirectChannelEvent(msg string) error
 }
 
 type WebSocket interface {
-	AddNewChannel(channel string)
 	SendRecentMessages(channel, user string, msgs []user.Message) error
 }
 
@@ -71,12 +78,5 @@ func (s *Service) CreateChannel(ctx context.Context, name string) error {
 		return err
 	}
 
-	err = s.eventbus.PublishUpdateChannelsCommand()
-	if err != nil {
-		return err
-	}
-
-	s.websocket.AddNewChannel(name)
-
-	return nil
+	return s.eventbus.PublishUpdateChannelsCommand()
 }
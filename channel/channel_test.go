@@ -16,9 +16,48 @@ type mockRepository struct {
 	channelData       map[string]string
 	recentMsgs        map[string][]user.Message
 	savedChannel      string
+	direct            map[string][]string // direct channel -> members
 	errToReturn       error
 }
 
+func (m *mockRepository) SaveDirectChannel(_ context.Context, name string, members []string) (bool, error) {
+	for _, u := range members {
+		if u == "ghost" {
+			return false, ErrUserNotFound
+		}
+	}
+	if _, ok := m.direct[name]; ok {
+		return false, m.errToReturn
+	}
+	if m.direct == nil {
+		m.direct = map[string][]string{}
+	}
+	m.direct[name] = members
+	return true, m.errToReturn
+}
+
+func (m *mockRepository) GetDirectChannels(_ context.Context, username string) ([]DirectChannel, error) {
+	var r []DirectChannel
+	for name, members := range m.direct {
+		if members[0] == username {
+			r = append(r, DirectChannel{Name: name, With: members[1]})
+		}
+		if members[1] == username {
+			r = append(r, DirectChannel{Name: name, With: members[0]})
+		}
+	}
+	return r, m.errToReturn
+}
+
+func (m *mockRepository) IsMember(_ context.Context, channel, username string) (bool, error) {
+	for _, u := range m.direct[channel] {
+		if u == username {
+			return true, m.errToReturn
+		}
+	}
+	return false, m.errToReturn
+}
+
 func (m *mockRepository) GetChannels(_ context.Context) ([]string, error) {
 	return m.channels, m.errToReturn
 }
@@ -29,6 +68,9 @@ func (m *mockRepository) SaveChannel(_ context.Context, name string) error {
 }
 
 func (m *mockRepository) GetChannel(_ context.Context, name string) (string, error) {
+	if m.channelData != nil && m.channelData[name] == "" {
+		return "", ErrChannelNotFound
+	}
 	return m.channelData[name], m.getChannelErr
 }
 
@@ -57,20 +99,21 @@ func (m *mockRepository) GetRecentMessages(channel string, maxMessages int) ([]u
 
 type mockEventBus struct {
 	errToReturn error
+	direct      []string
 }
 
 func (m *mockEventBus) PublishUpdateChannelsCommand() error {
 	return m.errToReturn
 }
 
-type mockWebSocket struct {
-	addedChannel string
-	sendErr      error
-	msgSent      []user.Message
+func (m *mockEventBus) PublishDirectChannelEvent(msg string) error {
+	m.direct = append(m.direct, msg)
+	return m.errToReturn
 }
 
-func (m *mockWebSocket) AddNewChannel(channel string) {
-	m.addedChannel = channel
+type mockWebSocket struct {
+	sendErr error
+	msgSent []user.Message
 }
 
 func (m *mockWebSocket) SendRecentMessages(_, _ string, msgs []user.Message) error {
@@ -92,9 +135,6 @@ func TestCreateChannel(t *testing.T) {
 		if repo.savedChannel != "newChannel" {
 			t.Errorf("Expected channel 'newChannel' to be saved, got %v", repo.savedChannel)
 		}
-		if ws.addedChannel != "newChannel" {
-			t.Errorf("Expected channel 'newChannel' to be added to WebSocket, got %v", ws.addedChannel)
-		}
 	})
 
 	t.Run("Short Channel Name", func(t *testing.T) {
@@ -171,3 +211,68 @@ func TestCreateChannel(t *testing.T) {
 		}
 	})
 }
+
+func TestOpenDirectChannel(t *testing.T) {
+	repo := &mockRepository{}
+	queue := &mockEventBus{}
+	service := NewService(repo, queue, &mockWebSocket{})
+
+	t.Run("Same Channel Both Ways", func(t *testing.T) {
+		a, err := service.OpenDirectChannel(context.Background(), "paulo", "ana")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := service.OpenDirectChannel(context.Background(), "ana", "paulo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.Name != b.Name || !IsDirect(a.Name) || a.With != "ana" || b.With != "paulo" {
+			t.Errorf("unexpected channels %+v %+v", a, b)
+		}
+		if len(queue.direct) != 1 {
+			t.Errorf("expected the members to be told once, got %d events", len(queue.direct))
+		}
+	})
+
+	t.Run("Usernames Can't Be Confused", func(t *testing.T) {
+		if DirectChannelName("a:b", "c") == DirectChannelName("a", "b:c") {
+			t.Error("expected different channels")
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := service.OpenDirectChannel(context.Background(), "paulo", "paulo"); !errors.Is(err, ErrDirectWithSelf) {
+			t.Errorf("expected %v, got %v", ErrDirectWithSelf, err)
+		}
+		if _, err := service.OpenDirectChannel(context.Background(), "paulo", "ghost"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("expected %v, got %v", ErrUserNotFound, err)
+		}
+	})
+
+	t.Run("Access", func(t *testing.T) {
+		access := NewAccess(&mockRepository{direct: repo.direct, channelData: map[string]string{"default": "default"}})
+		name := DirectChannelName("paulo", "ana")
+
+		for _, c := range []struct {
+			channel, user string
+			want          bool
+		}{
+			{"default", "eve", true},
+			{name, "ana", true},
+			{name, "eve", false},
+		} {
+			ok, err := access.CanAccess(context.Background(), c.channel, c.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != c.want {
+				t.Errorf("%s in %s: expected %v, got %v", c.user, c.channel, c.want, ok)
+			}
+		}
+
+		if _, err := access.CanAccess(context.Background(), "nowhere", "eve"); !errors.Is(err, ErrChannelNotFound) {
+			t.Errorf("expected %v, got %v", ErrChannelNotFound, err)
+		}
+	})
+}
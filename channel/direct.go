@@ -0,0 +1,104 @@
+package channel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+)
+
+// directPrefix can't clash with the public channels, their names are only letters and numbers
+const directPrefix = "dm:"
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrDirectWithSelf = errors.New("a direct conversation needs another user")
+)
+
+// DirectChannel is a private conversation between the user and another one
+type DirectChannel struct {
+	Name string `json:"channel"`
+	With string `json:"with"`
+}
+
+// DirectChannelName returns the channel of the conversation between the two users, whatever their order.
+// Usernames can hold any character so they are hashed instead of joined, the members are kept in the database.
+func DirectChannelName(a, b string) string {
+	members := []string{a, b}
+	sort.Strings(members)
+
+	sum := sha256.Sum256([]byte(members[0] + "\x00" + members[1]))
+	return directPrefix + hex.EncodeToString(sum[:16])
+}
+
+// IsDirect reports whether the channel is a direct conversation
+func IsDirect(name string) bool {
+	return strings.HasPrefix(name, directPrefix)
+}
+
+// OpenDirectChannel returns the conversation between the two users, it is created on the first call
+// and both users are told about it on every instance
+func (s *Service) OpenDirectChannel(ctx context.Context, from, to string) (DirectChannel, error) {
+	if from == to {
+		return DirectChannel{}, ErrDirectWithSelf
+	}
+
+	name := DirectChannelName(from, to)
+	created, err := s.r.SaveDirectChannel(ctx, name, []string{from, to})
+	if errors.Is(err, ErrUserNotFound) {
+		return DirectChannel{}, err
+	}
+	if err != nil {
+		return DirectChannel{}, fmt.Errorf("error opening direct channel: %w", err)
+	}
+
+	if created {
+		j, err := json.Marshal(eventbus.DirectChannelEvent{Channel: name, Members: []string{from, to}})
+		if err != nil {
+			return DirectChannel{}, fmt.Errorf("error serializing DirectChannelEvent: %w", err)
+		}
+
+		if err := s.eventbus.PublishDirectChannelEvent(string(j)); err != nil {
+			return DirectChannel{}, err
+		}
+	}
+
+	return DirectChannel{Name: name, With: to}, nil
+}
+
+// GetDirectChannels returns the conversations of the user
+func (s *Service) GetDirectChannels(ctx context.Context, username string) ([]DirectChannel, error) {
+	return s.r.GetDirectChannels(ctx, username)
+}
+
+// CanAccess reports whether the user can see the channel, see Access
+func (s *Service) CanAccess(ctx context.Context, channel, username string) (bool, error) {
+	return NewAccess(s.r).CanAccess(ctx, channel, username)
+}
+
+// Access tells who can use a channel: public channels are open to everyone, direct ones only to their members.
+// It returns ErrChannelNotFound for a public channel that doesn't exist.
+type Access struct {
+	r Repository
+}
+
+func NewAccess(r Repository) *Access {
+	return &Access{r}
+}
+
+func (a *Access) CanAccess(ctx context.Context, channel, username string) (bool, error) {
+	if !IsDirect(channel) {
+		if _, err := a.r.GetChannel(ctx, channel); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return a.r.IsMember(ctx, channel, username)
+}
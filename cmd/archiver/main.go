@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ap-pauloafonso/investor-chat/archive"
 	"github.com/ap-pauloafonso/investor-chat/config"
 	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/mention"
 	"github.com/ap-pauloafonso/investor-chat/pb"
 	"github.com/ap-pauloafonso/investor-chat/storage"
+	"github.com/ap-pauloafonso/investor-chat/user"
 	"github.com/ap-pauloafonso/investor-chat/utils"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/lmittmann/tint"
 	"github.com/sethvargo/go-envconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"log"
 	"log/slog"
@@ -58,8 +63,10 @@ func main() {
 		utils.LogErrorFatal(err)
 	}
 	defer eventbus.Close()
+	// the archiver records the mentions of the messages it stores
+	mentionService := mention.NewService(storage.NewMentionRepository(db), eventbus)
 	// Create an instance of  archive service
-	archiveService := archive.NewService(repository, eventbus)
+	archiveService := archive.NewService(repository, eventbus, mentionService)
 	// init archiver consumer
 	archiveService.InitConsumer(ctx)
 	// Create an instance of gRPC service
@@ -86,23 +93,88 @@ func NewArchiveGRPCService(service *archive.Service) *ArchiveGRPCService {
 }
 
 func (s *ArchiveGRPCService) GetRecentMessages(ctx context.Context, req *pb.GetRecentMessagesRequest) (*pb.GetRecentMessagesResponse, error) {
-	messages, err := s.service.GetRecentMessages(ctx, req.Channel)
+	messages, err := s.service.GetRecentMessages(ctx, req.Username, req.Channel)
+	if errors.Is(err, archive.ErrForbidden) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s can't read channel %s", req.Username, req.Channel)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	return &pb.GetRecentMessagesResponse{Messages: toPB(messages)}, nil
+}
+
+func (s *ArchiveGRPCService) GetMessagesAfter(ctx context.Context, req *pb.GetMessagesAfterRequest) (*pb.GetMessagesAfterResponse, error) {
+	messages, found, hasMore, err := s.service.GetMessagesAfter(ctx, req.Username, req.Channel, req.AfterId, int(req.MaxMessages))
+	if errors.Is(err, archive.ErrForbidden) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s can't read channel %s", req.Username, req.Channel)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetMessagesAfterResponse{Messages: toPB(messages), Found: found, HasMore: hasMore}, nil
+}
+
+func (s *ArchiveGRPCService) GetMessagesBefore(ctx context.Context, req *pb.GetMessagesBeforeRequest) (*pb.GetMessagesBeforeResponse, error) {
+	messages, found, hasMore, err := s.service.GetMessagesBefore(ctx, req.Username, req.Channel, req.BeforeId, int(req.MaxMessages))
+	if errors.Is(err, archive.ErrForbidden) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s can't read channel %s", req.Username, req.Channel)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetMessagesBeforeResponse{Messages: toPB(messages), Found: found, HasMore: hasMore}, nil
+}
+
+func (s *ArchiveGRPCService) GetMessage(ctx context.Context, req *pb.GetMessageRequest) (*pb.Message, error) {
+	message, found, err := s.service.GetMessage(ctx, req.Username, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "message %s not found", req.Id)
+	}
+
+	return toPB([]user.Message{message})[0], nil
+}
+
+func (s *ArchiveGRPCService) GetThread(ctx context.Context, req *pb.GetThreadRequest) (*pb.GetThreadResponse, error) {
+	parent, replies, found, hasMore, err := s.service.GetThread(ctx, req.Username, req.ParentId, int(req.MaxMessages))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "message %s not found", req.ParentId)
+	}
+
+	return &pb.GetThreadResponse{Parent: toPB([]user.Message{parent})[0], Replies: toPB(replies), HasMore: hasMore}, nil
+}
+
+func toPB(messages []user.Message) []*pb.Message {
 	r := make([]*pb.Message, len(messages))
 
 	for i := range messages {
 
 		var item = messages[i]
 		r[i] = &pb.Message{
-			Channel:   item.Channel,
-			User:      item.User,
-			Text:      item.Text,
-			Timestamp: timestamppb.New(item.Timestamp),
+			Id:         item.ID,
+			Channel:    item.Channel,
+			User:       item.User,
+			Text:       item.Text,
+			Timestamp:  timestamppb.New(item.Timestamp),
+			Deleted:    item.Deleted,
+			ParentId:   item.ParentID,
+			ReplyCount: int32(item.ReplyCount),
+		}
+		if !item.EditedAt.IsZero() {
+			r[i].EditedAt = timestamppb.New(item.EditedAt)
+		}
+		for _, reaction := range item.Reactions {
+			r[i].Reactions = append(r[i].Reactions, &pb.Reaction{Emoji: reaction.Emoji, Count: int32(reaction.Count)})
 		}
 
 	}
-	return &pb.GetRecentMessagesResponse{Messages: r}, nil
+	return r
 }
@@ -47,6 +47,6 @@ func main() {
 	// Block until a signal is received
 	sig := <-c
 
-	slog.Info("Received signal, Server shut down gracefully", sig)
+	slog.Info("Received signal, Server shut down gracefully", "signal", sig)
 
 }
@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/auth"
 	"github.com/ap-pauloafonso/investor-chat/channel"
 	"github.com/ap-pauloafonso/investor-chat/config"
 	"github.com/ap-pauloafonso/investor-chat/eventbus"
 	"github.com/ap-pauloafonso/investor-chat/frontend"
+	"github.com/ap-pauloafonso/investor-chat/mention"
 	"github.com/ap-pauloafonso/investor-chat/pb"
+	"github.com/ap-pauloafonso/investor-chat/presence"
+	"github.com/ap-pauloafonso/investor-chat/ratelimit"
+	"github.com/ap-pauloafonso/investor-chat/readmarker"
+	"github.com/ap-pauloafonso/investor-chat/routing"
 	"github.com/ap-pauloafonso/investor-chat/server"
 	"github.com/ap-pauloafonso/investor-chat/storage"
 	"github.com/ap-pauloafonso/investor-chat/user"
@@ -20,9 +28,11 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -72,33 +82,124 @@ func main() {
 
 	grpcClient := pb.NewArchiveServiceClient(grpcConn)
 
+	instanceID := cfg.InstanceID
+	if instanceID == "" {
+		instanceID, err = os.Hostname()
+		if err != nil {
+			utils.LogErrorFatal(fmt.Errorf("error resolving the instance id: %w", err))
+		}
+	}
+
+	// create presence service
+	presenceService := presence.NewService(instanceID, eventbus, cfg.PresenceTTL)
+
+	// create read marker service
+	readMarkerService := readmarker.NewService(storage.NewReadMarkerRepository(db))
+
+	// create mention service
+	mentionService := mention.NewService(storage.NewMentionRepository(db), eventbus)
+
+	// create rate limiter, the buckets live in the database so every instance enforces the same limits
+	rateLimitService := ratelimit.NewService(storage.NewRateLimitRepository(db),
+		ratelimit.Limit{Burst: cfg.RateLimitUserBurst, Every: cfg.RateLimitUserEvery},
+		ratelimit.Limit{Burst: cfg.RateLimitChannelBurst, Every: cfg.RateLimitChannelEvery},
+		ratelimit.Limit{Burst: cfg.RateLimitBotBurst, Every: cfg.RateLimitBotEvery},
+	)
+	go rateLimitService.Run(ctx, time.Minute)
+
+	// create auth service, it signs the session tokens with one of the configured keys and verifies them with all of them
+	jwtKeys, err := auth.LoadKeys(cfg.JWTKeys, cfg.JWTKeysFile)
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+	authService, err := auth.NewService(storage.NewLoginRepository(db), jwtKeys, cfg.JWTSigningKeyID, auth.Lifetimes{
+		Access:  cfg.AccessTokenTTL,
+		Refresh: cfg.RefreshTokenTTL,
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+	go authService.Run(ctx, time.Hour)
+
+	// the attributes of the session cookies
+	sameSite, err := server.ParseSameSite(cfg.CookieSameSite)
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+	cookies := server.CookieConfig{Secure: cfg.CookieSecure, SameSite: sameSite, Domain: cfg.CookieDomain}
+	if err := cookies.Validate(); err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	// create router, it tells the instances every session is on so a user can be reached wherever they are
+	router := routing.NewService(storage.NewSessionRepository(db), eventbus, instanceID, cfg.SessionTTL)
+
 	// create websocket handler
-	wserver := websocket.NewWebSocketHandler(eventbus, grpcClient)
+	wserver := websocket.NewWebSocketHandler(websocket.Deps{
+		Eventbus:    eventbus,
+		Archive:     grpcClient,
+		Presence:    presenceService,
+		ReadMarkers: readMarkerService,
+		Moderators:  userService,
+		Access:      channel.NewAccess(channelRepository),
+		Mentions:    mentionService,
+		RateLimiter: rateLimitService,
+		Router:      router,
+		Limits: websocket.Limits{
+			MaxMessageLength: cfg.MessageMaxLength,
+			ReadLimit:        cfg.WSReadLimit,
+		},
+		KeepAlive: websocket.KeepAlive{
+			PingInterval: cfg.WSPingInterval,
+			PongTimeout:  cfg.WSPongTimeout,
+			IdleTimeout:  cfg.WSIdleTimeout,
+		},
+		OriginPatterns: cfg.AllowedOrigins,
+	})
 	// start printing the sessions
 	wserver.PrintOnlineUsers()
+	// start sharing our presence with the other instances
+	go presenceService.Run(ctx, cfg.PresenceHeartbeat, wserver.LocalMembers, wserver.BroadcastPresence)
+	// keep the sessions of this instance routable
+	go router.Run(ctx, cfg.SessionHeartbeat, wserver.LocalSessions)
 
 	// create channel service
 	channelService := channel.NewService(channelRepository, eventbus, wserver)
 
 	// Create the application instance
-	server := server.NewApp(ctx, userService, channelService, eventbus, frontend.FS, wserver)
+	server := server.NewApp(ctx, authService, cookies, userService, channelService, presenceService, readMarkerService, mentionService, router, grpcClient, eventbus, frontend.FS, wserver)
+
+	// the metrics are served apart, only what can reach DebugAddr sees them
+	if cfg.DebugAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			if err := http.ListenAndServe(cfg.DebugAddr, mux); err != nil {
+				slog.Error("error serving the debug endpoints", "addr", cfg.DebugAddr, "err", err)
+			}
+		}()
+	}
 
 	// Start the server
 	go func() {
 		slog.Info(fmt.Sprintf("server is running on :%d", cfg.ServerPort))
-		if err := server.E.Start(fmt.Sprintf(":%d", cfg.ServerPort)); err != nil {
+		// Drain shuts it down, Start returns http.ErrServerClosed right away while the drain goes on
+		if err := server.E.Start(fmt.Sprintf(":%d", cfg.ServerPort)); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			utils.LogErrorFatal(err)
 		}
 	}()
 
 	// Wait for a signal to exit
 	sig := <-c
+	slog.Info("Received signal, draining the server", "signal", sig, "timeout", cfg.ShutdownTimeout)
 
-	// Shutdown the server gracefully
-	if err := server.E.Shutdown(context.Background()); err != nil {
-		utils.LogErrorFatal(err)
+	// Shutdown the server gracefully, the clients are moved to the other instances first
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Drain(drainCtx, cfg.DrainDelay); err != nil {
+		slog.Error("error draining the server", "err", err) // out of time, what is left is dropped on exit
 	}
 
-	slog.Info("Received signal, Server shut down gracefully", sig)
+	slog.Info("Server shut down gracefully")
 
 }
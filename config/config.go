@@ -1,9 +1,43 @@
 package config
 
+import "time"
+
 type GlobalConfig struct {
 	ServerPort         int    `env:"SERVER_PORT,required"`
 	ArchiverServerPort int    `env:"ARCHIVER_PORT,required"`
 	PostgresConnection string `env:"POSTGRES_CONNECTION,required"`
 	RabbitmqConnection string `env:"RABBITMQ_CONNECTION,required"`
 	GrpcConnection     string `env:"GRPC_CONNECTION,required"`
+	// JSON lists of {"kid","alg","key" or "file"}, the keys of both are loaded, see auth.KeySpec
+	JWTKeys           string        `env:"JWT_KEYS"`
+	JWTKeysFile       string        `env:"JWT_KEYS_FILE"`
+	JWTSigningKeyID   string        `env:"JWT_SIGNING_KEY_ID"`             // defaults to the first key
+	AccessTokenTTL    time.Duration `env:"ACCESS_TOKEN_TTL,default=15m"`   // the frontend refreshes it when it expires
+	RefreshTokenTTL   time.Duration `env:"REFRESH_TOKEN_TTL,default=168h"` // a login not refreshed for longer has to log in again
+	CookieSecure      bool          `env:"COOKIE_SECURE,default=true"`     // only over https, turn it off for a local setup over plain http
+	CookieSameSite    string        `env:"COOKIE_SAMESITE,default=lax"`    // lax, strict or none
+	CookieDomain      string        `env:"COOKIE_DOMAIN"`                  // defaults to the host of the request
+	AllowedOrigins    []string      `env:"ALLOWED_ORIGINS"`                // hosts of the pages, besides our own, that may open a websocket, e.g. app.example.com
+	InstanceID        string        `env:"INSTANCE_ID"`                    // defaults to the hostname
+	PresenceHeartbeat time.Duration `env:"PRESENCE_HEARTBEAT,default=5s"`
+	PresenceTTL       time.Duration `env:"PRESENCE_TTL,default=15s"`
+	SessionHeartbeat  time.Duration `env:"SESSION_HEARTBEAT,default=10s"` // refreshing the sessions in the routing registry
+	SessionTTL        time.Duration `env:"SESSION_TTL,default=30s"`       // sessions not refreshed for longer aren't routed to
+	WSPingInterval    time.Duration `env:"WS_PING_INTERVAL,default=20s"`
+	WSPongTimeout     time.Duration `env:"WS_PONG_TIMEOUT,default=10s"`
+	WSIdleTimeout     time.Duration `env:"WS_IDLE_TIMEOUT,default=30m"`     // no frames from the client, pongs don't count
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT,default=30s"`    // the whole drain, the process exits after it
+	DrainDelay        time.Duration `env:"DRAIN_DELAY,default=3s"`          // failing the health check before closing the clients
+	MessageMaxLength  int           `env:"MESSAGE_MAX_LENGTH,default=2000"` // characters
+	WSReadLimit       int64         `env:"WS_READ_LIMIT,default=65536"`     // bytes per frame, bigger frames close the connection
+	// token buckets: up to BURST messages at once, then one every EVERY
+	RateLimitUserBurst    int           `env:"RATE_LIMIT_USER_BURST,default=10"`
+	RateLimitUserEvery    time.Duration `env:"RATE_LIMIT_USER_EVERY,default=1s"`
+	RateLimitChannelBurst int           `env:"RATE_LIMIT_CHANNEL_BURST,default=50"`
+	RateLimitChannelEvery time.Duration `env:"RATE_LIMIT_CHANNEL_EVERY,default=100ms"`
+	RateLimitBotBurst     int           `env:"RATE_LIMIT_BOT_BURST,default=3"` // bot commands, per user, on top of the user limit
+	RateLimitBotEvery     time.Duration `env:"RATE_LIMIT_BOT_EVERY,default=10s"`
+
+	// where /debug/vars is served, apart from the public port, empty turns it off
+	DebugAddr string `env:"DEBUG_ADDR,default=localhost:6060"`
 }
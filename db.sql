@@ -20,4 +20,122 @@ CREATE TABLE IF NOT EXISTS messages (
     created_at TIMESTAMPTZ DEFAULT NOW(),
     FOREIGN KEY (channel_name) REFERENCES channels (name),
     FOREIGN KEY (user_name) REFERENCES users (username)
-);
\ No newline at end of file
+);
+
+-- serves the recent messages and the unread counts, both walk a channel by time
+CREATE INDEX IF NOT EXISTS messages_channel_created_at_idx ON messages (channel_name, created_at);
+
+CREATE TABLE IF NOT EXISTS read_markers (
+    user_name TEXT NOT NULL,
+    channel_name TEXT NOT NULL,
+    last_read_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_name, channel_name),
+    FOREIGN KEY (channel_name) REFERENCES channels (name),
+    FOREIGN KEY (user_name) REFERENCES users (username)
+);
+
+-- set by the websocket server, a client retrying a message gets the same id and the copy is dropped
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS message_id TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS messages_message_id_idx ON messages (message_id);
+
+-- moderators can edit and delete the messages of everyone, set by hand
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_moderator BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- a deleted message is kept as a tombstone: no text, who deleted it and when
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by TEXT;
+
+-- every text a message had before an edit or a delete
+CREATE TABLE IF NOT EXISTS message_edits (
+    id SERIAL PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    previous_text TEXT NOT NULL,
+    edited_by TEXT NOT NULL,
+    edited_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES messages (message_id)
+);
+CREATE INDEX IF NOT EXISTS message_edits_message_id_idx ON message_edits (message_id);
+
+-- one row per user and emoji on a message, toggled by the user
+CREATE TABLE IF NOT EXISTS reactions (
+    message_id TEXT NOT NULL,
+    user_name TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (message_id, user_name, emoji),
+    FOREIGN KEY (message_id) REFERENCES messages (message_id),
+    FOREIGN KEY (user_name) REFERENCES users (username)
+);
+
+-- replies point at the message that started their thread
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id TEXT REFERENCES messages (message_id);
+CREATE INDEX IF NOT EXISTS messages_parent_id_idx ON messages (parent_id, created_at);
+
+-- direct channels are private, only their members can see them
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS is_private BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS channel_members (
+    channel_name TEXT NOT NULL,
+    user_name TEXT NOT NULL,
+    PRIMARY KEY (channel_name, user_name),
+    FOREIGN KEY (channel_name) REFERENCES channels (name),
+    FOREIGN KEY (user_name) REFERENCES users (username)
+);
+CREATE INDEX IF NOT EXISTS channel_members_user_name_idx ON channel_members (user_name);
+
+-- users mentioned in a message, delivered_at is set once they were notified live or in the summary on connect
+CREATE TABLE IF NOT EXISTS mentions (
+    message_id TEXT NOT NULL,
+    user_name TEXT NOT NULL,
+    channel_name TEXT NOT NULL,
+    mentioned_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ,
+    PRIMARY KEY (message_id, user_name),
+    FOREIGN KEY (message_id) REFERENCES messages (message_id),
+    FOREIGN KEY (user_name) REFERENCES users (username)
+);
+CREATE INDEX IF NOT EXISTS mentions_user_name_created_at_idx ON mentions (user_name, created_at);
+CREATE INDEX IF NOT EXISTS mentions_undelivered_idx ON mentions (user_name) WHERE delivered_at IS NULL;
+
+-- token buckets of the rate limits, shared by every server instance
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ -- NULL until the bucket is first used, it starts full
+);
+CREATE INDEX IF NOT EXISTS rate_limits_updated_at_idx ON rate_limits (updated_at);
+
+-- websocket sessions open on every server instance, so deliveries for a user go to the instances they are on.
+-- seen_at is refreshed by the instance, the rows of an instance that stopped refreshing them are pruned
+CREATE TABLE IF NOT EXISTS sessions (
+    session_id TEXT PRIMARY KEY,
+    user_name TEXT NOT NULL,
+    instance TEXT NOT NULL,
+    seen_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_name) REFERENCES users (username)
+);
+CREATE INDEX IF NOT EXISTS sessions_user_name_idx ON sessions (user_name);
+CREATE INDEX IF NOT EXISTS sessions_instance_idx ON sessions (instance);
+CREATE INDEX IF NOT EXISTS sessions_seen_at_idx ON sessions (seen_at);
+
+-- a login lasts as long as its latest refresh token, logging out deletes it and its access tokens stop working
+CREATE TABLE IF NOT EXISTS logins (
+    login_id TEXT PRIMARY KEY,
+    user_name TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_name) REFERENCES users (username)
+);
+CREATE INDEX IF NOT EXISTS logins_user_name_idx ON logins (user_name);
+CREATE INDEX IF NOT EXISTS logins_expires_at_idx ON logins (expires_at);
+
+-- the refresh tokens given to a login, by their sha256. A used one is kept to notice when it is used again
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    login_id TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (login_id) REFERENCES logins (login_id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_login_id_idx ON refresh_tokens (login_id);
@@ -11,12 +11,16 @@ const commandRequestRoutingKey = "botrequest-command"
 const commandResponseRoutingKey = "botresponse-command"
 
 type BotCommandRequest struct {
-	Command string
-	Channel string
-	Time    time.Time
+	MessageID string // id of the message that triggered the command
+	ParentID  string // thread of the message that triggered the command, the response goes there too
+	Command   string
+	Channel   string
+	Time      time.Time
 }
 
 type BotCommandResponse struct {
+	ID               string
+	ParentID         string
 	GeneratedMessage string
 	Channel          string
 	Time             time.Time
@@ -0,0 +1,52 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+)
+
+const directChannelRoutingKey = "direct-channel-event"
+
+// DirectChannelEvent announces a new direct conversation, one instance takes it and tells only its members
+type DirectChannelEvent struct {
+	Channel string
+	Members []string
+}
+
+func (e *Eventbus) PublishDirectChannelEvent(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{directChannelRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing direct-channel-event: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Eventbus) ConsumeDirectChannelEvents(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackDiscard // the members find the conversation on their next listing anyway
+			}
+
+			return rabbitmq.Ack
+		},
+		"direct-channel-q", // shared by the instances, each event is handled once
+		rabbitmq.WithConsumerOptionsRoutingKey(directChannelRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
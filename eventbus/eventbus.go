@@ -38,10 +38,16 @@ func New(rabbitmqURL string) (*Eventbus, error) {
 
 }
 
-func (e *Eventbus) Close() {
+// StopConsumers stops receiving, publishing keeps working until Close
+func (e *Eventbus) StopConsumers() {
 	for _, item := range e.consumers {
 		item.Close()
 	}
+	e.consumers = nil
+}
+
+func (e *Eventbus) Close() {
+	e.StopConsumers()
 	e.publisher.Close()
 	e.conn.Close()
 }
@@ -0,0 +1,57 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+	"time"
+)
+
+const mentionRoutingKey = "mention-event"
+
+// MentionEvent tells that a user was mentioned, one instance takes it and sends it to the ones the user is connected to
+type MentionEvent struct {
+	Username  string // who was mentioned
+	MessageID string
+	Channel   string
+	By        string // author of the message
+	Text      string
+	Time      time.Time
+}
+
+func (e *Eventbus) PublishMentionEvent(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{mentionRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing mention-event: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Eventbus) ConsumeMentionEvents(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackDiscard // the mention stays undelivered, it is in the summary of the next connection
+			}
+
+			return rabbitmq.Ack
+		},
+		"mention-q", // shared by the instances, each event is handled once
+		rabbitmq.WithConsumerOptionsRoutingKey(mentionRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
@@ -0,0 +1,90 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+	"time"
+)
+
+const messageChangeRoutingKey = "message-change-command"
+
+// types of MessageChangeCommand
+const (
+	MessageEdit   = "edit"
+	MessageDelete = "delete"
+)
+
+// MessageChangeCommand is an edit or a delete of an archived message, already authorized by the server that
+// published it
+type MessageChangeCommand struct {
+	Type    string
+	ID      string // id of the changed message
+	Channel string
+	Text    string // the new text, empty for a delete
+	By      string // who made the change, the author or a moderator
+	Time    time.Time
+}
+
+func (e *Eventbus) PublishMessageChangeCommand(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{messageChangeRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing message-change-command: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Eventbus) ConsumeMessageChangeCommandForWSBroadcast(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackRequeue
+			}
+
+			return rabbitmq.Ack
+		},
+		"",
+		rabbitmq.WithConsumerOptionsQueueAutoDelete,
+		rabbitmq.WithConsumerOptionsRoutingKey(messageChangeRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
+
+func (e *Eventbus) ConsumeMessageChangeCommandForStorage(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackRequeue
+			}
+
+			return rabbitmq.Ack
+		},
+		"storage-change-q",
+		rabbitmq.WithConsumerOptionsRoutingKey(messageChangeRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+	"time"
+)
+
+const presenceRoutingKey = "presence-event"
+
+const (
+	PresenceJoin     = "join"     // a user opened their first session in a channel on the instance
+	PresenceLeave    = "leave"    // a user closed their last session in a channel on the instance
+	PresenceSnapshot = "snapshot" // the full presence of the instance, sent periodically as a heartbeat
+)
+
+type PresenceEvent struct {
+	Instance string
+	Type     string
+	Channel  string              // join/leave only
+	Username string              // join/leave only
+	Members  map[string][]string // snapshot only: channel -> users
+	Time     time.Time
+}
+
+// PublishPresenceEvent publishes a transient event, presence is rebuilt from the snapshots so nothing is lost
+// if a broker restart drops it
+func (e *Eventbus) PublishPresenceEvent(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{presenceRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing presence-event: %w", err)
+	}
+	return nil
+}
+
+// ConsumePresenceEvents receives the presence events of every instance, including the ones of the caller
+func (e *Eventbus) ConsumePresenceEvents(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackDiscard // a broken event won't get any better, the next snapshot fixes the view
+			}
+			return rabbitmq.Ack
+		},
+		"",
+		rabbitmq.WithConsumerOptionsQueueAutoDelete,
+		rabbitmq.WithConsumerOptionsRoutingKey(presenceRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return fmt.Errorf("error in ConsumePresenceEvents: %w", err)
+	}
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
@@ -0,0 +1,108 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+	"time"
+)
+
+const reactionCommandRoutingKey = "reaction-command"
+
+const reactionEventRoutingKey = "reaction-event"
+
+// ReactionCommand asks the archiver to add the reaction of a user to a message, or to remove it when it's already there
+type ReactionCommand struct {
+	MessageID string
+	Channel   string
+	Emoji     string
+	Username  string
+	Time      time.Time
+}
+
+// ReactionEvent is a ReactionCommand once applied by the archiver, Count is the new total for the emoji on the message
+type ReactionEvent struct {
+	MessageID string
+	Channel   string
+	Emoji     string
+	Username  string
+	Added     bool // false when the toggle removed the reaction
+	Count     int
+}
+
+func (e *Eventbus) PublishReactionCommand(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{reactionCommandRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing reaction-command: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Eventbus) PublishReactionEvent(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{reactionEventRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing reaction-event: %w", err)
+	}
+
+	return nil
+}
+
+func (e *Eventbus) ConsumeReactionCommandForStorage(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackRequeue
+			}
+
+			return rabbitmq.Ack
+		},
+		"storage-reaction-q",
+		rabbitmq.WithConsumerOptionsRoutingKey(reactionCommandRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+
+	return nil
+}
+
+func (e *Eventbus) ConsumeReactionEventForWSBroadcast(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackRequeue
+			}
+
+			return rabbitmq.Ack
+		},
+		"",
+		rabbitmq.WithConsumerOptionsQueueAutoDelete,
+		rabbitmq.WithConsumerOptionsRoutingKey(reactionEventRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
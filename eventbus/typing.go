@@ -0,0 +1,58 @@
+package eventbus
+
+import (
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+	"strconv"
+	"time"
+)
+
+// typing events use their own routing key, so they never reach storage-q and are never archived
+const typingRoutingKey = "typing-event"
+
+// TypingTTL is how long a typing event stays meaningful, both in the queues and on the clients
+const TypingTTL = 5 * time.Second
+
+type TypingEvent struct {
+	Channel  string
+	Username string
+	Time     time.Time
+}
+
+// PublishTypingEvent publishes a transient event that the broker drops if it isn't consumed within TypingTTL
+func (e *Eventbus) PublishTypingEvent(msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{typingRoutingKey},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+		rabbitmq.WithPublishOptionsExpiration(strconv.FormatInt(TypingTTL.Milliseconds(), 10)),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing typing-event: %w", err)
+	}
+	return nil
+}
+
+func (e *Eventbus) ConsumeTypingEvents(fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackDiscard // typing is best effort, never worth a redelivery
+			}
+			return rabbitmq.Ack
+		},
+		"",
+		rabbitmq.WithConsumerOptionsQueueAutoDelete,
+		rabbitmq.WithConsumerOptionsRoutingKey(typingRoutingKey),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return fmt.Errorf("error in ConsumeTypingEvents: %w", err)
+	}
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
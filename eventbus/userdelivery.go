@@ -0,0 +1,64 @@
+package eventbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wagslane/go-rabbitmq"
+)
+
+const userDeliveryRoutingKey = "user-delivery"
+
+// UserDelivery is something for a single user, published only to the instances the user is connected to
+type UserDelivery struct {
+	Username string
+	Channel  string          // when set, only the sessions subscribed to the channel get it
+	Frame    json.RawMessage // websocket frame, queued as is to the sessions
+	Kick     string          // when set, the sessions are closed with this reason instead
+	Login    string          // when set, only the sessions opened with the login get it
+	Mention  string          // when set, the frame is the mention in this message, delivered once a session gets it
+}
+
+func userDeliveryKey(instance string) string {
+	return userDeliveryRoutingKey + "." + instance
+}
+
+// PublishUserDelivery publishes to the queue of a single instance
+func (e *Eventbus) PublishUserDelivery(instance, msg string) error {
+	err := e.publisher.Publish(
+		[]byte(msg),
+		[]string{userDeliveryKey(instance)},
+		rabbitmq.WithPublishOptionsContentType(contentType),
+		rabbitmq.WithPublishOptionsExchange(exchangeName),
+	)
+	if err != nil {
+		return fmt.Errorf("error publishing user-delivery: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeUserDeliveries consumes the queue of this instance, it goes away with the instance
+func (e *Eventbus) ConsumeUserDeliveries(instance string, fn func(payload []byte) error) error {
+	consumer, err := rabbitmq.NewConsumer(
+		e.conn,
+		func(d rabbitmq.Delivery) rabbitmq.Action {
+			err := fn(d.Body)
+			if err != nil {
+				return rabbitmq.NackDiscard // the sessions it was for are gone
+			}
+
+			return rabbitmq.Ack
+		},
+		userDeliveryKey(instance),
+		rabbitmq.WithConsumerOptionsQueueAutoDelete,
+		rabbitmq.WithConsumerOptionsRoutingKey(userDeliveryKey(instance)),
+		rabbitmq.WithConsumerOptionsExchangeName(exchangeName),
+		rabbitmq.WithConsumerOptionsExchangeDeclare,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.consumers = append(e.consumers, consumer)
+	return nil
+}
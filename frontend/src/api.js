@@ -0,0 +1,57 @@
+let refreshing = null;
+let onLoggedOut = () => {};
+
+// called when the login is over, logged out elsewhere or expired
+export function setLoggedOutHandler(fn) {
+  onLoggedOut = fn;
+}
+
+// the requests that change something carry the token of the csrf_token cookie, pages of other sites can't read it
+function withCSRF(init = {}) {
+  const method = (init.method || "GET").toUpperCase();
+  if (method === "GET" || method === "HEAD") {
+    return init;
+  }
+
+  const cookie = document.cookie
+    .split("; ")
+    .find((c) => c.startsWith("csrf_token="));
+  const token = cookie ? decodeURIComponent(cookie.substring("csrf_token=".length)) : "";
+  return { ...init, headers: { ...init.headers, "X-CSRF-Token": token } };
+}
+
+// exchanges the refresh token cookie for new tokens, the calls made meanwhile share the same request
+export function refreshSession() {
+  if (!refreshing) {
+    refreshing = fetch("/api/refresh", withCSRF({ method: "POST" }))
+      .then((response) => response.ok)
+      .catch(() => false)
+      .then((ok) => {
+        refreshing = null;
+        if (!ok) {
+          onLoggedOut();
+        }
+        return ok;
+      });
+  }
+  return refreshing;
+}
+
+// fetch for the API, a request rejected because the access token expired is retried once after refreshing it
+export async function apiFetch(input, init) {
+  const response = await fetch(input, withCSRF(init));
+  if (response.status !== 401 || !(await refreshSession())) {
+    return response;
+  }
+  return fetch(input, withCSRF(init));
+}
+
+// returns the logged in user, refreshing the access token when it expired, or "" when there is no login
+export async function currentUser() {
+  try {
+    const response = await apiFetch("/api/me");
+    return response.ok ? (await response.json()).message : "";
+  } catch (e) {
+    return "";
+  }
+}
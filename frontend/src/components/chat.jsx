@@ -3,11 +3,15 @@ import React, { useEffect, useRef, useState } from "react";
 import { toast } from "react-toastify";
 import Message from "./message";
 import clsx from "clsx";
+import { apiFetch, currentUser, refreshSession } from "../api";
 
-const Chat = ({ userName, logoutFn }) => {
+const Chat = ({ userName, logoutFn, logoutAllFn }) => {
   const [channels, setChannels] = useState([]);
   const [newChannel, setNewChannel] = useState("");
 
+  const [directs, setDirects] = useState([]); // private conversations: {channel, with, unread}
+  const [newDirect, setNewDirect] = useState("");
+
   const [messages, setMessages] = useState([]);
   const [newMessage, setNewMessage] = useState("");
   const [socket, setSocket] = useState(null);
@@ -18,23 +22,256 @@ const Chat = ({ userName, logoutFn }) => {
 
   const [connectedOnce, setConnectedOnce] = useState(false);
 
+  const [typingUsers, setTypingUsers] = useState({}); // username -> expiresAt
+
+  // id of the message whose thread is open, new messages are sent as replies to it meanwhile
+  const [thread, setThread] = useState(null);
+  const lastTypingSent = useRef(0);
+
+  // last message seen, a reconnect to the same channel only asks for what came after it
+  const lastMessage = useRef({ channel: null, id: null });
+
+  // set once the websocket couldn't be opened, the event stream is used from then on
+  const useStream = useRef(false);
+
   const el = useRef(null);
 
   function scrollToBottom() {
     el.current.scrollIntoView({ block: "end", behavior: "smooth" });
   }
 
+  // direct channel names are opaque, name them after the other user
+  const where = (channel) => {
+    const direct = directs.find((d) => d.channel === channel);
+    return direct ? `your conversation with ${direct.with}` : `#${channel}`;
+  };
+
   const handleKeyDown = (event) => {
     if (event.key === "Enter") {
       sendMessage();
     }
   };
 
-  const connectWebSocket = (channel) => {
+  // handles a frame from the server, ws is what answers go through (the websocket or the stream adapter)
+  const handleFrame = (frame, ws) => {
+    const toMessage = (x) => ({
+      id: x.id,
+      msg: x.msg,
+      user: x.username,
+      isBot: x.isBot,
+      time: x.time,
+      edited: !!x.editedAt,
+      deleted: !!x.deleted,
+      reactions: x.reactions || [],
+      parentId: x.parentId,
+      replyCount: x.replyCount || 0,
+    });
+
+    const remember = (x) => {
+      if (x && x.id) {
+        lastMessage.current = { channel: frame.channel, id: x.id };
+      }
+    };
+
+    switch (frame.type) {
+      case "channels_updated":
+        fetchChannels(); // the frame only has the names, refetch to get the unread counts as well
+        return;
+      case "direct_opened":
+        fetchDirects();
+        return;
+      case "mention":
+        toast.info(`${frame.data.by} mentioned you in ${where(frame.data.channel)}: ${frame.data.text}`);
+        return;
+      case "mentions":
+        // what we were mentioned in while offline, the whole list is at /api/mentions
+        toast.info(
+          `You were mentioned ${frame.data.count} time${frame.data.count === 1 ? "" : "s"} while away, last by ${frame.data.mentions[0].by} in ${where(frame.data.mentions[0].channel)}`,
+        );
+        return;
+      case "history":
+        setMessages(frame.data.map(toMessage));
+        remember(frame.data[frame.data.length - 1]);
+        markRead(ws, frame.data[frame.data.length - 1]);
+        break;
+      case "replay":
+        // what we missed while disconnected
+        setMessages((prevMessages) =>
+          appendMessages(prevMessages, frame.data.map(toMessage)),
+        );
+        remember(frame.data[frame.data.length - 1]);
+        markRead(ws, frame.data[frame.data.length - 1]);
+        break;
+      case "message":
+        setMessages((prevMessages) =>
+          appendMessages(prevMessages, [toMessage(frame.data)]),
+        );
+        remember(frame.data);
+        markRead(ws, frame.data);
+        break;
+      case "message_edited":
+        setMessages((prevMessages) =>
+          prevMessages.map((m) =>
+            m.id === frame.data.id
+              ? { ...m, msg: frame.data.text, edited: true }
+              : m
+          )
+        );
+        return;
+      case "message_deleted":
+        setMessages((prevMessages) =>
+          prevMessages.map((m) =>
+            m.id === frame.data.id
+              ? { ...m, msg: "", deleted: true, reactions: [] }
+              : m
+          )
+        );
+        return;
+      case "reaction":
+        setMessages((prevMessages) =>
+          prevMessages.map((m) => {
+            if (m.id !== frame.data.messageId) {
+              return m;
+            }
+            const others = m.reactions.filter(
+              (r) => r.emoji !== frame.data.emoji
+            );
+            const current = m.reactions.find(
+              (r) => r.emoji === frame.data.emoji
+            );
+            if (frame.data.count === 0) {
+              return { ...m, reactions: others };
+            }
+            if (!current) {
+              return {
+                ...m,
+                reactions: [
+                  ...others,
+                  { emoji: frame.data.emoji, count: frame.data.count },
+                ],
+              };
+            }
+            return {
+              ...m,
+              reactions: m.reactions.map((r) =>
+                r.emoji === frame.data.emoji
+                  ? { ...r, count: frame.data.count }
+                  : r
+              ),
+            };
+          })
+        );
+        return;
+      case "typing":
+        setTypingUsers((prev) => ({
+          ...prev,
+          [frame.data.username]: Date.parse(frame.data.expiresAt),
+        }));
+        return;
+      case "error":
+        if (frame.data.code === "rate_limited") {
+          toast.warn(
+            `${frame.data.message}, try again in ${Math.ceil(frame.data.retryAfterMs / 1000)}s`,
+            { position: "top-right", autoClose: 5000 },
+          );
+          return;
+        }
+        toast.error(frame.data.message, {
+          position: "top-right",
+          autoClose: 5000, // Close after 5 seconds
+        });
+        return;
+      default:
+        return; // ignore frame types we don't know about
+    }
+
+    scrollToBottom();
+  };
+
+  // server-sent events fallback, frames arrive on the stream and messages go out as http requests.
+  // Reactions, edits and typing indicators need the websocket.
+  const connectStream = async () => {
+    if (socket) {
+      socket.close();
+    }
+
+    // a websocket can't retry its upgrade after refreshing an expired access token, it is refreshed first
+    if (!(await currentUser())) {
+      return; // logged out
+    }
+
+    const channel = encodeURIComponent(selectedChannel);
+    let uri = `/api/channels/${channel}/stream`;
+    if (lastMessage.current.channel === selectedChannel && lastMessage.current.id) {
+      uri += `?after=${encodeURIComponent(lastMessage.current.id)}`;
+    }
+
+    const es = new EventSource(uri);
+    const conn = {
+      send: (raw) => {
+        const frame = JSON.parse(raw);
+        const request = (method, path, body) =>
+          apiFetch(`/api/channels/${channel}/${path}`, {
+            method,
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify(body),
+          }).then(async (response) => {
+            if (!response.ok) {
+              const err = await response.json();
+              toast.error(err.errorMessage, { position: "top-right", autoClose: 5000 });
+            }
+          });
+
+        if (frame.type === "message") {
+          request("POST", "messages", frame.data);
+        } else if (frame.type === "read") {
+          request("PUT", "read", frame.data);
+        }
+      },
+      close: () => es.close(),
+    };
+    setSocket(conn);
+
+    es.onopen = () => {
+      setIsDisconnected(false);
+      setConnectedOnce(true);
+      console.log("Connected to the event stream");
+    };
+    es.onmessage = (event) => handleFrame(JSON.parse(event.data), conn);
+    es.onerror = () => {
+      setIsDisconnected(true);
+      // the browser reconnects on its own, unless the server refused the stream, e.g. the access token expired
+      if (es.readyState === EventSource.CLOSED) {
+        refreshSession().then((ok) => ok && setTimeout(connectStream, 2000));
+      }
+    };
+    // the server closed the stream on purpose, e.g. 1012 when it restarts or 4003 when the user was kicked
+    es.addEventListener("close", (event) => {
+      es.close();
+      setIsDisconnected(true);
+      if (JSON.parse(event.data).code === 4003) {
+        refreshSession(); // logged out when this login was the one ended
+        return; // no need for reconnection
+      }
+      setTimeout(connectStream, Math.random() * 1000);
+    });
+  };
+
+  const connectWebSocket = async (channel) => {
+    if (useStream.current) {
+      connectStream();
+      return;
+    }
+
     if (socket) {
       socket.close();
     }
 
+    // a websocket can't retry its upgrade after refreshing an expired access token, it is refreshed first
+    if (!(await currentUser())) {
+      return; // logged out
+    }
+
     console.log("connecting....");
 
     var loc = window.location,
@@ -45,69 +282,77 @@ const Chat = ({ userName, logoutFn }) => {
       new_uri = "ws:";
     }
     new_uri += "//" + loc.host + `/ws/${selectedChannel}`;
+    if (lastMessage.current.channel === selectedChannel && lastMessage.current.id) {
+      new_uri += `?after=${encodeURIComponent(lastMessage.current.id)}`;
+    }
 
     const ws = new WebSocket(new_uri);
     setSocket(ws);
 
+    let opened = false;
     ws.onopen = () => {
+      opened = true;
       setIsDisconnected(false);
       setConnectedOnce(true);
       console.log("Connected to the WebSocket server");
     };
 
-    ws.onmessage = (event) => {
-      const message = event.data;
-
-      if (message === "[channel_list_update]") {
-        fetchChannels();
-        return;
-      }
-      const obj = JSON.parse(message);
-
-      if (Array.isArray(obj)) {
-        const mappedArray = obj.map((x) => ({
-          msg: x.Msg,
-          user: x.Username,
-          isBot: x.IsBot,
-
-          time: x.Time,
-        }));
-
-        setMessages(mappedArray);
-      } else {
-        setMessages((prevMessages) => [
-          ...prevMessages,
-          {
-            msg: obj.Msg,
-            user: obj.Username,
-            isBot: obj.IsBot,
-            time: obj.Time,
-          },
-        ]);
-      }
-
-      scrollToBottom();
-    };
+    ws.onmessage = (event) => handleFrame(JSON.parse(event.data), ws);
 
     ws.onclose = (event) => {
-      if (event.wasClean) {
+      // 4000: the server dropped the connection for being idle or unresponsive
+      // 1012: the server is restarting, another instance takes over
+      if (event.wasClean && event.code !== 4000 && event.code !== 1012) {
+        if (event.code === 4003) {
+          refreshSession(); // logged out when this login was the one ended
+        }
         return; // no need for reconnection
       }
 
       setIsDisconnected(true);
-      console.log("attempting to reconnect in 2s...");
-      setTimeout(connectWebSocket, 2000);
+
+      // the upgrade never went through, likely a proxy stripping it, the event stream works over plain http
+      if (!opened && event.code !== 1012) {
+        console.log("websocket unavailable, falling back to server-sent events");
+        useStream.current = true;
+        setTimeout(connectStream, 2000);
+        return;
+      }
+
+      // spread the clients of a restarting server over a second instead of all at once
+      const delay = event.code === 1012 ? Math.random() * 1000 : 2000;
+      console.log(`attempting to reconnect in ${Math.round(delay)}ms...`);
+      setTimeout(connectWebSocket, delay);
     };
   };
 
   useEffect(() => {
     fetchChannels();
+    fetchDirects();
 
     return () => {};
   }, []);
 
+  // drop the typing indicators once they expire
+  useEffect(() => {
+    const interval = setInterval(() => {
+      setTypingUsers((prev) => {
+        const now = Date.now();
+        const next = Object.fromEntries(
+          Object.entries(prev).filter(([, expiresAt]) => expiresAt > now),
+        );
+        return Object.keys(next).length === Object.keys(prev).length
+          ? prev
+          : next;
+      });
+    }, 1000);
+
+    return () => clearInterval(interval);
+  }, []);
+
   useEffect(() => {
     setNewMessage("");
+    setTypingUsers({});
     // Initial WebSocket connection
     connectWebSocket(selectedChannel);
 
@@ -126,20 +371,139 @@ const Chat = ({ userName, logoutFn }) => {
     }
 
     // Send a message to the WebSocket server
-    socket.send(newMessage);
+    socket.send(
+      JSON.stringify({
+        v: 1,
+        type: "message",
+        id: Date.now().toString(36) + Math.random().toString(36).slice(2),
+        data: thread ? { text: newMessage, parentId: thread } : { text: newMessage },
+      }),
+    );
     setNewMessage("");
   };
 
+  // everything up to the message is on screen, move the read marker of the channel there
+  const markRead = (ws, lastMessage) => {
+    ws.send(
+      JSON.stringify({
+        v: 1,
+        type: "read",
+        data: lastMessage ? { at: lastMessage.time } : {},
+      }),
+    );
+  };
+
+  // appends new messages, replies also bump the reply count of the message that started their thread
+  const appendMessages = (prevMessages, newMessages) => {
+    const known = new Set(prevMessages.map((m) => m.id));
+    const added = newMessages.filter((m) => !m.id || !known.has(m.id));
+
+    return [...prevMessages, ...added].map((m) => {
+      const replies = added.filter(
+        (r) => r.parentId && r.parentId === m.id && !r.isBot,
+      ).length;
+      return replies > 0 ? { ...m, replyCount: m.replyCount + replies } : m;
+    });
+  };
+
+  const openThread = async (id) => {
+    setThread(id);
+    try {
+      const response = await apiFetch(`/api/messages/${encodeURIComponent(id)}/thread`);
+      if (!response.ok) {
+        throw new Error("thread could not be loaded");
+      }
+      const data = await response.json();
+      const toMessage = (x) => ({
+        id: x.id,
+        msg: x.msg,
+        user: x.username,
+        time: x.time,
+        edited: !!x.editedAt,
+        deleted: !!x.deleted,
+        reactions: x.reactions || [],
+        parentId: x.parentId,
+        replyCount: x.replyCount || 0,
+      });
+
+      // the replies we already have are kept, the count of the parent comes from the archive
+      setMessages((prevMessages) => {
+        const known = new Set(prevMessages.map((m) => m.id));
+        return [
+          ...prevMessages,
+          ...data.replies.map(toMessage).filter((m) => !known.has(m.id)),
+        ];
+      });
+    } catch (error) {
+      toast.error(error.message, { position: "top-right", autoClose: 5000 });
+    }
+  };
+
+  // adds the reaction, or removes it when we already reacted with the same emoji
+  const react = (messageId, emoji) => {
+    if (isDisconnected || !messageId) {
+      return;
+    }
+
+    socket.send(
+      JSON.stringify({ v: 1, type: "react", data: { messageId, emoji } })
+    );
+  };
+
+  const sendTyping = () => {
+    // the server relays at most one typing event every 2s anyway
+    if (isDisconnected || Date.now() - lastTypingSent.current < 2000) {
+      return;
+    }
+
+    lastTypingSent.current = Date.now();
+    socket.send(JSON.stringify({ v: 1, type: "typing" }));
+  };
+
   function fetchChannels() {
-    fetch("/api/channels")
+    apiFetch("/api/v2/channels")
       .then((x) => x.json())
       .then((data) => setChannels(data.channels));
   }
 
+  function fetchDirects() {
+    apiFetch("/api/direct")
+      .then((x) => x.json())
+      .then((data) => setDirects(data.conversations));
+  }
+
+  // opens the conversation with the user, it is created on the first time
+  const openDirect = async () => {
+    if (newDirect.trim() === "") {
+      return;
+    }
+
+    const response = await apiFetch("/api/direct", {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+      },
+      body: JSON.stringify({ username: newDirect.trim() }),
+    });
+    if (response.ok) {
+      const direct = await response.json();
+      fetchDirects();
+      changeChannel(direct.channel);
+    } else {
+      const err = await response.json();
+      toast.error(err.errorMessage, {
+        position: "top-right",
+        autoClose: 5000, // Close after 5 seconds
+      });
+    }
+
+    setNewDirect("");
+  };
+
   // Function to create a new channel
   const createChannel = async () => {
     if (newChannel.trim() !== "" || isDisconnected) {
-      const response = await fetch("/api/channels", {
+      const response = await apiFetch("/api/channels", {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
@@ -169,6 +533,14 @@ const Chat = ({ userName, logoutFn }) => {
     }
 
     setSelectedChannel(channel);
+    setThread(null);
+    // the channel we are opening is about to be read
+    setDirects((prev) =>
+      prev.map((d) => (d.channel === channel ? { ...d, unread: 0 } : d)),
+    );
+    setChannels((prev) =>
+      prev.map((c) => (c.name === channel ? { ...c, unread: 0 } : c)),
+    );
   }
 
   return (
@@ -186,6 +558,12 @@ const Chat = ({ userName, logoutFn }) => {
             >
               Logout
             </button>
+            <button
+              onClick={logoutAllFn}
+              className="bg-blue-700 text-white px-4 py-2 rounded"
+            >
+              Logout everywhere
+            </button>
           </div>
         </div>
       </nav>
@@ -211,13 +589,19 @@ const Chat = ({ userName, logoutFn }) => {
                 key={index}
                 className={clsx(
                   "mb-2 flex gap-2",
-                  channel !== selectedChannel && "cursor-pointer",
+                  channel.name !== selectedChannel && "cursor-pointer",
                 )}
-                onClick={() => changeChannel(channel)}
+                onClick={() => changeChannel(channel.name)}
               >
-                <span> {channel}</span>
+                <span> {channel.name}</span>
+
+                {channel.name !== selectedChannel && channel.unread > 0 && (
+                  <span className="bg-blue-500 text-white text-xs rounded-full px-2 py-0.5 self-center">
+                    {channel.unread >= 100 ? "99+" : channel.unread}
+                  </span>
+                )}
 
-                {channel === selectedChannel && (
+                {channel.name === selectedChannel && (
                   <div className={"text-green-400"}>
                     <svg
                       xmlns="http://www.w3.org/2000/svg"
@@ -252,6 +636,49 @@ const Chat = ({ userName, logoutFn }) => {
               Add
             </button>
           </div>
+
+          <h2 className="text-xl font-bold mb-4">Direct messages</h2>
+          <ul className={"overflow-y-scroll max-h-[200px]"}>
+            {directs.map((direct) => (
+              <li
+                key={direct.channel}
+                className={clsx(
+                  "mb-2 flex gap-2",
+                  direct.channel !== selectedChannel
+                    ? "cursor-pointer"
+                    : "font-bold",
+                )}
+                onClick={() => changeChannel(direct.channel)}
+              >
+                <span>@{direct.with}</span>
+                {direct.channel !== selectedChannel && direct.unread > 0 && (
+                  <span className="bg-blue-500 text-white text-xs rounded-full px-2 py-0.5 self-center">
+                    {direct.unread >= 100 ? "99+" : direct.unread}
+                  </span>
+                )}
+              </li>
+            ))}
+          </ul>
+          <div className="mt-2 mb-4 relative">
+            <input
+              type="text"
+              value={newDirect}
+              onChange={(e) => setNewDirect(e.target.value)}
+              placeholder="Username"
+              className="w-full p-2 rounded-full border border-gray-300 focus:outline-none"
+              disabled={isDisconnected}
+            />
+            <button
+              onClick={openDirect}
+              className={clsx(
+                "absolute px-4 right-0 top-0 h-10 bg-blue-500 text-white p-2 rounded-full hover-bg-blue-600 transition duration-200",
+                isDisconnected && "opacity-50",
+              )}
+              disabled={isDisconnected}
+            >
+              Open
+            </button>
+          </div>
         </div>
 
         <div className="flex-grow flex w-8/10 p-4  rounded-lg flex-col gap-2 py-2">
@@ -263,25 +690,66 @@ const Chat = ({ userName, logoutFn }) => {
                 "h-full overflow-y-scroll px-[5%] flex flex-col gap-1 pt-2"
               }
             >
-              {messages.map((message, index) => (
-                <Message
-                  key={index}
-                  username={message.user}
-                  isSender={message.user === userName}
-                  message={message.msg}
-                  isBot={message.isBot}
-                  time={message.time}
-                />
-              ))}
+              {messages
+                .filter((message) => !message.parentId)
+                .map((message, index) => (
+                  <Message
+                    key={message.id || index}
+                    username={message.user}
+                    isSender={message.user === userName}
+                    message={message.msg}
+                    isBot={message.isBot}
+                    time={message.time}
+                    edited={message.edited}
+                    deleted={message.deleted}
+                    reactions={message.reactions}
+                    onReact={(emoji) => react(message.id, emoji)}
+                    replyCount={message.replyCount}
+                    onOpenThread={() => openThread(message.id)}
+                  />
+                ))}
               <div id={"el"} ref={el}></div>
             </div>
           </div>
+          {thread && (
+            <div className="bg-white rounded-lg max-h-[250px] overflow-y-scroll px-[5%] py-2 flex flex-col gap-1">
+              <div className="flex justify-between text-sm text-gray-500">
+                <span>Thread</span>
+                <button onClick={() => setThread(null)}>close</button>
+              </div>
+              {messages
+                .filter((m) => m.id === thread || m.parentId === thread)
+                .map((message, index) => (
+                  <Message
+                    key={message.id || index}
+                    username={message.user}
+                    isSender={message.user === userName}
+                    message={message.msg}
+                    isBot={message.isBot}
+                    time={message.time}
+                    edited={message.edited}
+                    deleted={message.deleted}
+                    reactions={message.reactions}
+                    onReact={(emoji) => react(message.id, emoji)}
+                  />
+                ))}
+            </div>
+          )}
+          <div className="h-5 text-sm text-gray-500 px-2">
+            {Object.keys(typingUsers).length > 0 &&
+              `${Object.keys(typingUsers).join(", ")} ${
+                Object.keys(typingUsers).length > 1 ? "are" : "is"
+              } typing...`}
+          </div>
           <div className="mb-4 relative">
             <input
               type="text"
               value={newMessage}
-              onChange={(e) => setNewMessage(e.target.value)}
-              placeholder="Type a message"
+              onChange={(e) => {
+                setNewMessage(e.target.value);
+                sendTyping();
+              }}
+              placeholder={thread ? "Reply in the thread" : "Type a message"}
               className="w-full p-2 rounded-full border border-gray-300 focus:outline-none"
               disabled={isDisconnected}
               onKeyPress={(e) => handleKeyDown(e)}
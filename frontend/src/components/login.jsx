@@ -2,8 +2,9 @@
 
 import React, { useState } from "react";
 import { toast } from "react-toastify";
+import { apiFetch } from "../api";
 
-function Login() {
+function Login({ onLogin }) {
   const [loginUser, setLoginUser] = useState({ username: "", password: "" });
   const [signupUser, setSignupUser] = useState({ username: "", password: "" });
 
@@ -16,7 +17,7 @@ function Login() {
   }
 
   const handleLogin = async () => {
-    const response = await fetch("/api/login", {
+    const response = await apiFetch("/api/login", {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
@@ -31,6 +32,7 @@ function Login() {
         position: "top-right",
         autoClose: 5000, // Close after 5 seconds
       });
+      onLogin(data.message);
     } else {
       toast.error(data.errorMessage, {
         position: "top-right",
@@ -40,7 +42,7 @@ function Login() {
   };
 
   const handleSignup = async () => {
-    const response = await fetch("/api/register", {
+    const response = await apiFetch("/api/register", {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
@@ -53,6 +55,7 @@ function Login() {
         position: "top-right",
         autoClose: 5000, // Close after 5 seconds
       });
+      onLogin((await response.json()).message);
     } else {
       const data = await response.json();
 
@@ -1,6 +1,50 @@
 import React from "react";
 
-const Message = ({ username, message, isSender, isBot,time }) => {
+const quickReactions = ["👍", "🚀", "📉"];
+
+// the totals of the message, clicking one toggles our reaction, the quick ones are always offered
+const Reactions = ({ reactions = [], onReact, isSender, replyCount, onOpenThread }) => {
+  const shown = [
+    ...reactions,
+    ...quickReactions
+      .filter((e) => !reactions.some((r) => r.emoji === e))
+      .map((e) => ({ emoji: e, count: 0 })),
+  ];
+
+  return (
+    <div
+      className={`flex gap-1 text-xs ${isSender ? "justify-end" : "justify-start"}`}
+    >
+      {shown.map((r) => (
+        <button
+          key={r.emoji}
+          onClick={() => onReact(r.emoji)}
+          className={`rounded-full px-1 ${r.count > 0 ? "bg-gray-300" : "opacity-40 hover:opacity-100"}`}
+        >
+          {r.emoji}
+          {r.count > 0 && ` ${r.count}`}
+        </button>
+      ))}
+      {onOpenThread && (
+        <button onClick={onOpenThread} className="text-blue-600 hover:underline px-1">
+          {replyCount > 0 ? `${replyCount} ${replyCount > 1 ? "replies" : "reply"}` : "reply"}
+        </button>
+      )}
+    </div>
+  );
+};
+
+const Message = ({ username, message, isSender, isBot, time, edited, deleted, reactions, onReact, replyCount, onOpenThread }) => {
+  if (deleted) {
+    message = <em className="opacity-70">message deleted</em>;
+  } else if (edited) {
+    message = (
+      <>
+        {message} <span className="text-xs opacity-70">(edited)</span>
+      </>
+    );
+  }
+
   return (
     <>
       {isBot ? (
@@ -47,6 +91,15 @@ const Message = ({ username, message, isSender, isBot,time }) => {
           </div>
         </div>
       )}
+      {!isBot && !deleted && onReact && (
+        <Reactions
+          reactions={reactions}
+          onReact={onReact}
+          isSender={isSender}
+          replyCount={replyCount}
+          onOpenThread={onOpenThread}
+        />
+      )}
     </>
   );
 };
@@ -7,30 +7,43 @@ import "./styles.css";
 import { ToastContainer } from "react-toastify";
 import "react-toastify/dist/ReactToastify.css";
 
-import { CookiesProvider, useCookies } from "react-cookie";
-import jwtDecode from "jwt-decode";
+import { apiFetch, currentUser, setLoggedOutHandler } from "./api";
 
 function App() {
-  const [cookies, setCookie, removeCookie] = useCookies(["token"]);
-
-  const [currentUser, setCurrentUser] = useState("");
+  // null until we know whether there is a login, the token cookie can't be read by scripts
+  const [user, setUser] = useState(null);
 
   useEffect(() => {
-    if (cookies.token) {
-      setCurrentUser(jwtDecode(cookies["token"]).username);
-    }
-  }, [cookies]);
+    setLoggedOutHandler(() => setUser(""));
+    currentUser().then(setUser);
+  }, []);
+
+  // the server ends the login, closes its connections and removes the cookies
+  async function handleLogout() {
+    await apiFetch("/api/logout", { method: "POST" }).catch(() => {});
+    setUser("");
+  }
+
+  // ends every login of the user, on every device
+  async function handleLogoutAll() {
+    await apiFetch("/api/logout/all", { method: "POST" }).catch(() => {});
+    setUser("");
+  }
 
-  function handleLogout() {
-    setCookie("token", "", { path: "/", expires: new Date(0) });
+  if (user === null) {
+    return null;
   }
 
   return (
     <>
-      {cookies.token ? (
-        <Chat logoutFn={handleLogout} userName={currentUser} />
+      {user ? (
+        <Chat
+          logoutFn={handleLogout}
+          logoutAllFn={handleLogoutAll}
+          userName={user}
+        />
       ) : (
-        <Login />
+        <Login onLogin={setUser} />
       )}
 
       <ToastContainer
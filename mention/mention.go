@@ -0,0 +1,150 @@
+package mention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+)
+
+const (
+	maxUsername  = 50  // longer names can't be registered, see user.Service.Register
+	maxMentions  = 20  // per message, the rest of the names are ignored
+	summarySize  = 20  // mentions listed in the summary sent on connect, the count covers all of them
+	inboxSize    = 50  // mentions returned by Inbox when no max is given
+	maxInboxSize = 200 // mentions returned by Inbox at most
+)
+
+// a mention ends at spaces and at the punctuation that usually follows a name in a sentence
+var mentionRegex = regexp.MustCompile(`(?:^|[\s(\[{"'])@([^\s@,;:!?()\[\]{}"'<>]+)`)
+
+type Repository interface {
+	// SaveMentions records the mentions of the message for the given users, skipping the ones that aren't registered,
+	// that can't read the channel or that are the author. It returns the users that were mentioned for the first time.
+	SaveMentions(ctx context.Context, m Mention, usernames []string) ([]string, error)
+	// GetMentions returns the last mentions of the user, newest first
+	GetMentions(ctx context.Context, username string, max int) ([]Mention, error)
+	// TakeUndelivered marks every mention of the user that wasn't delivered yet as delivered and returns them, newest first
+	TakeUndelivered(ctx context.Context, username string) ([]Mention, error)
+	MarkDelivered(ctx context.Context, username, messageID string) error
+}
+
+type Eventbus interface {
+	PublishMentionEvent(msg string) error
+}
+
+// Mention is a message that mentions a user
+type Mention struct {
+	MessageID string    `json:"messageId"`
+	Channel   string    `json:"channel"`
+	By        string    `json:"by"`
+	Text      string    `json:"text"`
+	Time      time.Time `json:"time"`
+}
+
+// Summary is what a user missed while offline
+type Summary struct {
+	Count    int       `json:"count"`
+	Mentions []Mention `json:"mentions"` // the newest ones, at most summarySize
+}
+
+type Service struct {
+	r        Repository
+	eventbus Eventbus
+}
+
+func NewService(r Repository, eventbus Eventbus) *Service {
+	return &Service{r: r, eventbus: eventbus}
+}
+
+// Parse returns the distinct usernames mentioned in the text, in order
+func Parse(text string) []string {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, match := range mentionRegex.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(match[1], ".")
+		if len(name) == 0 || len(name) > maxUsername || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentions {
+			break
+		}
+	}
+
+	return names
+}
+
+// Record stores the mentions of an archived message and announces them, a redelivered message announces nothing
+func (s *Service) Record(ctx context.Context, messageID, channel, by, text string, t time.Time) error {
+	names := Parse(text)
+	if len(names) == 0 || messageID == "" {
+		return nil
+	}
+
+	m := Mention{MessageID: messageID, Channel: channel, By: by, Text: text, Time: t}
+	mentioned, err := s.r.SaveMentions(ctx, m, names)
+	if err != nil {
+		return err
+	}
+
+	for _, username := range mentioned {
+		j, err := json.Marshal(eventbus.MentionEvent{
+			Username:  username,
+			MessageID: m.MessageID,
+			Channel:   m.Channel,
+			By:        m.By,
+			Text:      m.Text,
+			Time:      m.Time,
+		})
+		if err != nil {
+			return fmt.Errorf("error serializing MentionEvent: %w", err)
+		}
+
+		if err := s.eventbus.PublishMentionEvent(string(j)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Inbox returns the last mentions of the user, newest first. max defaults to 50 and is capped at 200.
+func (s *Service) Inbox(ctx context.Context, username string, max int) ([]Mention, error) {
+	if max <= 0 {
+		max = inboxSize
+	}
+	if max > maxInboxSize {
+		max = maxInboxSize
+	}
+
+	return s.r.GetMentions(ctx, username, max)
+}
+
+// Pending returns the summary of the mentions the user got while offline, they won't be returned again.
+// ok is false when there are none.
+func (s *Service) Pending(ctx context.Context, username string) (summary Summary, ok bool, err error) {
+	mentions, err := s.r.TakeUndelivered(ctx, username)
+	if err != nil || len(mentions) == 0 {
+		return Summary{}, false, err
+	}
+
+	summary = Summary{Count: len(mentions), Mentions: mentions}
+	if len(mentions) > summarySize {
+		summary.Mentions = mentions[:summarySize]
+	}
+
+	return summary, true, nil
+}
+
+// Delivered records that the user was notified of the mention live, it won't be in their next summary
+func (s *Service) Delivered(ctx context.Context, username, messageID string) error {
+	return s.r.MarkDelivered(ctx, username, messageID)
+}
@@ -0,0 +1,156 @@
+package mention
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+)
+
+type mockRepository struct {
+	users       map[string]bool // registered users that can read the channel
+	saved       map[string]bool // message id + username
+	undelivered []Mention
+	inboxMax    int
+}
+
+func (m *mockRepository) SaveMentions(_ context.Context, mn Mention, usernames []string) ([]string, error) {
+	var mentioned []string
+	for _, u := range usernames {
+		key := mn.MessageID + "/" + u
+		if !m.users[u] || u == mn.By || m.saved[key] {
+			continue
+		}
+		m.saved[key] = true
+		mentioned = append(mentioned, u)
+	}
+	return mentioned, nil
+}
+
+func (m *mockRepository) GetMentions(_ context.Context, _ string, max int) ([]Mention, error) {
+	m.inboxMax = max
+	return []Mention{}, nil
+}
+
+func (m *mockRepository) TakeUndelivered(_ context.Context, _ string) ([]Mention, error) {
+	taken := m.undelivered
+	m.undelivered = nil
+	return taken, nil
+}
+
+func (m *mockRepository) MarkDelivered(_ context.Context, _, _ string) error {
+	return nil
+}
+
+type mockEventbus struct {
+	events []eventbus.MentionEvent
+}
+
+func (m *mockEventbus) PublishMentionEvent(msg string) error {
+	var e eventbus.MentionEvent
+	if err := json.Unmarshal([]byte(msg), &e); err != nil {
+		return err
+	}
+	m.events = append(m.events, e)
+	return nil
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello there", nil},
+		{"@ana hi", []string{"ana"}},
+		{"hi @ana, @bob and @ana again", []string{"ana", "bob"}},
+		{"ask @ana.", []string{"ana"}},
+		{"(@ana) @bob: @carl! @dan?", []string{"ana", "bob", "carl", "dan"}},
+		{"mail me at paulo@example.com", nil},
+		{"just @ alone", nil},
+		{"@" + strings.Repeat("a", 51), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := Parse(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Capped", func(t *testing.T) {
+		var text []string
+		for i := 0; i < maxMentions+5; i++ {
+			text = append(text, "@user"+strings.Repeat("x", i))
+		}
+		if got := Parse(strings.Join(text, " ")); len(got) != maxMentions {
+			t.Errorf("expected %d names, got %d", maxMentions, len(got))
+		}
+	})
+}
+
+func TestRecord(t *testing.T) {
+	at := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	repo := &mockRepository{users: map[string]bool{"ana": true, "bob": true, "paulo": true}, saved: map[string]bool{}}
+	bus := &mockEventbus{}
+	service := NewService(repo, bus)
+
+	t.Run("Known Users Are Announced", func(t *testing.T) {
+		if err := service.Record(context.Background(), "m1", "general", "paulo", "@ana @ghost @paulo look", at); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []eventbus.MentionEvent{{Username: "ana", MessageID: "m1", Channel: "general", By: "paulo", Text: "@ana @ghost @paulo look", Time: at}}
+		if !reflect.DeepEqual(bus.events, want) {
+			t.Errorf("expected %+v, got %+v", want, bus.events)
+		}
+	})
+
+	t.Run("Redelivery Announces Nothing", func(t *testing.T) {
+		bus.events = nil
+		if err := service.Record(context.Background(), "m1", "general", "paulo", "@ana @ghost @paulo look", at); err != nil {
+			t.Fatal(err)
+		}
+		if len(bus.events) != 0 {
+			t.Errorf("expected no events, got %+v", bus.events)
+		}
+	})
+}
+
+func TestInbox(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo, nil)
+
+	for _, tt := range []struct{ max, want int }{{0, inboxSize}, {10, 10}, {1000, maxInboxSize}} {
+		if _, err := service.Inbox(context.Background(), "ana", tt.max); err != nil {
+			t.Fatal(err)
+		}
+		if repo.inboxMax != tt.want {
+			t.Errorf("Inbox(%d) fetched %d, want %d", tt.max, repo.inboxMax, tt.want)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	repo := &mockRepository{}
+	for i := 0; i < summarySize+5; i++ {
+		repo.undelivered = append(repo.undelivered, Mention{MessageID: "m" + strings.Repeat("x", i)})
+	}
+	service := NewService(repo, nil)
+
+	summary, ok, err := service.Pending(context.Background(), "ana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || summary.Count != summarySize+5 || len(summary.Mentions) != summarySize {
+		t.Errorf("unexpected summary: ok %v, count %d, %d mentions", ok, summary.Count, len(summary.Mentions))
+	}
+
+	if _, ok, _ := service.Pending(context.Background(), "ana"); ok {
+		t.Error("expected the mentions to be handed over once")
+	}
+}
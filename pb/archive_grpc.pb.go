@@ -23,6 +23,10 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type ArchiveServiceClient interface {
 	GetRecentMessages(ctx context.Context, in *GetRecentMessagesRequest, opts ...grpc.CallOption) (*GetRecentMessagesResponse, error)
+	GetMessagesAfter(ctx context.Context, in *GetMessagesAfterRequest, opts ...grpc.CallOption) (*GetMessagesAfterResponse, error)
+	GetMessagesBefore(ctx context.Context, in *GetMessagesBeforeRequest, opts ...grpc.CallOption) (*GetMessagesBeforeResponse, error)
+	GetMessage(ctx context.Context, in *GetMessageRequest, opts ...grpc.CallOption) (*Message, error)
+	GetThread(ctx context.Context, in *GetThreadRequest, opts ...grpc.CallOption) (*GetThreadResponse, error)
 }
 
 type archiveServiceClient struct {
@@ -42,11 +46,51 @@ func (c *archiveServiceClient) GetRecentMessages(ctx context.Context, in *GetRec
 	return out, nil
 }
 
+func (c *archiveServiceClient) GetMessagesAfter(ctx context.Context, in *GetMessagesAfterRequest, opts ...grpc.CallOption) (*GetMessagesAfterResponse, error) {
+	out := new(GetMessagesAfterResponse)
+	err := c.cc.Invoke(ctx, "/pb.ArchiveService/GetMessagesAfter", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveServiceClient) GetMessagesBefore(ctx context.Context, in *GetMessagesBeforeRequest, opts ...grpc.CallOption) (*GetMessagesBeforeResponse, error) {
+	out := new(GetMessagesBeforeResponse)
+	err := c.cc.Invoke(ctx, "/pb.ArchiveService/GetMessagesBefore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveServiceClient) GetMessage(ctx context.Context, in *GetMessageRequest, opts ...grpc.CallOption) (*Message, error) {
+	out := new(Message)
+	err := c.cc.Invoke(ctx, "/pb.ArchiveService/GetMessage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *archiveServiceClient) GetThread(ctx context.Context, in *GetThreadRequest, opts ...grpc.CallOption) (*GetThreadResponse, error) {
+	out := new(GetThreadResponse)
+	err := c.cc.Invoke(ctx, "/pb.ArchiveService/GetThread", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ArchiveServiceServer is the server API for ArchiveService service.
 // All implementations must embed UnimplementedArchiveServiceServer
 // for forward compatibility
 type ArchiveServiceServer interface {
 	GetRecentMessages(context.Context, *GetRecentMessagesRequest) (*GetRecentMessagesResponse, error)
+	GetMessagesAfter(context.Context, *GetMessagesAfterRequest) (*GetMessagesAfterResponse, error)
+	GetMessagesBefore(context.Context, *GetMessagesBeforeRequest) (*GetMessagesBeforeResponse, error)
+	GetMessage(context.Context, *GetMessageRequest) (*Message, error)
+	GetThread(context.Context, *GetThreadRequest) (*GetThreadResponse, error)
 	mustEmbedUnimplementedArchiveServiceServer()
 }
 
@@ -57,6 +101,18 @@ type UnimplementedArchiveServiceServer struct {
 func (UnimplementedArchiveServiceServer) GetRecentMessages(context.Context, *GetRecentMessagesRequest) (*GetRecentMessagesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetRecentMessages not implemented")
 }
+func (UnimplementedArchiveServiceServer) GetMessagesAfter(context.Context, *GetMessagesAfterRequest) (*GetMessagesAfterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMessagesAfter not implemented")
+}
+func (UnimplementedArchiveServiceServer) GetMessagesBefore(context.Context, *GetMessagesBeforeRequest) (*GetMessagesBeforeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMessagesBefore not implemented")
+}
+func (UnimplementedArchiveServiceServer) GetMessage(context.Context, *GetMessageRequest) (*Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMessage not implemented")
+}
+func (UnimplementedArchiveServiceServer) GetThread(context.Context, *GetThreadRequest) (*GetThreadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetThread not implemented")
+}
 func (UnimplementedArchiveServiceServer) mustEmbedUnimplementedArchiveServiceServer() {}
 
 // UnsafeArchiveServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +144,78 @@ func _ArchiveService_GetRecentMessages_Handler(srv interface{}, ctx context.Cont
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ArchiveService_GetMessagesAfter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMessagesAfterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServiceServer).GetMessagesAfter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.ArchiveService/GetMessagesAfter",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServiceServer).GetMessagesAfter(ctx, req.(*GetMessagesAfterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ArchiveService_GetMessagesBefore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMessagesBeforeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServiceServer).GetMessagesBefore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.ArchiveService/GetMessagesBefore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServiceServer).GetMessagesBefore(ctx, req.(*GetMessagesBeforeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ArchiveService_GetMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServiceServer).GetMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.ArchiveService/GetMessage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServiceServer).GetMessage(ctx, req.(*GetMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ArchiveService_GetThread_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetThreadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ArchiveServiceServer).GetThread(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.ArchiveService/GetThread",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ArchiveServiceServer).GetThread(ctx, req.(*GetThreadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // ArchiveService_ServiceDesc is the grpc.ServiceDesc for ArchiveService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,6 +227,22 @@ var ArchiveService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetRecentMessages",
 			Handler:    _ArchiveService_GetRecentMessages_Handler,
 		},
+		{
+			MethodName: "GetMessagesAfter",
+			Handler:    _ArchiveService_GetMessagesAfter_Handler,
+		},
+		{
+			MethodName: "GetMessagesBefore",
+			Handler:    _ArchiveService_GetMessagesBefore_Handler,
+		},
+		{
+			MethodName: "GetMessage",
+			Handler:    _ArchiveService_GetMessage_Handler,
+		},
+		{
+			MethodName: "GetThread",
+			Handler:    _ArchiveService_GetThread_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "archive.proto",
@@ -0,0 +1,249 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownEventType = errors.New("unknown presence event type")
+)
+
+type Eventbus interface {
+	PublishPresenceEvent(msg string) error
+}
+
+// Change is a user going online or offline in a channel, as seen by the whole cluster
+type Change struct {
+	Channel  string
+	Username string
+	Online   bool
+}
+
+type instanceState struct {
+	lastSeen time.Time
+	channels map[string]map[string]struct{} // channel -> users
+}
+
+// Service keeps a merged view of who is connected to each channel across every server instance.
+// Each instance publishes joins and leaves as they happen plus a periodic snapshot of its whole presence,
+// the snapshot doubles as a heartbeat: instances that stop sending it (e.g. crashed) are dropped after ttl.
+type Service struct {
+	instance string
+	eventbus Eventbus
+	ttl      time.Duration
+	now      func() time.Time
+
+	instances    map[string]*instanceState
+	sync.RWMutex // for mutual exclusion while operating over instances
+}
+
+func NewService(instance string, eventbus Eventbus, ttl time.Duration) *Service {
+	return &Service{
+		instance:  instance,
+		eventbus:  eventbus,
+		ttl:       ttl,
+		now:       time.Now,
+		instances: map[string]*instanceState{},
+	}
+}
+
+// Joined announces that a user opened their first session in a channel on this instance
+func (s *Service) Joined(channel, username string) error {
+	return s.publish(eventbus.PresenceEvent{Type: eventbus.PresenceJoin, Channel: channel, Username: username})
+}
+
+// Left announces that a user closed their last session in a channel on this instance
+func (s *Service) Left(channel, username string) error {
+	return s.publish(eventbus.PresenceEvent{Type: eventbus.PresenceLeave, Channel: channel, Username: username})
+}
+
+// Heartbeat announces the whole presence of this instance (channel -> users)
+func (s *Service) Heartbeat(members map[string][]string) error {
+	return s.publish(eventbus.PresenceEvent{Type: eventbus.PresenceSnapshot, Members: members})
+}
+
+func (s *Service) publish(e eventbus.PresenceEvent) error {
+	e.Instance = s.instance
+	e.Time = s.now()
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error serializing PresenceEvent: %w", err)
+	}
+
+	return s.eventbus.PublishPresenceEvent(string(j))
+}
+
+// Apply merges an event published by any instance (this one included) and returns what changed cluster-wide
+func (s *Service) Apply(payload []byte) ([]Change, error) {
+	var e eventbus.PresenceEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	state, ok := s.instances[e.Instance]
+	if !ok {
+		state = &instanceState{channels: map[string]map[string]struct{}{}}
+		s.instances[e.Instance] = state
+	}
+	state.lastSeen = s.now()
+
+	switch e.Type {
+	case eventbus.PresenceJoin:
+		return s.mutateLocked([]Change{{Channel: e.Channel, Username: e.Username}}, func() {
+			if state.channels[e.Channel] == nil {
+				state.channels[e.Channel] = map[string]struct{}{}
+			}
+			state.channels[e.Channel][e.Username] = struct{}{}
+		}), nil
+	case eventbus.PresenceLeave:
+		return s.mutateLocked([]Change{{Channel: e.Channel, Username: e.Username}}, func() {
+			delete(state.channels[e.Channel], e.Username)
+			if len(state.channels[e.Channel]) == 0 {
+				delete(state.channels, e.Channel)
+			}
+		}), nil
+	case eventbus.PresenceSnapshot:
+		affected := pairs(state.channels)
+		for channel, users := range e.Members {
+			for _, u := range users {
+				affected = append(affected, Change{Channel: channel, Username: u})
+			}
+		}
+
+		return s.mutateLocked(affected, func() {
+			state.channels = map[string]map[string]struct{}{}
+			for channel, users := range e.Members {
+				state.channels[channel] = map[string]struct{}{}
+				for _, u := range users {
+					state.channels[channel][u] = struct{}{}
+				}
+			}
+		}), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownEventType, e.Type)
+	}
+}
+
+// Expire drops the instances that haven't been heard of within ttl and returns what changed cluster-wide
+func (s *Service) Expire() []Change {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+
+	var expired []string
+	var affected []Change
+	for instance, state := range s.instances {
+		if now.Sub(state.lastSeen) > s.ttl {
+			expired = append(expired, instance)
+			affected = append(affected, pairs(state.channels)...)
+		}
+	}
+
+	return s.mutateLocked(affected, func() {
+		for _, instance := range expired {
+			delete(s.instances, instance)
+		}
+	})
+}
+
+// mutateLocked applies fn and returns the affected pairs whose cluster-wide state was flipped by it
+func (s *Service) mutateLocked(affected []Change, fn func()) []Change {
+	before := make([]bool, len(affected))
+	for i, c := range affected {
+		before[i] = s.isOnlineLocked(c.Channel, c.Username)
+	}
+
+	fn()
+
+	var changes []Change
+	seen := map[Change]bool{}
+	for i, c := range affected {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		if after := s.isOnlineLocked(c.Channel, c.Username); after != before[i] {
+			c.Online = after
+			changes = append(changes, c)
+		}
+	}
+
+	return changes
+}
+
+func (s *Service) isOnlineLocked(channel, username string) bool {
+	for _, state := range s.instances {
+		if _, ok := state.channels[channel][username]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Members returns the users connected to the channel on any instance, sorted by name
+func (s *Service) Members(channel string) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	set := map[string]struct{}{}
+	for _, state := range s.instances {
+		for u := range state.channels[channel] {
+			set[u] = struct{}{}
+		}
+	}
+
+	members := make([]string, 0, len(set))
+	for u := range set {
+		members = append(members, u)
+	}
+	sort.Strings(members)
+
+	return members
+}
+
+func pairs(channels map[string]map[string]struct{}) []Change {
+	var r []Change
+	for channel, users := range channels {
+		for u := range users {
+			r = append(r, Change{Channel: channel, Username: u})
+		}
+	}
+	return r
+}
+
+// Run sends a heartbeat with the local presence every interval and expires the instances that went silent,
+// changes are handed to onChange. It blocks until ctx is done.
+func (s *Service) Run(ctx context.Context, interval time.Duration, local func() map[string][]string, onChange func([]Change)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Heartbeat(local()); err != nil {
+			slog.Error("error sending presence heartbeat", "err", err)
+		}
+
+		if changes := s.Expire(); len(changes) > 0 {
+			onChange(changes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package presence
+
+import (
+	"encoding/json"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type mockEventbus struct {
+	published []string
+}
+
+func (m *mockEventbus) PublishPresenceEvent(msg string) error {
+	m.published = append(m.published, msg)
+	return nil
+}
+
+func event(t *testing.T, e eventbus.PresenceEvent) []byte {
+	t.Helper()
+	j, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestPublish(t *testing.T) {
+	bus := &mockEventbus{}
+	service := NewService("server1", bus, time.Minute)
+
+	if err := service.Joined("default", "paulo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// what gets published is exactly what every instance applies
+	changes, err := service.Apply([]byte(bus.published[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Change{{Channel: "default", Username: "paulo", Online: true}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %v, want %v", changes, want)
+	}
+}
+
+func TestApply(t *testing.T) {
+	service := NewService("server1", &mockEventbus{}, time.Minute)
+
+	t.Run("Join On Two Instances", func(t *testing.T) {
+		changes, err := service.Apply(event(t, eventbus.PresenceEvent{Instance: "server1", Type: eventbus.PresenceJoin, Channel: "default", Username: "paulo"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || !changes[0].Online {
+			t.Errorf("expected paulo to come online, got %v", changes)
+		}
+
+		changes, err = service.Apply(event(t, eventbus.PresenceEvent{Instance: "server2", Type: eventbus.PresenceJoin, Channel: "default", Username: "paulo"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 0 {
+			t.Errorf("expected no change for a user already online elsewhere, got %v", changes)
+		}
+	})
+
+	t.Run("Leave One Instance Keeps User Online", func(t *testing.T) {
+		changes, err := service.Apply(event(t, eventbus.PresenceEvent{Instance: "server1", Type: eventbus.PresenceLeave, Channel: "default", Username: "paulo"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 0 {
+			t.Errorf("expected no change, got %v", changes)
+		}
+		if members := service.Members("default"); !reflect.DeepEqual(members, []string{"paulo"}) {
+			t.Errorf("expected paulo to still be a member, got %v", members)
+		}
+	})
+
+	t.Run("Snapshot Replaces Instance State", func(t *testing.T) {
+		changes, err := service.Apply(event(t, eventbus.PresenceEvent{Instance: "server2", Type: eventbus.PresenceSnapshot, Members: map[string][]string{
+			"default": {"ana"},
+		}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 2 {
+			t.Errorf("expected ana online and paulo offline, got %v", changes)
+		}
+		if members := service.Members("default"); !reflect.DeepEqual(members, []string{"ana"}) {
+			t.Errorf("expected only ana, got %v", members)
+		}
+	})
+
+	t.Run("Unknown Event Type", func(t *testing.T) {
+		_, err := service.Apply(event(t, eventbus.PresenceEvent{Instance: "server2", Type: "dance"}))
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+	service := NewService("server1", &mockEventbus{}, 15*time.Second)
+	service.now = func() time.Time { return now }
+
+	_, err := service.Apply(event(t, eventbus.PresenceEvent{Instance: "crashed", Type: eventbus.PresenceJoin, Channel: "default", Username: "paulo"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.Apply(event(t, eventbus.PresenceEvent{Instance: "alive", Type: eventbus.PresenceJoin, Channel: "default", Username: "ana"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(10 * time.Second)
+	if changes := service.Expire(); len(changes) != 0 {
+		t.Errorf("expected nothing to expire yet, got %v", changes)
+	}
+
+	// only the alive instance keeps sending heartbeats
+	_, err = service.Apply(event(t, eventbus.PresenceEvent{Instance: "alive", Type: eventbus.PresenceSnapshot, Members: map[string][]string{"default": {"ana"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(10 * time.Second)
+	changes := service.Expire()
+	want := []Change{{Channel: "default", Username: "paulo", Online: false}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %v, want %v", changes, want)
+	}
+	if members := service.Members("default"); !reflect.DeepEqual(members, []string{"ana"}) {
+		t.Errorf("expected only ana, got %v", members)
+	}
+}
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Limit is a token bucket: it holds up to Burst tokens and gets a new one every Every, each message takes one
+type Limit struct {
+	Burst int
+	Every time.Duration
+}
+
+// Bucket is the stored state of a bucket, a zero UpdatedAt is a bucket never used, which is full
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+type Repository interface {
+	// Update loads the buckets of the keys, locked so the other instances wait for it, and stores what fn returns.
+	// now is the clock of the database, the same for every instance.
+	Update(ctx context.Context, keys []string, fn func(now time.Time, buckets []Bucket) []Bucket) error
+	// Prune deletes the buckets not used for longer than idle
+	Prune(ctx context.Context, idle time.Duration) error
+}
+
+// Decision is the outcome of a check, RetryAfter is how long until it would be allowed when it isn't
+type Decision struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// Service limits how fast messages are sent, per user and per channel, across every server instance.
+// Bot commands also count against a stricter bucket of their own.
+type Service struct {
+	r       Repository
+	user    Limit
+	channel Limit
+	bot     Limit
+}
+
+func NewService(r Repository, user, channel, bot Limit) *Service {
+	return &Service{r: r, user: user, channel: channel, bot: bot}
+}
+
+// AllowMessage takes a token from every bucket the message counts against, or none of them when one is empty
+func (s *Service) AllowMessage(ctx context.Context, username, channel string, botCommand bool) (Decision, error) {
+	keys := []string{"user:" + username, "channel:" + channel}
+	limits := []Limit{s.user, s.channel}
+	if botCommand {
+		keys = append(keys, "bot:"+username)
+		limits = append(limits, s.bot)
+	}
+
+	var d Decision
+	err := s.r.Update(ctx, keys, func(now time.Time, buckets []Bucket) []Bucket {
+		d = take(now, buckets, limits)
+		return buckets
+	})
+	if err != nil {
+		return Decision{}, fmt.Errorf("error checking rate limits: %w", err)
+	}
+
+	return d, nil
+}
+
+// Run prunes the buckets that are full again every interval, until the context is done
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	idle := max(s.user.full(), s.channel.full(), s.bot.full())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.r.Prune(ctx, idle); err != nil {
+				slog.Error("error pruning rate limit buckets", "err", err)
+			}
+		}
+	}
+}
+
+// full is how long an empty bucket takes to fill up, an unused bucket older than that is the same as a new one
+func (l Limit) full() time.Duration {
+	return time.Duration(l.Burst) * l.Every
+}
+
+// take refills the buckets up to now and takes a token from each one if they all have it
+func take(now time.Time, buckets []Bucket, limits []Limit) Decision {
+	allowed := true
+	var retryAfter time.Duration
+
+	for i := range buckets {
+		b, l := &buckets[i], limits[i]
+		b.Tokens = refill(now, *b, l)
+		b.UpdatedAt = now
+
+		if b.Tokens < 1 {
+			allowed = false
+			wait := time.Duration(math.Ceil((1 - b.Tokens) * float64(l.Every)))
+			retryAfter = max(retryAfter, wait)
+		}
+	}
+
+	if !allowed {
+		return Decision{RetryAfter: retryAfter}
+	}
+
+	for i := range buckets {
+		buckets[i].Tokens--
+	}
+	return Decision{Allowed: true}
+}
+
+func refill(now time.Time, b Bucket, l Limit) float64 {
+	burst := float64(l.Burst)
+	if b.UpdatedAt.IsZero() || l.Every <= 0 {
+		return burst
+	}
+
+	elapsed := now.Sub(b.UpdatedAt)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return math.Min(burst, b.Tokens+float64(elapsed)/float64(l.Every))
+}
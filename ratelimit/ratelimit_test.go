@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// mockRepository keeps the buckets in memory, now is the clock of the "database"
+type mockRepository struct {
+	buckets map[string]Bucket
+	now     time.Time
+}
+
+func (m *mockRepository) Update(_ context.Context, keys []string, fn func(now time.Time, buckets []Bucket) []Bucket) error {
+	buckets := make([]Bucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = m.buckets[key]
+	}
+
+	for i, b := range fn(m.now, buckets) {
+		m.buckets[keys[i]] = b
+	}
+	return nil
+}
+
+func (m *mockRepository) Prune(_ context.Context, _ time.Duration) error {
+	return nil
+}
+
+func TestAllowMessage(t *testing.T) {
+	newService := func() (*Service, *mockRepository) {
+		repo := &mockRepository{buckets: map[string]Bucket{}, now: time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)}
+		service := NewService(repo,
+			Limit{Burst: 3, Every: time.Second},
+			Limit{Burst: 5, Every: 100 * time.Millisecond},
+			Limit{Burst: 1, Every: 10 * time.Second},
+		)
+		return service, repo
+	}
+
+	allow := func(t *testing.T, s *Service, username, channel string, bot bool) Decision {
+		t.Helper()
+		d, err := s.AllowMessage(context.Background(), username, channel, bot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("Burst Then Refill", func(t *testing.T) {
+		service, repo := newService()
+
+		for i := 0; i < 3; i++ {
+			if d := allow(t, service, "paulo", "general", false); !d.Allowed {
+				t.Fatalf("message %d should be allowed", i+1)
+			}
+		}
+
+		d := allow(t, service, "paulo", "general", false)
+		if d.Allowed || d.RetryAfter != time.Second {
+			t.Errorf("expected to wait 1s, got %+v", d)
+		}
+
+		repo.now = repo.now.Add(500 * time.Millisecond)
+		if d := allow(t, service, "paulo", "general", false); d.Allowed || d.RetryAfter != 500*time.Millisecond {
+			t.Errorf("expected to wait 500ms, got %+v", d)
+		}
+
+		repo.now = repo.now.Add(500 * time.Millisecond)
+		if d := allow(t, service, "paulo", "general", false); !d.Allowed {
+			t.Error("expected a token after 1s")
+		}
+	})
+
+	t.Run("Channel Limit Is Shared", func(t *testing.T) {
+		service, _ := newService()
+
+		for _, u := range []string{"a", "b", "c", "d", "e"} {
+			if d := allow(t, service, u, "general", false); !d.Allowed {
+				t.Fatalf("message from %s should be allowed", u)
+			}
+		}
+
+		if d := allow(t, service, "f", "general", false); d.Allowed {
+			t.Error("expected the channel to be throttled")
+		}
+		if d := allow(t, service, "f", "other", false); !d.Allowed {
+			t.Error("expected the other channel to be free")
+		}
+	})
+
+	t.Run("Denied Takes Nothing", func(t *testing.T) {
+		service, repo := newService()
+
+		if d := allow(t, service, "paulo", "general", true); !d.Allowed {
+			t.Fatal("first bot command should be allowed")
+		}
+		if d := allow(t, service, "paulo", "general", true); d.Allowed || d.RetryAfter != 10*time.Second {
+			t.Errorf("expected to wait 10s, got %+v", d)
+		}
+
+		// the denied command didn't take from the user bucket, two plain messages are still left
+		if got := repo.buckets["user:paulo"].Tokens; got != 2 {
+			t.Errorf("expected 2 tokens left, got %v", got)
+		}
+		if d := allow(t, service, "paulo", "general", false); !d.Allowed {
+			t.Error("expected plain messages to go through")
+		}
+	})
+}
+
+func TestRefill(t *testing.T) {
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	l := Limit{Burst: 10, Every: time.Second}
+
+	tests := []struct {
+		name string
+		b    Bucket
+		want float64
+	}{
+		{"New Bucket Is Full", Bucket{}, 10},
+		{"Partial", Bucket{Tokens: 2, UpdatedAt: now.Add(-2500 * time.Millisecond)}, 4.5},
+		{"Capped At Burst", Bucket{Tokens: 2, UpdatedAt: now.Add(-time.Hour)}, 10},
+		{"Clock Going Back", Bucket{Tokens: 2, UpdatedAt: now.Add(time.Second)}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refill(now, tt.b, l); got != tt.want {
+				t.Errorf("expected %v tokens, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package readmarker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MaxUnread caps the unread count of a channel, counting stops there so a user that never opened a busy channel
+// doesn't make every request walk its whole history. Clients should show it as "99+" or similar.
+const MaxUnread = 100
+
+var (
+	ErrChannelNotFound = errors.New("channel not found")
+)
+
+type Repository interface {
+	// MarkRead moves the marker of the user in the channel forward to at, ok is false when the channel doesn't exist
+	// or is a direct channel of other users
+	MarkRead(ctx context.Context, username, channel string, at time.Time) (ok bool, err error)
+	// GetUnread returns every channel the user can see, direct ones included, with how many messages from other
+	// users arrived after the marker, counting at most max of them
+	GetUnread(ctx context.Context, username string, max int) ([]ChannelUnread, error)
+}
+
+type ChannelUnread struct {
+	Name   string `json:"name"`
+	Unread int    `json:"unread"`
+}
+
+// Service keeps the last read position of each user in each channel
+type Service struct {
+	r   Repository
+	now func() time.Time
+}
+
+func NewService(r Repository) *Service {
+	return &Service{r: r, now: time.Now}
+}
+
+// MarkRead records that the user has seen the channel up to at, the time of the last message they saw.
+// A zero at means up to now, markers never move backwards.
+func (s *Service) MarkRead(ctx context.Context, username, channel string, at time.Time) error {
+	now := s.now()
+	if at.IsZero() || at.After(now) {
+		at = now
+	}
+
+	ok, err := s.r.MarkRead(ctx, username, channel, at)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrChannelNotFound
+	}
+
+	return nil
+}
+
+// Unread returns every channel the user can see with the number of messages the user hasn't read yet, capped at MaxUnread
+func (s *Service) Unread(ctx context.Context, username string) ([]ChannelUnread, error) {
+	return s.r.GetUnread(ctx, username, MaxUnread)
+}
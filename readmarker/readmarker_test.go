@@ -0,0 +1,85 @@
+package readmarker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type mockRepository struct {
+	channels map[string]bool
+	markedAt time.Time
+	max      int
+}
+
+func (m *mockRepository) MarkRead(_ context.Context, _, channel string, at time.Time) (bool, error) {
+	if !m.channels[channel] {
+		return false, nil
+	}
+	m.markedAt = at
+	return true, nil
+}
+
+func (m *mockRepository) GetUnread(_ context.Context, _ string, max int) ([]ChannelUnread, error) {
+	m.max = max
+	return []ChannelUnread{{Name: "default", Unread: 3}}, nil
+}
+
+func TestMarkRead(t *testing.T) {
+	now := time.Now()
+	repo := &mockRepository{channels: map[string]bool{"default": true}}
+	service := NewService(repo)
+	service.now = func() time.Time { return now }
+
+	t.Run("Explicit Time", func(t *testing.T) {
+		at := now.Add(-time.Minute)
+		if err := service.MarkRead(context.Background(), "paulo", "default", at); err != nil {
+			t.Fatal(err)
+		}
+		if !repo.markedAt.Equal(at) {
+			t.Errorf("expected the marker at %v, got %v", at, repo.markedAt)
+		}
+	})
+
+	t.Run("Zero Time Means Now", func(t *testing.T) {
+		if err := service.MarkRead(context.Background(), "paulo", "default", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if !repo.markedAt.Equal(now) {
+			t.Errorf("expected the marker at now, got %v", repo.markedAt)
+		}
+	})
+
+	t.Run("Future Time Is Clamped", func(t *testing.T) {
+		if err := service.MarkRead(context.Background(), "paulo", "default", now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if !repo.markedAt.Equal(now) {
+			t.Errorf("expected the marker at now, got %v", repo.markedAt)
+		}
+	})
+
+	t.Run("Unknown Channel", func(t *testing.T) {
+		err := service.MarkRead(context.Background(), "paulo", "nope", now)
+		if !errors.Is(err, ErrChannelNotFound) {
+			t.Errorf("expected %v, got %v", ErrChannelNotFound, err)
+		}
+	})
+}
+
+func TestUnread(t *testing.T) {
+	repo := &mockRepository{}
+	service := NewService(repo)
+
+	channels, err := service.Unread(context.Background(), "paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Unread != 3 {
+		t.Errorf("unexpected channels %v", channels)
+	}
+	if repo.max != MaxUnread {
+		t.Errorf("expected the count to be capped at %d, got %d", MaxUnread, repo.max)
+	}
+}
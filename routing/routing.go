@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"log/slog"
+	"time"
+)
+
+// ErrOffline is returned when the user has no session open on any instance
+var ErrOffline = errors.New("user is not connected")
+
+type Repository interface {
+	SaveSession(ctx context.Context, id, username, instance string) error
+	DeleteSession(ctx context.Context, id string) error
+	// GetUserInstances returns the instances the user has sessions on, leaving out the ones not refreshed within ttl
+	GetUserInstances(ctx context.Context, username string, ttl time.Duration) ([]string, error)
+	// RefreshSessions replaces the sessions registered for the instance with the given ones (id -> username),
+	// marking them as still open
+	RefreshSessions(ctx context.Context, instance string, sessions map[string]string) error
+	// PruneSessions deletes the sessions not refreshed within ttl, left behind by instances that crashed
+	PruneSessions(ctx context.Context, ttl time.Duration) error
+}
+
+type Eventbus interface {
+	PublishUserDelivery(instance, msg string) error
+}
+
+// Service keeps a registry of the sessions open on every server instance, so something meant for one user is sent
+// to the instances they are connected to and nowhere else. Each instance consumes its own queue of deliveries.
+type Service struct {
+	r        Repository
+	eventbus Eventbus
+	instance string
+	ttl      time.Duration
+}
+
+func NewService(r Repository, eventbus Eventbus, instance string, ttl time.Duration) *Service {
+	return &Service{r: r, eventbus: eventbus, instance: instance, ttl: ttl}
+}
+
+// Instance is the instance this service registers the sessions of, its queue gets the deliveries for them
+func (s *Service) Instance() string {
+	return s.instance
+}
+
+// Connected registers a session opened by the user on this instance
+func (s *Service) Connected(ctx context.Context, sessionID, username string) error {
+	return s.r.SaveSession(ctx, sessionID, username, s.instance)
+}
+
+// Disconnected forgets a session closed on this instance
+func (s *Service) Disconnected(ctx context.Context, sessionID string) error {
+	return s.r.DeleteSession(ctx, sessionID)
+}
+
+// SendToUser publishes the delivery once to every instance the user has a session on,
+// it returns ErrOffline when there is none
+func (s *Service) SendToUser(ctx context.Context, d eventbus.UserDelivery) error {
+	instances, err := s.r.GetUserInstances(ctx, d.Username, s.ttl)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return ErrOffline
+	}
+
+	j, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("error serializing UserDelivery: %w", err)
+	}
+
+	for _, instance := range instances {
+		if err := s.eventbus.PublishUserDelivery(instance, string(j)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run keeps the sessions open on this instance (local returns them, id -> username) registered and removes the ones
+// left behind by other instances, every interval until ctx is done. interval should be well under the ttl.
+func (s *Service) Run(ctx context.Context, interval time.Duration, local func() map[string]string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.r.RefreshSessions(ctx, s.instance, local()); err != nil {
+				slog.Error("error refreshing sessions", "instance", s.instance, "err", err)
+			}
+			if err := s.r.PruneSessions(ctx, s.ttl); err != nil {
+				slog.Error("error pruning sessions", "err", err)
+			}
+		}
+	}
+}
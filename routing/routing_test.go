@@ -0,0 +1,165 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type mockSession struct {
+	username string
+	instance string
+}
+
+type mockRepository struct {
+	sessions map[string]mockSession
+}
+
+func (m *mockRepository) SaveSession(_ context.Context, id, username, instance string) error {
+	if m.sessions == nil {
+		m.sessions = map[string]mockSession{}
+	}
+	m.sessions[id] = mockSession{username: username, instance: instance}
+	return nil
+}
+
+func (m *mockRepository) DeleteSession(_ context.Context, id string) error {
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *mockRepository) GetUserInstances(_ context.Context, username string, _ time.Duration) ([]string, error) {
+	seen := map[string]bool{}
+	var instances []string
+	for _, s := range m.sessions {
+		if s.username == username && !seen[s.instance] {
+			seen[s.instance] = true
+			instances = append(instances, s.instance)
+		}
+	}
+	sort.Strings(instances)
+	return instances, nil
+}
+
+func (m *mockRepository) RefreshSessions(_ context.Context, instance string, sessions map[string]string) error {
+	for id, s := range m.sessions {
+		if _, ok := sessions[id]; s.instance == instance && !ok {
+			delete(m.sessions, id)
+		}
+	}
+	for id, username := range sessions {
+		m.sessions[id] = mockSession{username: username, instance: instance}
+	}
+	return nil
+}
+
+func (m *mockRepository) PruneSessions(_ context.Context, _ time.Duration) error {
+	return nil
+}
+
+type published struct {
+	instance string
+	msg      string
+}
+
+type mockEventbus struct {
+	published []published
+}
+
+func (m *mockEventbus) PublishUserDelivery(instance, msg string) error {
+	m.published = append(m.published, published{instance: instance, msg: msg})
+	return nil
+}
+
+func TestSendToUser(t *testing.T) {
+	repo := &mockRepository{}
+	bus := &mockEventbus{}
+	server1 := NewService(repo, bus, "server1", time.Minute)
+	server2 := NewService(repo, bus, "server2", time.Minute)
+
+	// two tabs on server1 and a phone on server2
+	for _, c := range []struct {
+		service *Service
+		id      string
+	}{{server1, "s1"}, {server1, "s2"}, {server2, "s3"}} {
+		if err := c.service.Connected(context.Background(), c.id, "paulo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Once Per Instance", func(t *testing.T) {
+		bus.published = nil
+		d := eventbus.UserDelivery{Username: "paulo", Frame: json.RawMessage(`{"type":"mention"}`)}
+		if err := server2.SendToUser(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+
+		var instances []string
+		for _, p := range bus.published {
+			instances = append(instances, p.instance)
+
+			var got eventbus.UserDelivery
+			if err := json.Unmarshal([]byte(p.msg), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, d) {
+				t.Errorf("expected %+v, got %+v", d, got)
+			}
+		}
+		if !reflect.DeepEqual(instances, []string{"server1", "server2"}) {
+			t.Errorf("expected a delivery to server1 and server2, got %v", instances)
+		}
+	})
+
+	t.Run("Disconnected", func(t *testing.T) {
+		bus.published = nil
+		if err := server2.Disconnected(context.Background(), "s3"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server1.SendToUser(context.Background(), eventbus.UserDelivery{Username: "paulo", Kick: "bye"}); err != nil {
+			t.Fatal(err)
+		}
+		if len(bus.published) != 1 || bus.published[0].instance != "server1" {
+			t.Errorf("expected a single delivery to server1, got %v", bus.published)
+		}
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		err := server1.SendToUser(context.Background(), eventbus.UserDelivery{Username: "ana"})
+		if !errors.Is(err, ErrOffline) {
+			t.Errorf("expected %v, got %v", ErrOffline, err)
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	repo := &mockRepository{}
+	bus := &mockEventbus{}
+	service := NewService(repo, bus, "server1", time.Minute)
+
+	// s1 closed but its delete was lost, s2 is open but was never registered
+	if err := service.Connected(context.Background(), "s1", "paulo"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		service.Run(ctx, time.Millisecond, func() map[string]string {
+			cancel()
+			return map[string]string{"s2": "ana"}
+		})
+	}()
+	<-refreshed
+
+	if !reflect.DeepEqual(repo.sessions, map[string]mockSession{"s2": {username: "ana", instance: "server1"}}) {
+		t.Errorf("expected only s2 to be registered, got %v", repo.sessions)
+	}
+}
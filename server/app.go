@@ -3,30 +3,45 @@ package server
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/auth"
 	"github.com/ap-pauloafonso/investor-chat/channel"
 	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/mention"
+	"github.com/ap-pauloafonso/investor-chat/pb"
+	"github.com/ap-pauloafonso/investor-chat/presence"
+	"github.com/ap-pauloafonso/investor-chat/readmarker"
+	"github.com/ap-pauloafonso/investor-chat/routing"
 	"github.com/ap-pauloafonso/investor-chat/user"
 	"github.com/ap-pauloafonso/investor-chat/utils"
 	"github.com/ap-pauloafonso/investor-chat/websocket"
-	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	jwtSecret = []byte("my-secret-key")
-)
-
 // Server represents the application instance
 type Server struct {
 	E                *echo.Echo
+	auth             *auth.Service
+	cookies          CookieConfig
 	userService      *user.Service
 	channelService   *channel.Service
+	presenceService  *presence.Service
+	readMarkers      *readmarker.Service
+	mentions         *mention.Service
+	router           *routing.Service
+	archive          pb.ArchiveServiceClient
 	eventbus         *eventbus.Eventbus
 	webSocketHandler *websocket.Handler
+	notReady         atomic.Bool // set by Drain, the health check fails so the load balancer sends no new clients
 }
 
 type UserRequest struct {
@@ -50,29 +65,93 @@ func (s *Server) RegisterUserHandler(c echo.Context) error {
 
 	}
 
-	// Create a token with user information
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": u.Username,
-	})
-
-	// Sign and get the complete encoded token as a string
-	tokenString, err := token.SignedString(jwtSecret)
+	// Start a login of the user, with its access and refresh tokens
+	tokens, err := s.auth.Login(c.Request().Context(), u.Username)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
 	}
 
-	setCookie(c, tokenString)
+	s.setCookies(c, tokens)
 
 	return c.JSON(http.StatusOK, ResultMessage{Message: u.Username})
 }
 
-func setCookie(c echo.Context, tokenString string) {
-	cookie := new(http.Cookie)
-	cookie.Name = "token"
-	cookie.Value = tokenString
-	cookie.Path = "/"
-	cookie.Expires = time.Now().Add(time.Hour * 24) // a day
-	c.SetCookie(cookie)
+// MeHandler returns the user of the token cookie, which scripts can't read
+func (s *Server) MeHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, ResultMessage{Message: c.Get("username").(string)})
+}
+
+// RefreshHandler exchanges the refresh token cookie for new tokens, when the access token has expired
+func (s *Server) RefreshHandler(c echo.Context) error {
+	cookie, err := c.Cookie("refresh_token")
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, utils.ErrorMessage{ErrorMessage: "Unauthorized"})
+	}
+
+	ctx := c.Request().Context()
+	tokens, err := s.auth.Refresh(ctx, cookie.Value)
+	if err != nil {
+		// the token was stolen, or this is the thief: the login is over and so are its connections
+		var reused *auth.ReusedTokenError
+		if errors.As(err, &reused) {
+			s.kickLogin(ctx, reused.Claims)
+		}
+
+		if errors.Is(err, auth.ErrInvalidToken) {
+			s.clearCookies(c)
+			return c.JSON(http.StatusUnauthorized, utils.ErrorMessage{ErrorMessage: "Unauthorized"})
+		}
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	s.setCookies(c, tokens)
+
+	return c.JSON(http.StatusOK, ResultMessage{Message: tokens.Username})
+}
+
+// LogoutHandler ends the login of the refresh token cookie and closes the connections opened with it
+func (s *Server) LogoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if cookie, err := c.Cookie("refresh_token"); err == nil {
+		claims, err := s.auth.Logout(ctx, cookie.Value)
+		switch {
+		case errors.Is(err, auth.ErrInvalidToken):
+			// already logged out
+		case err != nil:
+			return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+		default:
+			s.kickLogin(ctx, claims)
+		}
+	}
+
+	s.clearCookies(c)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// kickLogin closes the connections opened with the login, wherever they are
+func (s *Server) kickLogin(ctx context.Context, claims auth.Claims) {
+	if err := s.webSocketHandler.KickLogin(ctx, claims.Username, claims.Login, "logged out"); err != nil && !errors.Is(err, routing.ErrOffline) {
+		slog.Error("error closing the connections of the login", "user", claims.Username, "login", claims.Login, "err", err)
+	}
+}
+
+// LogoutAllHandler ends every login of the user, on every device, and closes all their connections
+func (s *Server) LogoutAllHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	username := c.Get("username").(string)
+
+	if err := s.auth.LogoutAll(ctx, username); err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	if err := s.webSocketHandler.KickUser(ctx, username, "logged out"); err != nil && !errors.Is(err, routing.ErrOffline) {
+		slog.Error("error closing the connections of the user", "user", username, "err", err)
+	}
+
+	s.clearCookies(c)
+
+	return c.NoContent(http.StatusNoContent)
 }
 
 func (s *Server) LoginUserHandler(c echo.Context) error {
@@ -87,21 +166,18 @@ func (s *Server) LoginUserHandler(c echo.Context) error {
 
 	}
 
-	// Create a token with user information
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": u.Username,
-	})
-
-	tokenString, err := token.SignedString(jwtSecret)
+	// Start a login of the user, with its access and refresh tokens
+	tokens, err := s.auth.Login(c.Request().Context(), u.Username)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
 	}
 
-	setCookie(c, tokenString)
+	s.setCookies(c, tokens)
 
 	return c.JSON(http.StatusOK, ResultMessage{Message: u.Username})
 }
 
+// GetChannelsHandler lists the names of the public channels, the shape the API always had
 func (s *Server) GetChannelsHandler(c echo.Context) error {
 	type ChannelListResponse struct {
 		Channels []string `json:"channels"`
@@ -112,15 +188,264 @@ func (s *Server) GetChannelsHandler(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
 	}
 
-	// Create the response and return it
+	return c.JSON(http.StatusOK, ChannelListResponse{Channels: channels})
+}
+
+// GetChannelsUnreadHandler lists the public channels with how many messages the user hasn't read in each
+func (s *Server) GetChannelsUnreadHandler(c echo.Context) error {
+	type ChannelListResponse struct {
+		Channels []readmarker.ChannelUnread `json:"channels"`
+	}
+
+	channels, err := s.readMarkers.Unread(c.Request().Context(), c.Get("username").(string))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	// Create the response and return it, direct channels are listed apart
 	response := ChannelListResponse{
-		Channels: channels,
+		Channels: make([]readmarker.ChannelUnread, 0, len(channels)),
+	}
+	for _, ch := range channels {
+		if !channel.IsDirect(ch.Name) {
+			response.Channels = append(response.Channels, ch)
+		}
 	}
 
 	return c.JSON(http.StatusOK, response)
 
 }
 
+func (s *Server) GetChannelMembersHandler(c echo.Context) error {
+	type ChannelMembersResponse struct {
+		Members []string `json:"members"`
+	}
+
+	name := c.Param("name")
+	if len(name) == 0 {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	ok, err := s.channelService.CanAccess(c.Request().Context(), name, c.Get("username").(string))
+	if errors.Is(err, channel.ErrChannelNotFound) {
+		return c.JSON(http.StatusNotFound, utils.ErrorMessage{ErrorMessage: "channel not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, utils.ErrorMessage{ErrorMessage: "channel not found"})
+	}
+
+	return c.JSON(http.StatusOK, ChannelMembersResponse{Members: s.presenceService.Members(name)})
+}
+
+func (s *Server) MarkChannelReadHandler(c echo.Context) error {
+	type MarkReadRequest struct {
+		At time.Time `json:"at"` // time of the last message seen, defaults to now
+	}
+
+	name := c.Param("name")
+	if len(name) == 0 {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	var req MarkReadRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	err := s.readMarkers.MarkRead(c.Request().Context(), c.Get("username").(string), name, req.At)
+	if errors.Is(err, readmarker.ErrChannelNotFound) {
+		return c.JSON(http.StatusNotFound, utils.ErrorMessage{ErrorMessage: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) GetDirectChannelsHandler(c echo.Context) error {
+	type DirectChannelUnread struct {
+		channel.DirectChannel
+		Unread int `json:"unread"`
+	}
+	type DirectChannelListResponse struct {
+		Conversations []DirectChannelUnread `json:"conversations"`
+	}
+
+	ctx := c.Request().Context()
+	username := c.Get("username").(string)
+
+	direct, err := s.channelService.GetDirectChannels(ctx, username)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	channels, err := s.readMarkers.Unread(ctx, username)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+	unread := make(map[string]int, len(channels))
+	for _, ch := range channels {
+		unread[ch.Name] = ch.Unread
+	}
+
+	response := DirectChannelListResponse{Conversations: make([]DirectChannelUnread, len(direct))}
+	for i, d := range direct {
+		response.Conversations[i] = DirectChannelUnread{DirectChannel: d, Unread: unread[d.Name]}
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) OpenDirectChannelHandler(c echo.Context) error {
+	type OpenDirectChannelRequest struct {
+		Username string `json:"username"` // who to talk to
+	}
+
+	var req OpenDirectChannelRequest
+	if err := c.Bind(&req); err != nil || req.Username == "" {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	direct, err := s.channelService.OpenDirectChannel(c.Request().Context(), c.Get("username").(string), req.Username)
+	if errors.Is(err, channel.ErrUserNotFound) {
+		return c.JSON(http.StatusNotFound, utils.ErrorMessage{ErrorMessage: err.Error()})
+	}
+	if errors.Is(err, channel.ErrDirectWithSelf) {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	return c.JSON(http.StatusOK, direct)
+}
+
+// Message is an archived message, in the same shape as the messages sent over the websocket
+type Message struct {
+	ID         string          `json:"id"`
+	ParentID   string          `json:"parentId,omitempty"`
+	Username   string          `json:"username"`
+	Msg        string          `json:"msg"`
+	Time       time.Time       `json:"time"`
+	EditedAt   *time.Time      `json:"editedAt,omitempty"`
+	Deleted    bool            `json:"deleted,omitempty"`
+	Reactions  []user.Reaction `json:"reactions,omitempty"`
+	ReplyCount int             `json:"replyCount,omitempty"`
+}
+
+func (s *Server) GetThreadHandler(c echo.Context) error {
+	type ThreadResponse struct {
+		Parent  Message   `json:"parent"`
+		Replies []Message `json:"replies"` // oldest first
+		HasMore bool      `json:"hasMore"`
+	}
+
+	id := c.Param("id")
+	if len(id) == 0 {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	limit := 0 // the archive default
+	if l := c.QueryParam("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "limit must be a positive number"})
+		}
+	}
+
+	resp, err := s.archive.GetThread(c.Request().Context(), &pb.GetThreadRequest{ParentId: id, MaxMessages: int32(limit), Username: c.Get("username").(string)})
+	if status.Code(err) == codes.NotFound {
+		return c.JSON(http.StatusNotFound, utils.ErrorMessage{ErrorMessage: "message not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	response := ThreadResponse{
+		Parent:  toMessage(resp.Parent),
+		Replies: make([]Message, len(resp.Replies)),
+		HasMore: resp.HasMore,
+	}
+	for i, m := range resp.Replies {
+		response.Replies[i] = toMessage(m)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func toMessage(m *pb.Message) Message {
+	r := Message{
+		ID:         m.Id,
+		ParentID:   m.ParentId,
+		Username:   m.User,
+		Msg:        m.Text,
+		Time:       m.Timestamp.AsTime(),
+		Deleted:    m.Deleted,
+		ReplyCount: int(m.ReplyCount),
+	}
+	if m.EditedAt != nil {
+		editedAt := m.EditedAt.AsTime()
+		r.EditedAt = &editedAt
+	}
+	for _, reaction := range m.Reactions {
+		r.Reactions = append(r.Reactions, user.Reaction{Emoji: reaction.Emoji, Count: int(reaction.Count)})
+	}
+
+	return r
+}
+
+// GetChannelMessagesHandler pages back through the history of the channel, the replies of threads left out.
+// The first page holds the latest messages, nextCursor is passed as before to get the ones preceding it.
+func (s *Server) GetChannelMessagesHandler(c echo.Context) error {
+	type MessagesResponse struct {
+		Messages   []Message `json:"messages"` // oldest first
+		NextCursor string    `json:"nextCursor,omitempty"`
+	}
+
+	channel := c.Param("name")
+	if len(channel) == 0 {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	limit := 0 // the archive default
+	if l := c.QueryParam("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "limit must be a positive number"})
+		}
+	}
+
+	resp, err := s.archive.GetMessagesBefore(c.Request().Context(), &pb.GetMessagesBeforeRequest{
+		Channel:     channel,
+		BeforeId:    c.QueryParam("before"),
+		MaxMessages: int32(limit),
+		Username:    c.Get("username").(string),
+	})
+	if status.Code(err) == codes.PermissionDenied {
+		return c.JSON(http.StatusForbidden, utils.ErrorMessage{ErrorMessage: "Forbidden"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+	if !resp.Found {
+		return c.JSON(http.StatusNotFound, utils.ErrorMessage{ErrorMessage: "message not found"})
+	}
+
+	response := MessagesResponse{Messages: make([]Message, len(resp.Messages))}
+	for i, m := range resp.Messages {
+		response.Messages[i] = toMessage(m)
+	}
+	if resp.HasMore && len(resp.Messages) > 0 {
+		response.NextCursor = resp.Messages[0].Id
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
 func (s *Server) CreateChannelHandler(c echo.Context) error {
 
 	type CreateChannelRequest struct {
@@ -142,25 +467,73 @@ func (s *Server) CreateChannelHandler(c echo.Context) error {
 	return c.JSON(http.StatusCreated, ResultMessage{Message: "Channel created successfully"})
 }
 
+// GetMentionsHandler returns the last messages that mentioned the user, newest first
+func (s *Server) GetMentionsHandler(c echo.Context) error {
+	type MentionsResponse struct {
+		Mentions []mention.Mention `json:"mentions"`
+	}
+
+	limit := 0 // the inbox default
+	if l := c.QueryParam("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "limit must be a positive number"})
+		}
+	}
+
+	mentions, err := s.mentions.Inbox(c.Request().Context(), c.Get("username").(string), limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+	}
+
+	return c.JSON(http.StatusOK, MentionsResponse{Mentions: mentions})
+}
+
 // NewApp creates a new instance of the Server
-func NewApp(ctx context.Context, userService *user.Service, channelService *channel.Service, q *eventbus.Eventbus, frontendFS embed.FS, webSocketHandler *websocket.Handler) *Server {
+func NewApp(ctx context.Context, authService *auth.Service, cookies CookieConfig, userService *user.Service, channelService *channel.Service, presenceService *presence.Service, readMarkers *readmarker.Service, mentions *mention.Service, router *routing.Service, archive pb.ArchiveServiceClient, q *eventbus.Eventbus, frontendFS embed.FS, webSocketHandler *websocket.Handler) *Server {
 	server := &Server{
 		E:                echo.New(),
+		auth:             authService,
+		cookies:          cookies,
 		userService:      userService,
 		channelService:   channelService,
+		presenceService:  presenceService,
+		readMarkers:      readMarkers,
+		mentions:         mentions,
+		router:           router,
+		archive:          archive,
 		eventbus:         q,
 		webSocketHandler: webSocketHandler,
 	}
 
 	server.E.Use(middleware.Recover())
+	server.E.Use(csrfCheck(cookies))
 
 	// Set up API routes
 	server.E.POST("/api/register", server.RegisterUserHandler)
 	server.E.POST("/api/login", server.LoginUserHandler)
-	server.E.GET("/api/channels", server.GetChannelsHandler, jwtCheck())
-	server.E.POST("/api/channels", server.CreateChannelHandler, jwtCheck())
-	server.E.GET("/ws/:channel", server.webSocketHandler.HandleRequest, jwtCheck())
+	server.E.POST("/api/refresh", server.RefreshHandler)
+	server.E.POST("/api/logout", server.LogoutHandler)
+	server.E.POST("/api/logout/all", server.LogoutAllHandler, jwtCheck(server.auth))
+	server.E.GET("/api/me", server.MeHandler, jwtCheck(server.auth))
+	server.E.GET("/api/channels", server.GetChannelsHandler, jwtCheck(server.auth))
+	server.E.GET("/api/v2/channels", server.GetChannelsUnreadHandler, jwtCheck(server.auth))
+	server.E.POST("/api/channels", server.CreateChannelHandler, jwtCheck(server.auth))
+	server.E.GET("/api/channels/:name/members", server.GetChannelMembersHandler, jwtCheck(server.auth))
+	server.E.PUT("/api/channels/:name/read", server.MarkChannelReadHandler, jwtCheck(server.auth))
+	server.E.GET("/api/channels/:name/stream", server.webSocketHandler.HandleStream, jwtCheck(server.auth))
+	server.E.GET("/api/channels/:name/messages", server.GetChannelMessagesHandler, jwtCheck(server.auth))
+	server.E.POST("/api/channels/:name/messages", server.webSocketHandler.HandlePostMessage, jwtCheck(server.auth))
+	server.E.GET("/api/direct", server.GetDirectChannelsHandler, jwtCheck(server.auth))
+	server.E.POST("/api/direct", server.OpenDirectChannelHandler, jwtCheck(server.auth))
+	server.E.GET("/api/messages/:id/thread", server.GetThreadHandler, jwtCheck(server.auth))
+	server.E.GET("/api/mentions", server.GetMentionsHandler, jwtCheck(server.auth))
+	server.E.GET("/ws", server.webSocketHandler.HandleMultiplexRequest, jwtCheck(server.auth))
+	server.E.GET("/ws/:channel", server.webSocketHandler.HandleRequest, jwtCheck(server.auth))
 	server.E.GET("/health", func(c echo.Context) error {
+		if server.notReady.Load() {
+			return c.NoContent(http.StatusServiceUnavailable)
+		}
 		return c.NoContent(http.StatusOK)
 	})
 
@@ -180,7 +553,27 @@ func NewApp(ctx context.Context, userService *user.Service, channelService *chan
 
 }
 
-func jwtCheck() echo.MiddlewareFunc {
+// Drain takes the instance out of the load balancer and shuts it down before ctx is done: the health check fails
+// for readinessDelay, long enough for the load balancer to notice, then the websocket clients are told to reconnect
+// elsewhere once their pending frames are written, the consumers stop and the HTTP server waits for the requests
+// in flight
+func (s *Server) Drain(ctx context.Context, readinessDelay time.Duration) error {
+	s.notReady.Store(true)
+
+	select {
+	case <-time.After(readinessDelay):
+	case <-ctx.Done():
+	}
+
+	s.webSocketHandler.Drain(ctx)
+	s.eventbus.StopConsumers()
+
+	return s.E.Shutdown(ctx)
+}
+
+// jwtCheck lets through the requests with a valid token cookie of a login that wasn't logged out, storing its user
+// and login in the context as "username" and "login"
+func jwtCheck(authService *auth.Service) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			tokenString, err := c.Cookie("token")
@@ -188,31 +581,19 @@ func jwtCheck() echo.MiddlewareFunc {
 				return c.JSON(http.StatusUnauthorized, utils.ErrorMessage{ErrorMessage: "Unauthorized"})
 			}
 
-			token, err := jwt.Parse(tokenString.Value, func(token *jwt.Token) (interface{}, error) {
-
-				// Validate the signing method
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("invalid signing method")
-				}
-				return jwtSecret, nil
-			})
-
+			claims, err := authService.Authenticate(c.Request().Context(), tokenString.Value)
 			if err != nil {
+				if !errors.Is(err, auth.ErrInvalidToken) {
+					return c.JSON(http.StatusInternalServerError, utils.ErrorMessage{ErrorMessage: "Internal Server Error"})
+				}
 				return c.JSON(http.StatusUnauthorized, utils.ErrorMessage{ErrorMessage: "Unauthorized"})
 			}
 
-			if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-				// Extract and store the username in the context
-				if username, ok := claims["username"].(string); ok {
-					c.Set("username", username)
-				} else {
-					return c.JSON(http.StatusUnauthorized, utils.ErrorMessage{ErrorMessage: "Unauthorized"})
-				}
+			// Store the username and the login in the context
+			c.Set("username", claims.Username)
+			c.Set("login", claims.Login)
 
-				return next(c)
-			}
-
-			return c.JSON(http.StatusUnauthorized, utils.ErrorMessage{ErrorMessage: "Unauthorized"})
+			return next(c)
 		}
 	}
 }
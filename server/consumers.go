@@ -3,7 +3,9 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/routing"
 	"github.com/ap-pauloafonso/investor-chat/utils"
 	"github.com/ap-pauloafonso/investor-chat/websocket"
 )
@@ -17,7 +19,7 @@ func (s *Server) initConsumers(ctx context.Context) {
 			return err
 		}
 
-		return s.webSocketHandler.BroadcastMessage(obj.Username, obj.Channel, obj.Message, false, obj.Time)
+		return s.webSocketHandler.BroadcastMessage(obj.ID, obj.ParentID, obj.Username, obj.Channel, obj.Message, false, obj.Time)
 
 	})
 	if err != nil {
@@ -45,11 +47,112 @@ func (s *Server) initConsumers(ctx context.Context) {
 			return err
 		}
 
-		return s.webSocketHandler.BroadcastMessage("BOT", obj.Channel, obj.GeneratedMessage, true, obj.Time)
+		return s.webSocketHandler.BroadcastMessage(obj.ID, obj.ParentID, "BOT", obj.Channel, obj.GeneratedMessage, true, obj.Time)
 
 	})
 	if err != nil {
 		utils.LogErrorFatal(err)
 	}
 
+	err = s.eventbus.ConsumePresenceEvents(func(payload []byte) error {
+		changes, err := s.presenceService.Apply(payload)
+		if err != nil {
+			return err
+		}
+
+		s.webSocketHandler.BroadcastPresence(changes)
+		return nil
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeMessageChangeCommandForWSBroadcast(func(payload []byte) error {
+		var obj eventbus.MessageChangeCommand
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		return s.webSocketHandler.BroadcastMessageChange(obj)
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeDirectChannelEvents(func(payload []byte) error {
+		var obj eventbus.DirectChannelEvent
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		return s.webSocketHandler.NotifyDirectChannel(ctx, obj)
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeReactionEventForWSBroadcast(func(payload []byte) error {
+		var obj eventbus.ReactionEvent
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		return s.webSocketHandler.BroadcastReaction(obj)
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeMentionEvents(func(payload []byte) error {
+		var obj eventbus.MentionEvent
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		err = s.webSocketHandler.NotifyMention(ctx, obj)
+		if errors.Is(err, routing.ErrOffline) {
+			return nil // not connected anywhere, the next summary delivers it
+		}
+
+		return err
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeUserDeliveries(s.router.Instance(), func(payload []byte) error {
+		var obj eventbus.UserDelivery
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		// a mention nobody got, the sessions closed in the meantime, stays in the next summary
+		if s.webSocketHandler.DeliverToUser(obj) && obj.Mention != "" {
+			return s.mentions.Delivered(ctx, obj.Username, obj.Mention)
+		}
+
+		return nil
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
+	err = s.eventbus.ConsumeTypingEvents(func(payload []byte) error {
+		var obj eventbus.TypingEvent
+		err := json.Unmarshal(payload, &obj)
+		if err != nil {
+			return err
+		}
+
+		return s.webSocketHandler.BroadcastTyping(obj)
+	})
+	if err != nil {
+		utils.LogErrorFatal(err)
+	}
+
 }
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/auth"
+	"github.com/ap-pauloafonso/investor-chat/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// CookieConfig holds the attributes of the cookies the server sets
+type CookieConfig struct {
+	Secure   bool // only sent over https, leave it on anywhere but a local setup over plain http
+	SameSite http.SameSite
+	Domain   string // empty for the host of the request
+}
+
+// ParseSameSite parses the SameSite attribute of the cookies: lax, strict or none
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid cookie SameSite %q, expected lax, strict or none", s)
+	}
+}
+
+// Validate checks the browsers would take the cookies
+func (cc CookieConfig) Validate() error {
+	if cc.SameSite == http.SameSiteNoneMode && !cc.Secure {
+		return errors.New("cookies with SameSite none must be secure")
+	}
+
+	return nil
+}
+
+func (cc CookieConfig) cookie(name, value, path string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   cc.Domain,
+		Secure:   cc.Secure,
+		SameSite: cc.SameSite,
+		HttpOnly: true, // scripts never need the tokens, an XSS can't steal them
+	}
+}
+
+// setCookies hands the tokens to the browser. The refresh token is only sent to the API.
+func (s *Server) setCookies(c echo.Context, tokens auth.Tokens) {
+	access := s.cookies.cookie("token", tokens.Access, "/")
+	access.Expires = tokens.AccessExpires
+	c.SetCookie(access)
+
+	refresh := s.cookies.cookie("refresh_token", tokens.Refresh, "/api")
+	refresh.Expires = tokens.RefreshExpires
+	c.SetCookie(refresh)
+}
+
+// clearCookies removes the tokens from the browser
+func (s *Server) clearCookies(c echo.Context) {
+	for _, cookie := range []*http.Cookie{s.cookies.cookie("token", "", "/"), s.cookies.cookie("refresh_token", "", "/api")} {
+		cookie.MaxAge = -1
+		c.SetCookie(cookie)
+	}
+}
+
+// csrfCheck refuses the requests that change something unless they carry the token of the csrf_token cookie in the
+// X-CSRF-Token header. Another site can make the browser send our cookies, but it can't read them to set the header.
+// The cookie is set on any request without it, e.g. loading the frontend.
+func csrfCheck(cc CookieConfig) echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "header:" + csrfHeaderName,
+		CookieName:     csrfCookieName,
+		CookiePath:     "/",
+		CookieDomain:   cc.Domain,
+		CookieSecure:   cc.Secure,
+		CookieSameSite: cc.SameSite,
+		CookieHTTPOnly: false, // the frontend reads it to set the header
+		ErrorHandler: func(err error, c echo.Context) error {
+			return c.JSON(http.StatusForbidden, utils.ErrorMessage{ErrorMessage: "Invalid CSRF token"})
+		},
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/channel"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
@@ -17,7 +18,7 @@ func NewChannelRepository(db *pgxpool.Pool) *ChannelRepository {
 }
 
 func (c *ChannelRepository) GetChannels(ctx context.Context) ([]string, error) {
-	rows, err := c.db.Query(ctx, "SELECT name FROM channels")
+	rows, err := c.db.Query(ctx, "SELECT name FROM channels WHERE NOT is_private")
 	if err != nil {
 		return nil, fmt.Errorf("error fetching channels: %w", err)
 	}
@@ -52,10 +53,89 @@ func (c *ChannelRepository) GetChannel(ctx context.Context, name string) (string
 	err := c.db.QueryRow(ctx, "SELECT name FROM channels WHERE name = $1", name).Scan(&channelName)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "", fmt.Errorf("channel with name '%s' not found", name)
+			return "", fmt.Errorf("%w: %s", channel.ErrChannelNotFound, name)
 		}
 		return "", fmt.Errorf("error fetching channel: %w", err)
 	}
 
 	return channelName, nil
 }
+
+func (c *ChannelRepository) SaveDirectChannel(ctx context.Context, name string, members []string) (bool, error) {
+	var created bool
+	err := c.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var registered int
+		err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE username = ANY($1)", members).Scan(&registered)
+		if err != nil {
+			return err
+		}
+		if registered != len(members) {
+			return channel.ErrUserNotFound
+		}
+
+		tag, err := tx.Exec(ctx, `
+            INSERT INTO channels (name, is_private) VALUES ($1, TRUE)
+            ON CONFLICT (name) DO NOTHING`,
+			name)
+		if err != nil {
+			return err
+		}
+		created = tag.RowsAffected() > 0
+
+		_, err = tx.Exec(ctx, `
+            INSERT INTO channel_members (channel_name, user_name)
+            SELECT $1, unnest($2::TEXT[])
+            ON CONFLICT DO NOTHING`,
+			name, members)
+		return err
+	})
+	if errors.Is(err, channel.ErrUserNotFound) {
+		return false, err
+	}
+	if err != nil {
+		return false, fmt.Errorf("error saving direct channel: %w", err)
+	}
+
+	return created, nil
+}
+
+func (c *ChannelRepository) GetDirectChannels(ctx context.Context, username string) ([]channel.DirectChannel, error) {
+	rows, err := c.db.Query(ctx, `
+        SELECT me.channel_name, other.user_name
+        FROM channel_members me
+        JOIN channel_members other ON other.channel_name = me.channel_name AND other.user_name <> me.user_name
+        WHERE me.user_name = $1
+        ORDER BY other.user_name`,
+		username)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching direct channels: %w", err)
+	}
+	defer rows.Close()
+
+	channels := make([]channel.DirectChannel, 0)
+	for rows.Next() {
+		var d channel.DirectChannel
+		if err := rows.Scan(&d.Name, &d.With); err != nil {
+			return nil, fmt.Errorf("error scanning direct channels: %w", err)
+		}
+		channels = append(channels, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over direct channels: %w", err)
+	}
+
+	return channels, nil
+}
+
+func (c *ChannelRepository) IsMember(ctx context.Context, channel, username string) (bool, error) {
+	var member bool
+	err := c.db.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM channel_members WHERE channel_name = $1 AND user_name = $2)`,
+		channel, username).Scan(&member)
+	if err != nil {
+		return false, fmt.Errorf("error checking channel membership: %w", err)
+	}
+
+	return member, nil
+}
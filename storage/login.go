@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/auth"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+type LoginRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewLoginRepository(db *pgxpool.Pool) *LoginRepository {
+	return &LoginRepository{db}
+}
+
+func (r *LoginRepository) CreateLogin(ctx context.Context, id, username, tokenHash string, expiresAt time.Time) error {
+	err := r.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+            INSERT INTO logins (login_id, user_name, expires_at) VALUES ($1, $2, $3)`,
+			id, username, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            INSERT INTO refresh_tokens (token_hash, login_id, expires_at) VALUES ($1, $2, $3)`,
+			tokenHash, id, expiresAt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error creating login: %w", err)
+	}
+
+	return nil
+}
+
+func (r *LoginRepository) LoginExists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM logins WHERE login_id = $1 AND expires_at > NOW())`,
+		id).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking login: %w", err)
+	}
+
+	return exists, nil
+}
+
+func (r *LoginRepository) GetRefreshToken(ctx context.Context, tokenHash string) (auth.RefreshToken, bool, error) {
+	t, err := scanRefreshToken(r.db.QueryRow(ctx, `
+        SELECT t.login_id, l.user_name, t.expires_at, t.used_at
+        FROM refresh_tokens t
+        JOIN logins l ON l.login_id = t.login_id
+        WHERE t.token_hash = $1`,
+		tokenHash))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return auth.RefreshToken{}, false, nil
+		}
+		return auth.RefreshToken{}, false, fmt.Errorf("error fetching refresh token: %w", err)
+	}
+
+	return t, true, nil
+}
+
+func (r *LoginRepository) UseRefreshToken(ctx context.Context, tokenHash string) (auth.RefreshToken, bool, error) {
+	var t auth.RefreshToken
+	var found bool
+	err := r.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// locked until the transaction ends, a concurrent exchange of the same token sees it used
+		var err error
+		t, err = scanRefreshToken(tx.QueryRow(ctx, `
+            SELECT t.login_id, l.user_name, t.expires_at, t.used_at
+            FROM refresh_tokens t
+            JOIN logins l ON l.login_id = t.login_id
+            WHERE t.token_hash = $1
+            FOR UPDATE OF t`,
+			tokenHash))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+
+		_, err = tx.Exec(ctx, `
+            UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL`,
+			tokenHash)
+		return err
+	})
+	if err != nil {
+		return auth.RefreshToken{}, false, fmt.Errorf("error using refresh token: %w", err)
+	}
+
+	return t, found, nil
+}
+
+func (r *LoginRepository) AddRefreshToken(ctx context.Context, login, tokenHash string, expiresAt time.Time) error {
+	err := r.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+            INSERT INTO refresh_tokens (token_hash, login_id, expires_at) VALUES ($1, $2, $3)`,
+			tokenHash, login, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            UPDATE logins SET expires_at = GREATEST(expires_at, $2) WHERE login_id = $1`,
+			login, expiresAt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error adding refresh token: %w", err)
+	}
+
+	return nil
+}
+
+func (r *LoginRepository) DeleteLogin(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM logins WHERE login_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting login: %w", err)
+	}
+
+	return nil
+}
+
+func (r *LoginRepository) DeleteUserLogins(ctx context.Context, username string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM logins WHERE user_name = $1`, username)
+	if err != nil {
+		return fmt.Errorf("error deleting user logins: %w", err)
+	}
+
+	return nil
+}
+
+func (r *LoginRepository) PruneLogins(ctx context.Context) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM logins WHERE expires_at < NOW()`)
+	if err != nil {
+		return fmt.Errorf("error pruning logins: %w", err)
+	}
+
+	return nil
+}
+
+func scanRefreshToken(row pgx.Row) (auth.RefreshToken, error) {
+	var t auth.RefreshToken
+	err := row.Scan(&t.Login, &t.Username, &t.ExpiresAt, &t.UsedAt)
+	return t, err
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/mention"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type MentionRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewMentionRepository(db *pgxpool.Pool) *MentionRepository {
+	return &MentionRepository{db}
+}
+
+func (r *MentionRepository) SaveMentions(ctx context.Context, m mention.Mention, usernames []string) ([]string, error) {
+	// selecting from users skips the names nobody registered, and the ones that can't read a private channel
+	rows, err := r.db.Query(ctx, `
+        INSERT INTO mentions (message_id, user_name, channel_name, mentioned_by, created_at)
+        SELECT $1, u.username, c.name, $3, $4
+        FROM users u
+        JOIN channels c ON c.name = $2
+        WHERE u.username = ANY($5) AND u.username <> $3
+          AND (NOT c.is_private OR EXISTS (SELECT 1 FROM channel_members cm WHERE cm.channel_name = c.name AND cm.user_name = u.username))
+        ON CONFLICT (message_id, user_name) DO NOTHING
+        RETURNING user_name`,
+		m.MessageID, m.Channel, m.By, m.Time, usernames)
+	if err != nil {
+		return nil, fmt.Errorf("error saving mentions: %w", err)
+	}
+	defer rows.Close()
+
+	var mentioned []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, fmt.Errorf("error scanning mentions: %w", err)
+		}
+		mentioned = append(mentioned, username)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over mentions: %w", err)
+	}
+
+	return mentioned, nil
+}
+
+func (r *MentionRepository) GetMentions(ctx context.Context, username string, max int) ([]mention.Mention, error) {
+	// the text comes from the message so edits show up, deleted messages are left out
+	rows, err := r.db.Query(ctx, `
+        SELECT mn.message_id, mn.channel_name, mn.mentioned_by, m.message_text, mn.created_at
+        FROM mentions mn
+        JOIN messages m ON m.message_id = mn.message_id
+        WHERE mn.user_name = $1 AND m.deleted_at IS NULL
+        ORDER BY mn.created_at DESC
+        LIMIT $2`,
+		username, max)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching mentions: %w", err)
+	}
+
+	return scanMentions(rows)
+}
+
+func (r *MentionRepository) TakeUndelivered(ctx context.Context, username string) ([]mention.Mention, error) {
+	rows, err := r.db.Query(ctx, `
+        WITH taken AS (
+            UPDATE mentions SET delivered_at = now()
+            WHERE user_name = $1 AND delivered_at IS NULL
+            RETURNING message_id, channel_name, mentioned_by, created_at
+        )
+        SELECT t.message_id, t.channel_name, t.mentioned_by, m.message_text, t.created_at
+        FROM taken t
+        JOIN messages m ON m.message_id = t.message_id
+        WHERE m.deleted_at IS NULL
+        ORDER BY t.created_at DESC`,
+		username)
+	if err != nil {
+		return nil, fmt.Errorf("error taking undelivered mentions: %w", err)
+	}
+
+	return scanMentions(rows)
+}
+
+func (r *MentionRepository) MarkDelivered(ctx context.Context, username, messageID string) error {
+	_, err := r.db.Exec(ctx, `
+        UPDATE mentions SET delivered_at = now()
+        WHERE user_name = $1 AND message_id = $2 AND delivered_at IS NULL`,
+		username, messageID)
+	if err != nil {
+		return fmt.Errorf("error marking mention as delivered: %w", err)
+	}
+
+	return nil
+}
+
+func scanMentions(rows pgx.Rows) ([]mention.Mention, error) {
+	defer rows.Close()
+
+	mentions := make([]mention.Mention, 0)
+	for rows.Next() {
+		var m mention.Mention
+		if err := rows.Scan(&m.MessageID, &m.Channel, &m.By, &m.Text, &m.Time); err != nil {
+			return nil, fmt.Errorf("error scanning mentions: %w", err)
+		}
+		mentions = append(mentions, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over mentions: %w", err)
+	}
+
+	return mentions, nil
+}
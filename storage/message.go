@@ -2,12 +2,22 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/archive"
 	"github.com/ap-pauloafonso/investor-chat/user"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"time"
 )
 
+// messageColumns is what scanMessage reads, deleted messages have their text blanked already
+const messageColumns = `COALESCE(message_id, ''), COALESCE(parent_id, ''), channel_name, user_name, message_text, created_at, edited_at, deleted_at IS NOT NULL`
+
+// foreignKeyViolation is the code postgres fails an insert with when a row it references doesn't exist
+const foreignKeyViolation = "23503"
+
 type MessageRepository struct {
 	db *pgxpool.Pool
 }
@@ -16,24 +26,30 @@ func NewMessageRepository(db *pgxpool.Pool) *MessageRepository {
 	return &MessageRepository{db}
 }
 
-func (m *MessageRepository) SaveMessage(ctx context.Context, channel, user, msg string, timestamp time.Time) error {
-	_, err := m.db.Exec(ctx, `
-        INSERT INTO messages (channel_name, user_name, message_text, created_at)
-        VALUES ($1, $2, $3, $4)`,
-		channel, user, msg, timestamp)
+func (m *MessageRepository) SaveMessage(ctx context.Context, id, parentID, channel, user, msg string, timestamp time.Time) (bool, error) {
+	// messages published before ids existed have none, they are stored with a NULL id and never deduplicated
+	tag, err := m.db.Exec(ctx, `
+        INSERT INTO messages (message_id, parent_id, channel_name, user_name, message_text, created_at)
+        VALUES (NULLIF($1, ''), NULLIF($2, ''), $3, $4, $5, $6)
+        ON CONFLICT (message_id) DO NOTHING`,
+		id, parentID, channel, user, msg, timestamp)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolation {
+		return false, fmt.Errorf("%w: %s", archive.ErrMissingReference, pgErr.ConstraintName)
+	}
 	if err != nil {
-		return fmt.Errorf("error saving message: %w", err)
+		return false, fmt.Errorf("error saving message: %w", err)
 	}
-	return nil
+	return tag.RowsAffected() > 0, nil
 }
 
 func (m *MessageRepository) GetRecentMessages(ctx context.Context, channel string, maxMessages int) ([]user.Message, error) {
 	rows, err := m.db.Query(ctx, `
-        SELECT channel_name, user_name, message_text, created_at
+        SELECT `+messageColumns+`
         FROM (
-            SELECT channel_name, user_name, message_text, created_at
+            SELECT *
             FROM messages
-            WHERE channel_name = $1
+            WHERE channel_name = $1 AND parent_id IS NULL
             ORDER BY created_at DESC
             LIMIT $2
         ) AS recent_messages
@@ -42,12 +58,387 @@ func (m *MessageRepository) GetRecentMessages(ctx context.Context, channel strin
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving messages: %w", err)
 	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, m.attachDetails(ctx, messages)
+}
+
+func (m *MessageRepository) GetMessagesAfter(ctx context.Context, channel, afterID string, maxMessages int) ([]user.Message, bool, error) {
+	var anchorTime time.Time
+	var anchorSeq int
+	err := m.db.QueryRow(ctx, `
+        SELECT created_at, id FROM messages WHERE channel_name = $1 AND message_id = $2`,
+		channel, afterID).Scan(&anchorTime, &anchorSeq)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("error fetching message %s: %w", afterID, err)
+	}
+
+	// same order as the history, the serial id breaks ties between messages sent at the same time
+	rows, err := m.db.Query(ctx, `
+        SELECT `+messageColumns+`
+        FROM messages
+        WHERE channel_name = $1 AND (created_at, id) > ($2, $3)
+        ORDER BY created_at ASC, id ASC
+        LIMIT $4`,
+		channel, anchorTime, anchorSeq, maxMessages)
+	if err != nil {
+		return nil, false, fmt.Errorf("error retrieving messages: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	if messages == nil {
+		messages = make([]user.Message, 0)
+	}
+	if err := m.attachDetails(ctx, messages); err != nil {
+		return nil, false, err
+	}
+
+	return messages, true, nil
+}
+
+func (m *MessageRepository) GetMessagesBefore(ctx context.Context, channel, beforeID string, maxMessages int) ([]user.Message, bool, error) {
+	// without an anchor the page ends at the newest message
+	var anchorTime *time.Time
+	var anchorSeq int
+	if beforeID != "" {
+		err := m.db.QueryRow(ctx, `
+            SELECT created_at, id FROM messages WHERE channel_name = $1 AND message_id = $2`,
+			channel, beforeID).Scan(&anchorTime, &anchorSeq)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil, false, nil
+			}
+			return nil, false, fmt.Errorf("error fetching message %s: %w", beforeID, err)
+		}
+	}
+
+	rows, err := m.db.Query(ctx, `
+        SELECT `+messageColumns+`
+        FROM (
+            SELECT *
+            FROM messages
+            WHERE channel_name = $1 AND parent_id IS NULL
+              AND ($2::TIMESTAMPTZ IS NULL OR (created_at, id) < ($2, $3))
+            ORDER BY created_at DESC, id DESC
+            LIMIT $4
+        ) AS page
+        ORDER BY created_at ASC, id ASC`,
+		channel, anchorTime, anchorSeq, maxMessages)
+	if err != nil {
+		return nil, false, fmt.Errorf("error retrieving messages: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	if messages == nil {
+		messages = make([]user.Message, 0)
+	}
+	if err := m.attachDetails(ctx, messages); err != nil {
+		return nil, false, err
+	}
+
+	return messages, true, nil
+}
+
+func (m *MessageRepository) GetMessage(ctx context.Context, id string) (user.Message, bool, error) {
+	message, err := scanMessage(m.db.QueryRow(ctx, `
+        SELECT `+messageColumns+` FROM messages WHERE message_id = $1`,
+		id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return user.Message{}, false, nil
+		}
+		return user.Message{}, false, fmt.Errorf("error fetching message %s: %w", id, err)
+	}
+
+	messages := []user.Message{message}
+	if err := m.attachDetails(ctx, messages); err != nil {
+		return user.Message{}, false, err
+	}
+
+	return messages[0], true, nil
+}
+
+// EditMessage replaces the text of the message and keeps the previous one in message_edits,
+// deleted messages and edits that change nothing are ignored so redeliveries are harmless
+func (m *MessageRepository) EditMessage(ctx context.Context, id, text, by string, at time.Time) error {
+	err := m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var previous string
+		err := tx.QueryRow(ctx, `
+            SELECT message_text FROM messages WHERE message_id = $1 AND deleted_at IS NULL FOR UPDATE`,
+			id).Scan(&previous)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && previous == text) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            INSERT INTO message_edits (message_id, previous_text, edited_by, edited_at) VALUES ($1, $2, $3, $4)`,
+			id, previous, by, at)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            UPDATE messages SET message_text = $2, edited_at = $3 WHERE message_id = $1`,
+			id, text, at)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error editing message %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// DeleteMessage turns the message into a tombstone, its last text is kept in message_edits
+func (m *MessageRepository) DeleteMessage(ctx context.Context, id, by string, at time.Time) error {
+	err := m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var previous string
+		err := tx.QueryRow(ctx, `
+            SELECT message_text FROM messages WHERE message_id = $1 AND deleted_at IS NULL FOR UPDATE`,
+			id).Scan(&previous)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            INSERT INTO message_edits (message_id, previous_text, edited_by, edited_at) VALUES ($1, $2, $3, $4)`,
+			id, previous, by, at)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            UPDATE messages SET message_text = '', deleted_at = $2, deleted_by = $3 WHERE message_id = $1`,
+			id, at, by)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `DELETE FROM reactions WHERE message_id = $1`, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting message %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// ToggleReaction adds the reaction of the user to the message or removes it when it's already there,
+// found is false when the message doesn't exist or is deleted
+func (m *MessageRepository) ToggleReaction(ctx context.Context, id, username, emoji string, at time.Time) (added bool, count int, found bool, err error) {
+	err = m.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// locks the message so concurrent toggles on it count in turn
+		err := tx.QueryRow(ctx, `
+            SELECT true FROM messages WHERE message_id = $1 AND deleted_at IS NULL FOR UPDATE`,
+			id).Scan(&found)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, `
+            DELETE FROM reactions WHERE message_id = $1 AND user_name = $2 AND emoji = $3`,
+			id, username, emoji)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			_, err = tx.Exec(ctx, `
+                INSERT INTO reactions (message_id, user_name, emoji, created_at) VALUES ($1, $2, $3, $4)`,
+				id, username, emoji, at)
+			if err != nil {
+				return err
+			}
+			added = true
+		}
+
+		return tx.QueryRow(ctx, `
+            SELECT count(*) FROM reactions WHERE message_id = $1 AND emoji = $2`,
+			id, emoji).Scan(&count)
+	})
+	if err != nil {
+		return false, 0, false, fmt.Errorf("error toggling reaction on message %s: %w", id, err)
+	}
+
+	return added, count, found, nil
+}
+
+// GetThread returns up to maxMessages replies to the message, oldest first
+func (m *MessageRepository) GetThread(ctx context.Context, parentID string, maxMessages int) ([]user.Message, error) {
+	rows, err := m.db.Query(ctx, `
+        SELECT `+messageColumns+`
+        FROM messages
+        WHERE parent_id = $1
+        ORDER BY created_at ASC, id ASC
+        LIMIT $2`,
+		parentID, maxMessages)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving thread %s: %w", parentID, err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		messages = make([]user.Message, 0)
+	}
+
+	return messages, m.attachDetails(ctx, messages)
+}
+
+// attachDetails fills what isn't stored in the messages rows: reaction totals and reply counts
+func (m *MessageRepository) attachDetails(ctx context.Context, messages []user.Message) error {
+	if err := m.attachReactions(ctx, messages); err != nil {
+		return err
+	}
+
+	return m.attachReplyCounts(ctx, messages)
+}
+
+// attachReplyCounts counts the replies of the messages that started a thread, deleted replies aside
+func (m *MessageRepository) attachReplyCounts(ctx context.Context, messages []user.Message) error {
+	index := map[string]int{}
+	ids := make([]string, 0, len(messages))
+	for i, message := range messages {
+		// replies can't start a thread themselves
+		if message.ID != "" && message.ParentID == "" {
+			index[message.ID] = i
+			ids = append(ids, message.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := m.db.Query(ctx, `
+        SELECT parent_id, count(*)
+        FROM messages
+        WHERE parent_id = ANY($1) AND deleted_at IS NULL
+        GROUP BY parent_id`,
+		ids)
+	if err != nil {
+		return fmt.Errorf("error counting replies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return fmt.Errorf("error scanning reply count: %w", err)
+		}
+		messages[index[id]].ReplyCount = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over reply counts: %w", err)
+	}
+
+	return nil
+}
+
+// attachReactions fills the reaction totals of the messages
+func (m *MessageRepository) attachReactions(ctx context.Context, messages []user.Message) error {
+	index := map[string]int{}
+	ids := make([]string, 0, len(messages))
+	for i, message := range messages {
+		if message.ID != "" {
+			index[message.ID] = i
+			ids = append(ids, message.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := m.db.Query(ctx, `
+        SELECT message_id, emoji, count(*)
+        FROM reactions
+        WHERE message_id = ANY($1)
+        GROUP BY message_id, emoji
+        ORDER BY min(created_at), emoji`,
+		ids)
+	if err != nil {
+		return fmt.Errorf("error retrieving reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var r user.Reaction
+		if err := rows.Scan(&id, &r.Emoji, &r.Count); err != nil {
+			return fmt.Errorf("error scanning reaction: %w", err)
+		}
+		i := index[id]
+		messages[i].Reactions = append(messages[i].Reactions, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over reactions: %w", err)
+	}
+
+	return nil
+}
+
+// CanRead lets everyone read the public channels and only their members read the private ones,
+// unknown channels have nothing to hide
+func (m *MessageRepository) CanRead(ctx context.Context, channel, username string) (bool, error) {
+	var ok bool
+	err := m.db.QueryRow(ctx, `
+        SELECT NOT EXISTS (SELECT 1 FROM channels WHERE name = $1 AND is_private)
+            OR EXISTS (SELECT 1 FROM channel_members WHERE channel_name = $1 AND user_name = $2)`,
+		channel, username).Scan(&ok)
+	if err != nil {
+		return false, fmt.Errorf("error checking access to channel %s: %w", channel, err)
+	}
+
+	return ok, nil
+}
+
+func scanMessage(row pgx.Row) (user.Message, error) {
+	var message user.Message
+	var editedAt *time.Time
+	if err := row.Scan(&message.ID, &message.ParentID, &message.Channel, &message.User, &message.Text, &message.Timestamp, &editedAt, &message.Deleted); err != nil {
+		return user.Message{}, err
+	}
+	if editedAt != nil {
+		message.EditedAt = *editedAt
+	}
+
+	return message, nil
+}
+
+func scanMessages(rows pgx.Rows) ([]user.Message, error) {
 	defer rows.Close()
 
 	var messages []user.Message
 	for rows.Next() {
-		var message user.Message
-		if err := rows.Scan(&message.Channel, &message.User, &message.Text, &message.Timestamp); err != nil {
+		message, err := scanMessage(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning message: %w", err)
 		}
 		messages = append(messages, message)
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/ratelimit"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"sort"
+	"time"
+)
+
+type RateLimitRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewRateLimitRepository(db *pgxpool.Pool) *RateLimitRepository {
+	return &RateLimitRepository{db}
+}
+
+func (r *RateLimitRepository) Update(ctx context.Context, keys []string, fn func(now time.Time, buckets []ratelimit.Bucket) []ratelimit.Bucket) error {
+	// locking in key order keeps two instances updating the same buckets from deadlocking
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	err := r.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// the rows must exist to be locked
+		_, err := tx.Exec(ctx, `
+            INSERT INTO rate_limits (key) SELECT unnest($1::TEXT[])
+            ON CONFLICT (key) DO NOTHING`,
+			sorted)
+		if err != nil {
+			return err
+		}
+
+		var now time.Time
+		if err := tx.QueryRow(ctx, "SELECT clock_timestamp()").Scan(&now); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, `
+            SELECT key, tokens, updated_at FROM rate_limits
+            WHERE key = ANY($1)
+            ORDER BY key
+            FOR UPDATE`,
+			sorted)
+		if err != nil {
+			return err
+		}
+
+		stored := make(map[string]ratelimit.Bucket, len(keys))
+		for rows.Next() {
+			var key string
+			var b ratelimit.Bucket
+			var updatedAt *time.Time
+			if err := rows.Scan(&key, &b.Tokens, &updatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			if updatedAt != nil {
+				b.UpdatedAt = *updatedAt
+			}
+			stored[key] = b
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		buckets := make([]ratelimit.Bucket, len(keys))
+		for i, key := range keys {
+			buckets[i] = stored[key]
+		}
+
+		buckets = fn(now, buckets)
+
+		tokens := make([]float64, len(keys))
+		updatedAt := make([]time.Time, len(keys))
+		for i, b := range buckets {
+			tokens[i] = b.Tokens
+			updatedAt[i] = b.UpdatedAt
+		}
+
+		_, err = tx.Exec(ctx, `
+            UPDATE rate_limits r SET tokens = u.tokens, updated_at = u.updated_at
+            FROM unnest($1::TEXT[], $2::DOUBLE PRECISION[], $3::TIMESTAMPTZ[]) AS u (key, tokens, updated_at)
+            WHERE r.key = u.key`,
+			keys, tokens, updatedAt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error updating rate limit buckets: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RateLimitRepository) Prune(ctx context.Context, idle time.Duration) error {
+	_, err := r.db.Exec(ctx, `
+        DELETE FROM rate_limits
+        WHERE updated_at < clock_timestamp() - make_interval(secs => $1)`,
+		idle.Seconds())
+	if err != nil {
+		return fmt.Errorf("error pruning rate limit buckets: %w", err)
+	}
+
+	return nil
+}
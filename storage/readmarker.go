@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/readmarker"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+type ReadMarkerRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewReadMarkerRepository(db *pgxpool.Pool) *ReadMarkerRepository {
+	return &ReadMarkerRepository{db}
+}
+
+func (r *ReadMarkerRepository) MarkRead(ctx context.Context, username, channel string, at time.Time) (bool, error) {
+	// selecting from channels makes an unknown channel insert nothing instead of failing on the foreign key,
+	// the direct channels of other users are unknown as well
+	tag, err := r.db.Exec(ctx, `
+        INSERT INTO read_markers (user_name, channel_name, last_read_at)
+        SELECT $1, c.name, $3 FROM channels c
+        WHERE c.name = $2
+          AND (NOT c.is_private OR EXISTS (SELECT 1 FROM channel_members cm WHERE cm.channel_name = c.name AND cm.user_name = $1))
+        ON CONFLICT (user_name, channel_name)
+        DO UPDATE SET last_read_at = GREATEST(read_markers.last_read_at, EXCLUDED.last_read_at)`,
+		username, channel, at)
+	if err != nil {
+		return false, fmt.Errorf("error saving read marker: %w", err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *ReadMarkerRepository) GetUnread(ctx context.Context, username string, max int) ([]readmarker.ChannelUnread, error) {
+	// each count is a range scan on messages_channel_created_at_idx that stops after max rows
+	rows, err := r.db.Query(ctx, `
+        SELECT c.name, u.unread
+        FROM channels c
+        LEFT JOIN read_markers r ON r.channel_name = c.name AND r.user_name = $1
+        CROSS JOIN LATERAL (
+            SELECT COUNT(*) AS unread
+            FROM (
+                SELECT 1
+                FROM messages m
+                WHERE m.channel_name = c.name
+                  AND m.created_at > COALESCE(r.last_read_at, '-infinity')
+                  AND m.user_name <> $1
+                LIMIT $2
+            ) AS unread_messages
+        ) AS u
+        WHERE NOT c.is_private OR EXISTS (SELECT 1 FROM channel_members cm WHERE cm.channel_name = c.name AND cm.user_name = $1)
+        ORDER BY c.id`,
+		username, max)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching unread counts: %w", err)
+	}
+	defer rows.Close()
+
+	channels := make([]readmarker.ChannelUnread, 0)
+	for rows.Next() {
+		var c readmarker.ChannelUnread
+		if err := rows.Scan(&c.Name, &c.Unread); err != nil {
+			return nil, fmt.Errorf("error scanning unread counts: %w", err)
+		}
+		channels = append(channels, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over unread counts: %w", err)
+	}
+
+	return channels, nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+type SessionRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewSessionRepository(db *pgxpool.Pool) *SessionRepository {
+	return &SessionRepository{db}
+}
+
+func (r *SessionRepository) SaveSession(ctx context.Context, id, username, instance string) error {
+	_, err := r.db.Exec(ctx, `
+        INSERT INTO sessions (session_id, user_name, instance, seen_at)
+        VALUES ($1, $2, $3, clock_timestamp())
+        ON CONFLICT (session_id) DO UPDATE SET instance = EXCLUDED.instance, seen_at = EXCLUDED.seen_at`,
+		id, username, instance)
+	if err != nil {
+		return fmt.Errorf("error saving session: %w", err)
+	}
+
+	return nil
+}
+
+func (r *SessionRepository) DeleteSession(ctx context.Context, id string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM sessions WHERE session_id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+
+	return nil
+}
+
+func (r *SessionRepository) GetUserInstances(ctx context.Context, username string, ttl time.Duration) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+        SELECT DISTINCT instance
+        FROM sessions
+        WHERE user_name = $1 AND seen_at > clock_timestamp() - make_interval(secs => $2)`,
+		username, ttl.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user instances: %w", err)
+	}
+	defer rows.Close()
+
+	var instances []string
+	for rows.Next() {
+		var instance string
+		if err := rows.Scan(&instance); err != nil {
+			return nil, fmt.Errorf("error scanning user instance: %w", err)
+		}
+		instances = append(instances, instance)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over user instances: %w", err)
+	}
+
+	return instances, nil
+}
+
+func (r *SessionRepository) RefreshSessions(ctx context.Context, instance string, sessions map[string]string) error {
+	ids := make([]string, 0, len(sessions))
+	usernames := make([]string, 0, len(sessions))
+	for id, username := range sessions {
+		ids = append(ids, id)
+		usernames = append(usernames, username)
+	}
+
+	err := r.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// closed while their delete failed, or registered by a previous run of the instance
+		_, err := tx.Exec(ctx, `
+            DELETE FROM sessions WHERE instance = $1 AND NOT (session_id = ANY($2))`,
+			instance, ids)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            INSERT INTO sessions (session_id, user_name, instance, seen_at)
+            SELECT s.id, s.user_name, $1, clock_timestamp()
+            FROM unnest($2::TEXT[], $3::TEXT[]) AS s (id, user_name)
+            ON CONFLICT (session_id) DO UPDATE SET instance = EXCLUDED.instance, seen_at = EXCLUDED.seen_at`,
+			instance, ids, usernames)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error refreshing sessions: %w", err)
+	}
+
+	return nil
+}
+
+func (r *SessionRepository) PruneSessions(ctx context.Context, ttl time.Duration) error {
+	_, err := r.db.Exec(ctx, `
+        DELETE FROM sessions
+        WHERE seen_at < clock_timestamp() - make_interval(secs => $1)`,
+		ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("error pruning sessions: %w", err)
+	}
+
+	return nil
+}
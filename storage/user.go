@@ -27,7 +27,8 @@ func (r *UserRepository) SaveUser(ctx context.Context, username, password string
 
 func (r *UserRepository) GetUser(ctx context.Context, username string) (*user.Model, error) {
 	var storedPassword string
-	err := r.db.QueryRow(ctx, "SELECT password FROM users WHERE username = $1", username).Scan(&storedPassword)
+	var isModerator bool
+	err := r.db.QueryRow(ctx, "SELECT password, is_moderator FROM users WHERE username = $1", username).Scan(&storedPassword, &isModerator)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -36,7 +37,8 @@ func (r *UserRepository) GetUser(ctx context.Context, username string) (*user.Mo
 	}
 
 	return &user.Model{
-		Username: username,
-		Password: storedPassword,
+		Username:    username,
+		Password:    storedPassword,
+		IsModerator: isModerator,
 	}, nil
 }
@@ -21,10 +21,22 @@ type Service struct {
 }
 
 type Message struct {
-	Channel   string    `json:"channel"`
-	User      string    `json:"user"`
-	Text      string    `json:"text"`
-	Timestamp time.Time `json:"timestamp"`
+	ID         string     `json:"id"`
+	Channel    string     `json:"channel"`
+	User       string     `json:"user"`
+	Text       string     `json:"text"`
+	Timestamp  time.Time  `json:"timestamp"`
+	EditedAt   time.Time  `json:"editedAt"` // zero when the message was never edited
+	Deleted    bool       `json:"deleted"`
+	Reactions  []Reaction `json:"reactions"`  // in the order they were first used
+	ParentID   string     `json:"parentId"`   // set on replies, the message that started the thread
+	ReplyCount int        `json:"replyCount"` // replies in the thread started by this message
+}
+
+// Reaction is the total of an emoji on a message
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
 }
 
 func NewService(userRepository Repository) *Service {
@@ -32,8 +44,9 @@ func NewService(userRepository Repository) *Service {
 }
 
 type Model struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	IsModerator bool   `json:"isModerator"`
 }
 
 type Repository interface {
@@ -80,6 +93,16 @@ func (s *Service) Login(ctx context.Context, username, password string) error {
 	return nil
 }
 
+// IsModerator reports whether the user may edit and delete the messages of others
+func (s *Service) IsModerator(ctx context.Context, username string) (bool, error) {
+	user, err := s.r.GetUser(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	return user.IsModerator, nil
+}
+
 func hashPassword(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log/slog"
 	"os"
 )
@@ -17,6 +19,15 @@ func LogErrorFatal(err error) {
 func ExecAndPrintErr(fn func() error) {
 	err := fn()
 	if err != nil {
-		slog.Error("error while executing fn", err)
+		slog.Error("error while executing fn", "err", err)
 	}
 }
+
+// NewID returns a random 128 bits identifier encoded as hex
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // the system random source is gone, nothing sensible left to do
+	}
+	return hex.EncodeToString(b)
+}
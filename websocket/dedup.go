@@ -0,0 +1,115 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// dedupTTL is how long message ids are remembered, retries from flaky clients come well within it
+const dedupTTL = 10 * time.Minute
+
+// messageIDFor derives the server message id from the idempotency key the client sent with the message,
+// a retry gets the same id whatever instance it lands on, so broadcast and archive can drop it as well
+func messageIDFor(username, key string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+type dedupEntry struct {
+	t       time.Time // the time the id was recorded with
+	seenAt  time.Time
+	pending chan struct{} // closed once what the id guards is done or forgotten, nil when it is done
+}
+
+// dedupCache remembers the ids it has seen for ttl
+type dedupCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	entries    map[string]dedupEntry
+	lastPrune  time.Time
+	sync.Mutex // for mutual exclusion while operating over entries
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{ttl: ttl, now: time.Now, entries: map[string]dedupEntry{}, lastPrune: time.Now()}
+}
+
+// seen records id with t and reports whether it was already there, in which case first is the time it was recorded with
+func (d *dedupCache) seen(id string, t time.Time) (first time.Time, dup bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	d.pruneLocked(now)
+
+	if e, ok := d.entries[id]; ok && now.Sub(e.seenAt) < d.ttl {
+		return e.t, true
+	}
+
+	d.entries[id] = dedupEntry{t: t, seenAt: now}
+	return t, false
+}
+
+// claim is seen for ids guarding something that can fail: a new id is pending until done or forget is called with
+// it, the claims of the id made meanwhile wait for that. They are dups once it is done, one of them gets the id when
+// it is forgotten.
+func (d *dedupCache) claim(id string, t time.Time) (first time.Time, dup bool) {
+	for {
+		d.Lock()
+		now := d.now()
+		d.pruneLocked(now)
+
+		e, ok := d.entries[id]
+		if !ok || now.Sub(e.seenAt) >= d.ttl {
+			d.entries[id] = dedupEntry{t: t, seenAt: now, pending: make(chan struct{})}
+			d.Unlock()
+			return t, false
+		}
+		d.Unlock()
+
+		if e.pending == nil {
+			return e.t, true
+		}
+		<-e.pending
+	}
+}
+
+// done marks what the claimed id guards as done, the id is a dup from then on
+func (d *dedupCache) done(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.entries[id]; ok && e.pending != nil {
+		close(e.pending)
+		e.pending = nil
+		d.entries[id] = e
+	}
+}
+
+// forget drops id, for when whatever it guarded failed and a retry must go through
+func (d *dedupCache) forget(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.entries[id]; ok && e.pending != nil {
+		close(e.pending)
+	}
+	delete(d.entries, id)
+}
+
+// pruneLocked drops the expired ids, at most once per ttl so it stays cheap
+func (d *dedupCache) pruneLocked(now time.Time) {
+	if now.Sub(d.lastPrune) < d.ttl {
+		return
+	}
+	d.lastPrune = now
+
+	for id, e := range d.entries {
+		if now.Sub(e.seenAt) >= d.ttl {
+			delete(d.entries, id)
+		}
+	}
+}
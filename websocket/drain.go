@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+const drainReason = "server restarting, reconnect"
+
+// Drain closes every connection with status 1012 (service restart) once the frames queued for it are written, so
+// the clients reconnect to another instance. Connections opened from now on are refused. It returns when every
+// connection is closed, the ones still open when ctx is done are dropped.
+func (w *Handler) Drain(ctx context.Context) {
+	w.draining.Store(true)
+
+	// the frames broadcast so far must reach the sessions before they stop taking them
+	w.hubs.flush()
+
+	sessions := w.hubs.allSessions()
+	slog.Info("[draining websocket connections]", "sessions", len(sessions))
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			s.drain(ctx, websocket.StatusServiceRestart, drainReason)
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,125 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (w *Handler) handleEdit(s *session, f Frame) {
+	var data EditData
+	if err := json.Unmarshal(f.Data, &data); err != nil || data.MessageID == "" {
+		w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "edit needs a messageId and a text")
+		return
+	}
+
+	text, errData := normalizeText(data.Text, w.limits.maxMessageLength())
+	if errData != nil {
+		w.sendError(s, f.Channel, f.ID, errData.Code, errData.Message)
+		return
+	}
+
+	w.changeMessage(s, f, eventbus.MessageChangeCommand{Type: eventbus.MessageEdit, ID: data.MessageID, Text: text})
+}
+
+func (w *Handler) handleDelete(s *session, f Frame) {
+	var data DeleteData
+	if err := json.Unmarshal(f.Data, &data); err != nil || data.MessageID == "" {
+		w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "delete needs a messageId")
+		return
+	}
+
+	w.changeMessage(s, f, eventbus.MessageChangeCommand{Type: eventbus.MessageDelete, ID: data.MessageID})
+}
+
+// changeMessage checks that the user is the author of the message or a moderator and publishes the change,
+// every instance and the archiver apply it from the eventbus. It is rate limited like a new message in the channel.
+func (w *Handler) changeMessage(s *session, f Frame, change eventbus.MessageChangeCommand) {
+	ctx := context.Background()
+
+	msg, err := w.archive.GetMessage(ctx, &pb.GetMessageRequest{Id: change.ID, Username: s.username})
+	if status.Code(err) == codes.NotFound || (err == nil && msg.Deleted) {
+		w.sendError(s, f.Channel, f.ID, errCodeUnknownMessage, "message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("error fetching the message to change", "id", change.ID, "err", err)
+		w.sendError(s, f.Channel, f.ID, errCodeInternal, "message could not be changed")
+		return
+	}
+	if msg.User != s.username {
+		isModerator, err := w.moderators.IsModerator(ctx, s.username)
+		if err != nil {
+			slog.Error("error checking moderator", "user", s.username, "err", err)
+			w.sendError(s, f.Channel, f.ID, errCodeInternal, "message could not be changed")
+			return
+		}
+		if !isModerator {
+			w.sendError(s, f.Channel, f.ID, errCodeForbidden, "only the author or a moderator can change this message")
+			return
+		}
+	}
+
+	// only the changes that would go through are charged
+	if errData := w.allowMessage(s.username, msg.Channel, false); errData != nil {
+		w.writeFrame(s, FrameError, f.Channel, f.ID, errData)
+		return
+	}
+
+	change.Channel = msg.Channel
+	change.By = s.username
+	change.Time = time.Now()
+
+	j, err := json.Marshal(change)
+	if err != nil {
+		slog.Error("error serializing MessageChangeCommand", "err", err)
+		w.sendError(s, change.Channel, f.ID, errCodeInternal, "message could not be changed")
+		return
+	}
+
+	if err := w.eventbus.PublishMessageChangeCommand(string(j)); err != nil {
+		slog.Error(err.Error())
+		w.sendError(s, change.Channel, f.ID, errCodeInternal, "message could not be changed")
+		return
+	}
+
+	w.writeFrame(s, FrameAck, change.Channel, f.ID, nil)
+}
+
+// BroadcastMessageChange tells every session in the channel that a message was edited or deleted
+func (w *Handler) BroadcastMessageChange(change eventbus.MessageChangeCommand) error {
+	h, ok := w.hubs.get(change.Channel)
+	if !ok {
+		return nil // nobody here has the channel open
+	}
+
+	var frame []byte
+	var err error
+	switch change.Type {
+	case eventbus.MessageEdit:
+		frame, err = newFrame(FrameMessageEdited, change.Channel, "", MessageEditedData{
+			ID: change.ID, Text: change.Text, EditedBy: change.By, EditedAt: change.Time,
+		})
+	case eventbus.MessageDelete:
+		frame, err = newFrame(FrameMessageDeleted, change.Channel, "", MessageDeletedData{
+			ID: change.ID, DeletedBy: change.By, DeletedAt: change.Time,
+		})
+	default:
+		return fmt.Errorf("unknown message change type %q", change.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	// held back like the messages while the channel is replayed, so it can't arrive before the message itself
+	h.send(hubFrame{b: frame, hold: true})
+
+	return nil
+}
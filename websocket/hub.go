@@ -0,0 +1,358 @@
+package websocket
+
+import (
+	"sync"
+)
+
+// hubQueueSize is how many frames a hub can have pending before broadcasters wait for it
+const hubQueueSize = 1024
+
+// hub owns the sessions subscribed to one channel. Only its goroutine reads or changes the membership, everything
+// else sends it events, so a broadcast needs no locks and a busy channel never holds back the others.
+// There is one hub per channel opened on this instance, it stops once the last session subscribed to it leaves.
+type hub struct {
+	channel    string
+	register   chan hubRequest
+	unregister chan hubRequest
+	broadcast  chan hubFrame
+	query      chan func(users map[string]map[string]*session)
+	stopped    chan struct{} // closed by hubRegistry once nobody is subscribed, the frames still pending are dropped
+
+	subscribers int // sessions subscribed or being subscribed or unsubscribed, guarded by hubRegistry
+}
+
+// hubRequest adds or removes a session, reply tells whether it was the first or the last session of its user
+type hubRequest struct {
+	s     *session
+	reply chan bool
+}
+
+// hubFrame is a frame for every session in the channel
+type hubFrame struct {
+	b      []byte
+	id     string        // id of the message, if any
+	hold   bool          // held back by the sessions replaying the channel, like the messages and their changes
+	except string        // user whose sessions don't get it, e.g. the one typing
+	done   chan struct{} // when set, closed once the frame is queued to every session
+}
+
+func newHub(channel string) *hub {
+	h := &hub{
+		channel:    channel,
+		register:   make(chan hubRequest),
+		unregister: make(chan hubRequest),
+		broadcast:  make(chan hubFrame, hubQueueSize),
+		query:      make(chan func(users map[string]map[string]*session)),
+		stopped:    make(chan struct{}),
+	}
+
+	go h.run()
+
+	return h
+}
+
+func (h *hub) run() {
+	users := map[string]map[string]*session{} // username -> session id -> session
+
+	for {
+		select {
+		case r := <-h.register:
+			sessions, ok := users[r.s.username]
+			if !ok {
+				sessions = map[string]*session{}
+				users[r.s.username] = sessions
+			}
+			sessions[r.s.id] = r.s
+			r.reply <- !ok
+		case r := <-h.unregister:
+			sessions, ok := users[r.s.username]
+			if ok {
+				delete(sessions, r.s.id)
+			}
+			last := ok && len(sessions) == 0
+			if last {
+				delete(users, r.s.username)
+			}
+			r.reply <- last
+		case f := <-h.broadcast:
+			if f.b != nil {
+				h.fanOut(users, f)
+			}
+			if f.done != nil {
+				close(f.done)
+			}
+		case fn := <-h.query:
+			fn(users)
+		case <-h.stopped:
+			return
+		}
+	}
+}
+
+func (h *hub) fanOut(users map[string]map[string]*session, f hubFrame) {
+	for u, sessions := range users {
+		if u == f.except {
+			continue
+		}
+		for _, s := range sessions {
+			if f.hold {
+				s.deliver(h.channel, f.id, f.b)
+			} else {
+				s.enqueue(f.b)
+			}
+		}
+	}
+}
+
+// join adds the session and reports whether it is the first one of its user in the channel
+func (h *hub) join(s *session) bool {
+	reply := make(chan bool)
+	h.register <- hubRequest{s: s, reply: reply}
+	return <-reply
+}
+
+// leave removes the session and reports whether it was the last one of its user in the channel
+func (h *hub) leave(s *session) bool {
+	reply := make(chan bool)
+	h.unregister <- hubRequest{s: s, reply: reply}
+	return <-reply
+}
+
+// send queues the frame for every session in the channel without waiting for it to be fanned out
+func (h *hub) send(f hubFrame) {
+	select {
+	case h.broadcast <- f:
+	case <-h.stopped: // nobody left to get it
+	}
+}
+
+// flush returns a channel closed once the frames sent so far are queued to the sessions, or the hub stopped
+func (h *hub) flush() <-chan struct{} {
+	done := make(chan struct{})
+	select {
+	case h.broadcast <- hubFrame{done: done}:
+	case <-h.stopped:
+		return h.stopped
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		select {
+		case <-done:
+		case <-h.stopped: // dropped with the frames still pending
+		}
+	}()
+	return flushed
+}
+
+// ask runs fn in the hub goroutine, it reports false when the hub stopped
+func (h *hub) ask(fn func(users map[string]map[string]*session)) bool {
+	select {
+	case h.query <- fn:
+		return true
+	case <-h.stopped:
+		return false
+	}
+}
+
+// sessions returns a snapshot of the sessions a user has open in the channel, every session when user is empty
+func (h *hub) sessions(user string) []*session {
+	reply := make(chan []*session, 1)
+	ok := h.ask(func(users map[string]map[string]*session) {
+		var r []*session
+		for u, sessions := range users {
+			if user != "" && u != user {
+				continue
+			}
+			for _, s := range sessions {
+				r = append(r, s)
+			}
+		}
+		reply <- r
+	})
+	if !ok {
+		return nil
+	}
+	return <-reply
+}
+
+// sessionCount returns how many sessions each user has open in the channel
+func (h *hub) sessionCount() map[string]int {
+	reply := make(chan map[string]int, 1)
+	ok := h.ask(func(users map[string]map[string]*session) {
+		r := make(map[string]int, len(users))
+		for u, sessions := range users {
+			r[u] = len(sessions)
+		}
+		reply <- r
+	})
+	if !ok {
+		return map[string]int{}
+	}
+	return <-reply
+}
+
+// hubRegistry indexes the open sessions and the hubs of the channels. It is only used to find them, subscribing
+// and broadcasting go through the hub, so its lock is never held while frames are fanned out.
+type hubRegistry struct {
+	hubs         map[string]*hub
+	sessions     map[string]*session // every open session, whatever it is subscribed to
+	sync.RWMutex                     // for mutual exclusion while operating over the hubs, the sessions or their subscriptions
+}
+
+func newHubRegistry() *hubRegistry {
+	return &hubRegistry{
+		hubs:     map[string]*hub{},
+		sessions: map[string]*session{},
+	}
+}
+
+// addChannelLocked starts the hub of the channel if it is missing and returns it, only a subscription does so the
+// hub has someone to stop it
+func (r *hubRegistry) addChannelLocked(channel string) *hub {
+	h, ok := r.hubs[channel]
+	if !ok {
+		h = newHub(channel)
+		r.hubs[channel] = h
+	}
+
+	return h
+}
+
+// get returns the hub of the channel, ok is false when it isn't running here, e.g. nobody is subscribed to it
+func (r *hubRegistry) get(channel string) (*hub, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	h, ok := r.hubs[channel]
+	return h, ok
+}
+
+// addSession registers a freshly opened session, it starts without subscriptions
+func (r *hubRegistry) addSession(s *session) {
+	r.Lock()
+	defer r.Unlock()
+
+	s.channels = map[string]struct{}{}
+	r.sessions[s.id] = s
+}
+
+// removeSession forgets the session, it should be unsubscribed from everything first
+func (r *hubRegistry) removeSession(s *session) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.sessions, s.id)
+}
+
+// unsubscribeAll removes the session from every channel, it returns the channels its user has no sessions left in
+func (r *hubRegistry) unsubscribeAll(s *session) []string {
+	r.Lock()
+	hubs := make([]*hub, 0, len(s.channels))
+	for channel := range s.channels {
+		hubs = append(hubs, r.hubs[channel])
+	}
+	s.channels = map[string]struct{}{}
+	r.Unlock()
+
+	var left []string
+	for _, h := range hubs {
+		if h.leave(s) {
+			left = append(left, h.channel)
+		}
+		r.release(h)
+	}
+
+	return left
+}
+
+// subscribe adds the session to the channel, joined reports whether it is the first session of its user there
+// and ok is false when the session was already subscribed
+func (r *hubRegistry) subscribe(channel string, s *session) (joined, ok bool) {
+	r.Lock()
+	if _, subscribed := s.channels[channel]; subscribed {
+		r.Unlock()
+		return false, false
+	}
+	s.channels[channel] = struct{}{}
+	h := r.addChannelLocked(channel) // first user logged in this channel starts its hub
+	h.subscribers++
+	r.Unlock()
+
+	return h.join(s), true
+}
+
+// unsubscribe removes the session from the channel, left reports whether its user has no sessions left there
+// and ok is false when the session was not subscribed
+func (r *hubRegistry) unsubscribe(channel string, s *session) (left, ok bool) {
+	r.Lock()
+	if _, subscribed := s.channels[channel]; !subscribed {
+		r.Unlock()
+		return false, false
+	}
+	delete(s.channels, channel)
+	h := r.hubs[channel]
+	r.Unlock()
+
+	left = h.leave(s)
+	r.release(h)
+	return left, true
+}
+
+// release is called once a session left the hub, the hub stops when it was the last one. Counting the sessions
+// from before they join to after they leave, the hub can't stop while one is on its way in or out.
+func (r *hubRegistry) release(h *hub) {
+	r.Lock()
+	defer r.Unlock()
+
+	h.subscribers--
+	if h.subscribers == 0 && r.hubs[h.channel] == h {
+		delete(r.hubs, h.channel)
+		close(h.stopped)
+	}
+}
+
+// isSubscribed reports whether the session is currently subscribed to the channel
+func (r *hubRegistry) isSubscribed(channel string, s *session) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	_, ok := s.channels[channel]
+	return ok
+}
+
+// snapshot returns the hubs currently running, so callers can iterate without holding the lock
+func (r *hubRegistry) snapshot() map[string]*hub {
+	r.RLock()
+	defer r.RUnlock()
+
+	hubs := make(map[string]*hub, len(r.hubs))
+	for k, v := range r.hubs {
+		hubs[k] = v
+	}
+	return hubs
+}
+
+// allSessions returns a snapshot of every open session, each one listed once whatever its subscriptions are
+func (r *hubRegistry) allSessions() []*session {
+	r.RLock()
+	defer r.RUnlock()
+
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// flush waits until every hub queued the frames sent to it so far
+func (r *hubRegistry) flush() {
+	var pending []<-chan struct{}
+	for _, h := range r.snapshot() {
+		pending = append(pending, h.flush())
+	}
+	for _, done := range pending {
+		<-done
+	}
+}
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// KeepAlive configures how the server detects connections that are gone without a close (e.g. a laptop that went
+// to sleep leaves a half-open TCP connection behind). A zero duration disables the matching check.
+type KeepAlive struct {
+	PingInterval time.Duration // how often the server pings each connection
+	PongTimeout  time.Duration // how long a ping can wait for its pong before the connection is dropped
+	IdleTimeout  time.Duration // how long a connection can go without the client sending any frame
+}
+
+// keepAlive pings the session and reaps it once it stops answering or stays idle for too long,
+// it returns when ctx is done or the session was reaped
+func (w *Handler) keepAlive(ctx context.Context, s *session, conn *websocket.Conn) {
+	interval := w.keepAliveConfig.PingInterval
+	if interval <= 0 {
+		interval = w.keepAliveConfig.IdleTimeout
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if idle := w.keepAliveConfig.IdleTimeout; idle > 0 && time.Since(s.lastActive()) > idle {
+			// the client is still there, tell it why so it can reconnect when it needs the connection again
+			w.reap(s, fmt.Sprintf("idle for more than %s", idle))
+			s.close(statusReconnect, "idle timeout")
+			return
+		}
+
+		if w.keepAliveConfig.PingInterval <= 0 {
+			continue
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, w.keepAliveConfig.PongTimeout)
+		err := conn.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return // the connection was closed while waiting for the pong
+			}
+
+			// nothing is listening on the other side, the failed ping already dropped the connection
+			// without a close handshake, which would only wait for its own timeout
+			w.reap(s, fmt.Sprintf("no pong within %s", w.keepAliveConfig.PongTimeout))
+			s.stop()
+			return
+		}
+	}
+}
+
+// reap logs why the session is being dropped, the reader then ends and unregisters it like any other disconnect
+func (w *Handler) reap(s *session, reason string) {
+	reapedConnections.Add(1)
+	slog.Info("[connection reaped]", "user", s.username, "session", s.id, "reason", reason)
+}
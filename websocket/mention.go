@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/mention"
+)
+
+// Mentions hands over what a user was mentioned in while offline
+type Mentions interface {
+	Pending(ctx context.Context, username string) (summary mention.Summary, ok bool, err error)
+}
+
+// sendPendingMentions tells a user who just connected what they were mentioned in while offline
+func (w *Handler) sendPendingMentions(ctx context.Context, s *session) {
+	summary, ok, err := w.mentions.Pending(ctx, s.username)
+	if err != nil {
+		slog.Error("error fetching pending mentions", "user", s.username, "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	w.writeFrame(s, FrameMentions, "", "", summary)
+}
+
+// NotifyMention sends the mention to every session the mentioned user has open, wherever they are and whatever
+// channels they watch. It fails with routing.ErrOffline when the user isn't connected. The mention stays in their
+// summary for the next connection until an instance hands it to one of their sessions.
+func (w *Handler) NotifyMention(ctx context.Context, e eventbus.MentionEvent) error {
+	m := mention.Mention{MessageID: e.MessageID, Channel: e.Channel, By: e.By, Text: e.Text, Time: e.Time}
+	b, err := newFrame(FrameMention, e.Channel, "", m)
+	if err != nil {
+		return err
+	}
+
+	// tagged with the channel but not limited to the sessions watching it
+	return w.router.SendToUser(ctx, eventbus.UserDelivery{Username: e.Username, Frame: b, Mention: e.MessageID})
+}
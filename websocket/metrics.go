@@ -0,0 +1,11 @@
+package websocket
+
+import "expvar"
+
+// metrics are published through expvar, see /debug/vars on DEBUG_ADDR
+var (
+	queuedFrames          = expvar.NewInt("ws_queued_frames")           // frames waiting in the send queues of all sessions
+	droppedFrames         = expvar.NewInt("ws_dropped_frames")          // frames that were never written to their session
+	slowConsumerEvictions = expvar.NewInt("ws_slow_consumer_evictions") // sessions closed because their queue was full
+	reapedConnections     = expvar.NewInt("ws_reaped_connections")      // sessions dropped for missing pongs or being idle
+)
@@ -0,0 +1,230 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/user"
+	"nhooyr.io/websocket"
+	"time"
+)
+
+// protocolVersion is stamped on every frame, clients can use it to detect breaking changes
+const protocolVersion = 1
+
+// FrameType identifies what is carried inside a Frame
+type FrameType string
+
+const (
+	FrameMessage         FrameType = "message"          // chat message, both directions
+	FrameHistory         FrameType = "history"          // recent messages of a channel, server -> client
+	FrameChannelsUpdated FrameType = "channels_updated" // the channel list changed, server -> client
+	FrameError           FrameType = "error"            // a client frame was rejected, server -> client
+	FrameAck             FrameType = "ack"              // a client frame was accepted, server -> client
+	FrameSubscribe       FrameType = "subscribe"        // start receiving a channel, client -> server
+	FrameUnsubscribe     FrameType = "unsubscribe"      // stop receiving a channel, client -> server
+	FrameMembers         FrameType = "members"          // who is in a channel, sent on subscribe, server -> client
+	FramePresence        FrameType = "presence"         // a user came online or went offline in a channel, server -> client
+	FrameTyping          FrameType = "typing"           // a user is typing, both directions
+	FrameRead            FrameType = "read"             // move the read marker of a channel, client -> server
+	FrameReplay          FrameType = "replay"           // the messages missed since the position a client resumed from, server -> client
+	FrameEdit            FrameType = "edit"             // change the text of a message, client -> server
+	FrameDelete          FrameType = "delete"           // delete a message, client -> server
+	FrameMessageEdited   FrameType = "message_edited"   // a message got a new text, server -> client
+	FrameMessageDeleted  FrameType = "message_deleted"  // a message was deleted, server -> client
+	FrameReact           FrameType = "react"            // add a reaction to a message, or remove it when already there, client -> server
+	FrameReaction        FrameType = "reaction"         // the reactions of a message changed, server -> client
+	FrameDirectOpened    FrameType = "direct_opened"    // a direct conversation with the user was opened, server -> client
+	FrameMention         FrameType = "mention"          // the user was mentioned in a message, server -> client
+	FrameMentions        FrameType = "mentions"         // what the user was mentioned in while offline, sent on connect, server -> client
+)
+
+// error codes sent inside FrameError
+const (
+	errCodeBadFrame           = "bad_frame"
+	errCodeUnknownType        = "unknown_type"
+	errCodeUnsupportedVersion = "unsupported_version"
+	errCodeInternal           = "internal_error"
+	errCodeMissingChannel     = "missing_channel"
+	errCodeNotSubscribed      = "not_subscribed"
+	errCodeAlreadySubscribed  = "already_subscribed"
+	errCodeUnknownChannel     = "unknown_channel"
+	errCodeUnknownMessage     = "unknown_message"
+	errCodeForbidden          = "forbidden"
+	errCodeRateLimited        = "rate_limited"
+	errCodeEmptyMessage       = "empty_message"
+	errCodeMessageTooLong     = "message_too_long"
+	errCodeInvalidText        = "invalid_text"
+)
+
+// close codes from the 4000-4999 range, reserved for applications
+const (
+	statusReconnect    websocket.StatusCode = 4000 // the connection was idle or unresponsive and was dropped, clients should reconnect
+	statusKicked       websocket.StatusCode = 4003 // the server removed the user, clients shouldn't reconnect on their own
+	statusSlowConsumer websocket.StatusCode = 4008 // the client didn't read fast enough and its send queue filled up
+)
+
+// Frame is the envelope used for everything exchanged over the websocket, in both directions.
+// ID is chosen by the client and echoed back on the ack/error frames that answer it.
+// Channel tags the frame with the channel it belongs to, it is what allows a single connection to carry several
+// channels.
+// Clients must ignore frame types they don't know about, this is what allows new types to be added
+// without breaking them.
+type Frame struct {
+	Version int             `json:"v"`
+	Type    FrameType       `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// MessageData is the data of an inbound FrameMessage
+type MessageData struct {
+	Text     string `json:"text"`
+	ParentID string `json:"parentId"` // reply in the thread of this message
+}
+
+// EditData is the data of a FrameEdit, only the author of the message or a moderator can send it
+type EditData struct {
+	MessageID string `json:"messageId"`
+	Text      string `json:"text"`
+}
+
+// DeleteData is the data of a FrameDelete, only the author of the message or a moderator can send it
+type DeleteData struct {
+	MessageID string `json:"messageId"`
+}
+
+// MessageEditedData is the data of a FrameMessageEdited
+type MessageEditedData struct {
+	ID       string    `json:"id"`
+	Text     string    `json:"text"`
+	EditedBy string    `json:"editedBy"`
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// MessageDeletedData is the data of a FrameMessageDeleted
+type MessageDeletedData struct {
+	ID        string    `json:"id"`
+	DeletedBy string    `json:"deletedBy"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// ReactData is the data of a FrameReact
+type ReactData struct {
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionData is the data of a FrameReaction, Count is the new total of the emoji on the message
+type ReactionData struct {
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	Username  string `json:"username"`
+	Added     bool   `json:"added"`
+	Count     int    `json:"count"`
+}
+
+// DirectOpenedData is the data of a FrameDirectOpened, subscribe to Channel to talk to With
+type DirectOpenedData struct {
+	Channel string `json:"channel"`
+	With    string `json:"with"`
+}
+
+// SubscribeData is the data of a FrameSubscribe, After is the id of the last message the client has,
+// to get only the ones it missed instead of the recent history
+type SubscribeData struct {
+	After string `json:"after"`
+}
+
+// ReadData is the data of an inbound FrameRead, At is the time of the last message seen and defaults to now
+type ReadData struct {
+	At time.Time `json:"at"`
+}
+
+// payload is the data of an outbound FrameMessage, FrameHistory carries a list of them
+type payload struct {
+	ID         string          `json:"id,omitempty"` // missing on messages archived before ids existed
+	Username   string          `json:"username"`
+	Msg        string          `json:"msg"`
+	IsBot      bool            `json:"isBot"`
+	Time       time.Time       `json:"time"`
+	EditedAt   *time.Time      `json:"editedAt,omitempty"`
+	Deleted    bool            `json:"deleted,omitempty"` // a tombstone, Msg is empty
+	Reactions  []user.Reaction `json:"reactions,omitempty"`
+	ParentID   string          `json:"parentId,omitempty"`   // set on replies, the message that started the thread
+	ReplyCount int             `json:"replyCount,omitempty"` // replies in the thread started by this message
+}
+
+// AckData is the data of the FrameAck answering a FrameMessage, a retry with the same frame id gets the same ack
+type AckData struct {
+	MessageID string    `json:"messageId"`
+	Time      time.Time `json:"time"`
+}
+
+// ChannelsUpdatedData is the data of a FrameChannelsUpdated
+type ChannelsUpdatedData struct {
+	Channels []string `json:"channels"`
+}
+
+// MembersData is the data of a FrameMembers
+type MembersData struct {
+	Members []string `json:"members"`
+}
+
+// PresenceData is the data of a FramePresence
+type PresenceData struct {
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+}
+
+// TypingData is the data of an outbound FrameTyping, the indicator should be hidden once ExpiresAt is reached
+// unless another typing frame refreshes it
+type TypingData struct {
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ErrorData is the data of a FrameError
+type ErrorData struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"` // set on rate_limited, when the frame can be sent again
+}
+
+// newFrame encodes a frame ready to be written to the socket, channel and data can be empty
+func newFrame(t FrameType, channel, id string, data any) ([]byte, error) {
+	f := Frame{Version: protocolVersion, Type: t, ID: id, Channel: channel}
+
+	if data != nil {
+		d, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s frame data: %w", t, err)
+		}
+		f.Data = d
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %s frame: %w", t, err)
+	}
+
+	return b, nil
+}
+
+// parseFrame decodes an inbound frame, frames without a version are treated as the current one
+func parseFrame(b []byte) (Frame, *ErrorData) {
+	var f Frame
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, &ErrorData{Code: errCodeBadFrame, Message: "frame is not a valid json envelope"}
+	}
+
+	if f.Version != 0 && f.Version != protocolVersion {
+		return f, &ErrorData{Code: errCodeUnsupportedVersion, Message: fmt.Sprintf("protocol version %d is not supported", f.Version)}
+	}
+
+	if f.Type == "" {
+		return f, &ErrorData{Code: errCodeBadFrame, Message: "frame type is missing"}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxEmojiRunes leaves room for the sequences that make up one emoji (skin tones, flags, joined emojis)
+const maxEmojiRunes = 8
+
+// handleReact publishes the toggle, the archiver applies it and fans the new total out to every instance. It is rate
+// limited like a new message in the channel.
+func (w *Handler) handleReact(s *session, f Frame) {
+	var data ReactData
+	if err := json.Unmarshal(f.Data, &data); err != nil || data.MessageID == "" {
+		w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "react needs a messageId and an emoji")
+		return
+	}
+	if !validEmoji(data.Emoji) {
+		w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "a reaction must be a single emoji")
+		return
+	}
+
+	msg, err := w.archive.GetMessage(context.Background(), &pb.GetMessageRequest{Id: data.MessageID, Username: s.username})
+	if status.Code(err) == codes.NotFound || (err == nil && msg.Deleted) {
+		w.sendError(s, f.Channel, f.ID, errCodeUnknownMessage, "message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("error fetching the message to react to", "id", data.MessageID, "err", err)
+		w.sendError(s, f.Channel, f.ID, errCodeInternal, "reaction could not be sent")
+		return
+	}
+
+	// only the reactions that would go through are charged
+	if errData := w.allowMessage(s.username, msg.Channel, false); errData != nil {
+		w.writeFrame(s, FrameError, f.Channel, f.ID, errData)
+		return
+	}
+
+	j, err := json.Marshal(eventbus.ReactionCommand{
+		MessageID: data.MessageID,
+		Channel:   msg.Channel,
+		Emoji:     data.Emoji,
+		Username:  s.username,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		slog.Error("error serializing ReactionCommand", "err", err)
+		w.sendError(s, msg.Channel, f.ID, errCodeInternal, "reaction could not be sent")
+		return
+	}
+
+	if err := w.eventbus.PublishReactionCommand(string(j)); err != nil {
+		slog.Error(err.Error())
+		w.sendError(s, msg.Channel, f.ID, errCodeInternal, "reaction could not be sent")
+		return
+	}
+
+	w.writeFrame(s, FrameAck, msg.Channel, f.ID, nil)
+}
+
+// validEmoji accepts a short sequence of symbols, anything with letters, digits, spaces or control characters
+// is text and belongs in a message
+func validEmoji(e string) bool {
+	if e == "" || !utf8.ValidString(e) || utf8.RuneCountInString(e) > maxEmojiRunes {
+		return false
+	}
+
+	hasSymbol := false
+	for _, r := range e {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), unicode.IsSpace(r), unicode.IsControl(r):
+			return false
+		case unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	return hasSymbol
+}
+
+// BroadcastReaction tells every session in the channel the new total of an emoji on a message
+func (w *Handler) BroadcastReaction(e eventbus.ReactionEvent) error {
+	h, ok := w.hubs.get(e.Channel)
+	if !ok {
+		return nil // nobody here has the channel open
+	}
+
+	frame, err := newFrame(FrameReaction, e.Channel, "", ReactionData{
+		MessageID: e.MessageID,
+		Emoji:     e.Emoji,
+		Username:  e.Username,
+		Added:     e.Added,
+		Count:     e.Count,
+	})
+	if err != nil {
+		return err
+	}
+
+	// held back while the channel is replayed, the replayed message already has the total
+	h.send(hubFrame{b: frame, hold: true})
+
+	return nil
+}
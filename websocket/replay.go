@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/ap-pauloafonso/investor-chat/pb"
+	"github.com/ap-pauloafonso/investor-chat/user"
+)
+
+const (
+	historySize    = 50   // messages sent to a session that subscribes without a position to resume from
+	replayPageSize = 200  // messages fetched per GetMessagesAfter call
+	maxReplay      = 1000 // a bigger gap isn't replayed, the session gets the recent history instead
+)
+
+// sessionConnected sends the channel history to a session that just subscribed to it and then releases the live
+// messages held back meanwhile. With after set, only the messages after it are sent (a replay frame) so a client
+// that reconnects gets exactly what it missed, otherwise the recent messages (a history frame).
+func (w *Handler) sessionConnected(channel string, s *session, after string) {
+	frameType := FrameReplay
+	msgs, ok, err := w.messagesAfter(s.username, channel, after)
+	if err != nil {
+		slog.Error("error fetching the messages to replay", "channel", channel, "after", after, "err", err)
+	}
+
+	if !ok {
+		frameType = FrameHistory
+		msgs, err = w.recentMessages(s.username, channel)
+		if err != nil {
+			slog.Error("error sending recent messages", "err", err)
+			s.finishReplay(channel, nil, nil)
+			return
+		}
+	}
+
+	frame, err := messagesFrame(frameType, channel, msgs)
+	if err != nil {
+		slog.Error(err.Error())
+		s.finishReplay(channel, nil, nil)
+		return
+	}
+
+	replayed := make(map[string]bool, len(msgs))
+	for _, m := range msgs {
+		if m.ID != "" {
+			replayed[m.ID] = true
+		}
+	}
+
+	// broadcasts still queued in the hub may already be in the history, they must be held back to be dropped
+	if h, ok := w.hubs.get(channel); ok {
+		<-h.flush()
+	}
+
+	s.finishReplay(channel, frame, replayed)
+}
+
+// messagesAfter fetches every message archived after the given id, ok is false when there is nothing to resume
+// from: no id, an id the archive doesn't know or a gap bigger than maxReplay
+func (w *Handler) messagesAfter(username, channel, after string) (msgs []user.Message, ok bool, err error) {
+	if after == "" {
+		return nil, false, nil
+	}
+
+	for {
+		resp, err := w.archive.GetMessagesAfter(context.Background(), &pb.GetMessagesAfterRequest{
+			Channel:     channel,
+			AfterId:     after,
+			MaxMessages: replayPageSize,
+			Username:    username,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !resp.Found {
+			return nil, false, nil
+		}
+
+		msgs = append(msgs, fromPB(resp.Messages)...)
+
+		if !resp.HasMore {
+			return msgs, true, nil
+		}
+		if len(msgs) >= maxReplay || len(resp.Messages) == 0 {
+			return nil, false, nil
+		}
+
+		after = resp.Messages[len(resp.Messages)-1].Id
+	}
+}
+
+func (w *Handler) recentMessages(username, channel string) ([]user.Message, error) {
+	// get recent messages using grpc
+	resp, err := w.archive.GetRecentMessages(context.Background(), &pb.GetRecentMessagesRequest{
+		Channel:     channel,
+		MaxMessages: historySize,
+		Username:    username,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fromPB(resp.Messages), nil
+}
+
+// fromPB converts the messages back to our standard message object
+func fromPB(messages []*pb.Message) []user.Message {
+	r := make([]user.Message, len(messages))
+	for i := range messages {
+		item := messages[i]
+		r[i] = user.Message{
+			ID:         item.Id,
+			Channel:    item.Channel,
+			User:       item.User,
+			Text:       item.Text,
+			Timestamp:  item.Timestamp.AsTime(),
+			Deleted:    item.Deleted,
+			ParentID:   item.ParentId,
+			ReplyCount: int(item.ReplyCount),
+		}
+		if item.EditedAt != nil {
+			r[i].EditedAt = item.EditedAt.AsTime()
+		}
+		for _, reaction := range item.Reactions {
+			r[i].Reactions = append(r[i].Reactions, user.Reaction{Emoji: reaction.Emoji, Count: int(reaction.Count)})
+		}
+	}
+	return r
+}
+
+// messagesFrame encodes archived messages as a history or replay frame
+func messagesFrame(t FrameType, channel string, msgs []user.Message) ([]byte, error) {
+	arr := make([]payload, len(msgs))
+
+	for i, m := range msgs {
+		arr[i] = payload{
+			ID:         m.ID,
+			Username:   m.User,
+			Msg:        m.Text,
+			IsBot:      false,
+			Time:       m.Timestamp,
+			Deleted:    m.Deleted,
+			Reactions:  m.Reactions,
+			ParentID:   m.ParentID,
+			ReplyCount: m.ReplyCount,
+		}
+		if !m.EditedAt.IsZero() {
+			editedAt := m.EditedAt
+			arr[i].EditedAt = &editedAt
+		}
+	}
+
+	b, err := newFrame(t, channel, "", arr)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding recent messages: %w", err)
+	}
+
+	return b, nil
+}
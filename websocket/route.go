@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+)
+
+// Router knows the instances each user has sessions on, so something for one user reaches them wherever they are
+type Router interface {
+	Connected(ctx context.Context, sessionID, username string) error
+	Disconnected(ctx context.Context, sessionID string) error
+	SendToUser(ctx context.Context, d eventbus.UserDelivery) error
+}
+
+// SendToUser sends a frame to every session the user has open, on this instance or any other one. With channel set
+// only the sessions subscribed to it get the frame. It fails with routing.ErrOffline when the user isn't connected.
+func (w *Handler) SendToUser(ctx context.Context, username, channel string, t FrameType, data any) error {
+	b, err := newFrame(t, channel, "", data)
+	if err != nil {
+		return err
+	}
+
+	return w.router.SendToUser(ctx, eventbus.UserDelivery{Username: username, Channel: channel, Frame: b})
+}
+
+// KickUser closes every session the user has open, wherever they are, with the given reason
+func (w *Handler) KickUser(ctx context.Context, username, reason string) error {
+	return w.router.SendToUser(ctx, eventbus.UserDelivery{Username: username, Kick: reason})
+}
+
+// KickLogin closes the sessions opened with the login of the user, wherever they are, with the given reason
+func (w *Handler) KickLogin(ctx context.Context, username, login, reason string) error {
+	return w.router.SendToUser(ctx, eventbus.UserDelivery{Username: username, Login: login, Kick: reason})
+}
+
+// DeliverToUser hands a delivery routed to this instance to the sessions of its user, it reports whether any got it
+func (w *Handler) DeliverToUser(d eventbus.UserDelivery) bool {
+	var delivered bool
+	for _, s := range w.userSessions(d.Username, d.Channel) {
+		if d.Login != "" && s.login != d.Login {
+			continue
+		}
+
+		if d.Kick != "" {
+			slog.Info("[user kicked]", "user", s.username, "session", s.id, "reason", d.Kick)
+			s.close(statusKicked, d.Kick)
+			delivered = true
+			continue
+		}
+
+		if s.enqueue(d.Frame) {
+			delivered = true
+		}
+	}
+
+	return delivered
+}
+
+// userSessions returns the sessions the user has open here, only the ones subscribed to channel when it is set
+func (w *Handler) userSessions(username, channel string) []*session {
+	if channel != "" {
+		h, ok := w.hubs.get(channel)
+		if !ok {
+			return nil
+		}
+		return h.sessions(username)
+	}
+
+	var r []*session
+	for _, s := range w.hubs.allSessions() {
+		if s.username == username {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// LocalSessions returns the sessions open on this instance, session id -> username
+func (w *Handler) LocalSessions() map[string]string {
+	r := map[string]string{}
+	for _, s := range w.hubs.allSessions() {
+		r[s.id] = s.username
+	}
+	return r
+}
@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/utils"
+	"nhooyr.io/websocket"
+)
+
+const (
+	sendQueueSize = 256              // frames a session can have pending before it is considered too slow
+	writeTimeout  = 10 * time.Second // deadline for a single frame to be written to the socket
+)
+
+// session is a single client connection, a websocket or an event stream. A user can have several of them open at
+// once (e.g. one per browser tab or device) and each of them can be subscribed to several channels.
+// Frames are never written to the socket by the caller, they are queued and written by the session's own writer
+// goroutine, so one stalled client can't hold back the others.
+type session struct {
+	id       string
+	username string
+	login    string // the login its token was issued for, logging out of it closes the session
+	conn     transport
+
+	channels map[string]struct{} // channels the session is subscribed to, guarded by hubRegistry
+
+	lastRead atomic.Int64 // unix nanoseconds of the last frame received from the client
+
+	send    chan []byte
+	done    chan struct{}
+	mu      sync.Mutex // guards closed, so nothing is queued after the writer stopped, and replays
+	closed  bool
+	replays map[string][]heldFrame // channels whose history is being fetched -> live frames held back meanwhile
+
+	// drain asks the writer to write what is queued and then close with closeCode, it closes flushed when done
+	flush       chan struct{}
+	flushed     chan struct{}
+	closeCode   websocket.StatusCode
+	closeReason string
+}
+
+// heldFrame is a live message frame held back while its channel is being replayed
+type heldFrame struct {
+	id string
+	b  []byte
+}
+
+func newSession(username string, conn transport) *session {
+	s := &session{
+		id:       utils.NewID(),
+		username: username,
+		conn:     conn,
+		send:     make(chan []byte, sendQueueSize),
+		done:     make(chan struct{}),
+		flush:    make(chan struct{}),
+		flushed:  make(chan struct{}),
+	}
+	s.touch()
+
+	go s.writeLoop()
+
+	return s
+}
+
+// touch records that the client just sent a frame
+func (s *session) touch() {
+	s.lastRead.Store(time.Now().UnixNano())
+}
+
+func (s *session) lastActive() time.Time {
+	return time.Unix(0, s.lastRead.Load())
+}
+
+// enqueue queues the frame without blocking, a session whose queue is full is evicted as a slow consumer
+func (s *session) enqueue(b []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enqueueLocked(b)
+}
+
+func (s *session) enqueueLocked(b []byte) bool {
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.send <- b:
+		queuedFrames.Add(1)
+		return true
+	default:
+		s.evictLocked()
+		return false
+	}
+}
+
+func (s *session) evictLocked() {
+	droppedFrames.Add(1)
+	slowConsumerEvictions.Add(1)
+	slog.Warn("[slow consumer evicted]", "user", s.username, "session", s.id)
+	s.closeLocked(statusSlowConsumer, "slow consumer: too many pending frames")
+}
+
+// startReplay holds back the live messages of the channel until finishReplay, so they can't overtake its history
+func (s *session) startReplay(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replays == nil {
+		s.replays = map[string][]heldFrame{}
+	}
+	s.replays[channel] = []heldFrame{}
+}
+
+// cancelReplay drops whatever was held back for the channel, for when the session unsubscribed from it
+func (s *session) cancelReplay(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.replays, channel)
+}
+
+// deliver queues a live message of the channel, or holds it back while the channel is being replayed
+func (s *session) deliver(channel, id string, b []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.replays[channel]
+	if !ok {
+		return s.enqueueLocked(b)
+	}
+
+	if s.closed {
+		return false
+	}
+
+	// held frames count against the same budget as the queued ones
+	if len(held) >= sendQueueSize {
+		s.evictLocked()
+		return false
+	}
+
+	s.replays[channel] = append(held, heldFrame{id: id, b: b})
+	return true
+}
+
+// finishReplay queues the replay frame followed by the live messages held back meanwhile,
+// minus the ones the replay already has. A nil replay only releases the held messages.
+func (s *session) finishReplay(channel string, replay []byte, replayed map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.replays[channel]
+	if !ok {
+		return // unsubscribed meanwhile
+	}
+	delete(s.replays, channel)
+
+	if replay != nil && !s.enqueueLocked(replay) {
+		return
+	}
+
+	for _, f := range held {
+		if f.id != "" && replayed[f.id] {
+			continue
+		}
+		if !s.enqueueLocked(f.b) {
+			return
+		}
+	}
+}
+
+func (s *session) writeLoop() {
+	for {
+		select {
+		case b := <-s.send:
+			queuedFrames.Add(-1)
+			if err := s.write(b); err != nil {
+				slog.Error("error writing to user ws", "user", s.username, "session", s.id, "err", err)
+				s.close(websocket.StatusInternalError, "write failed")
+			}
+		case <-s.done:
+			// nothing can be queued anymore, whatever is left will never be written
+			n := int64(len(s.send))
+			queuedFrames.Add(-n)
+			droppedFrames.Add(n)
+			return
+		case <-s.flush:
+			s.flushQueue()
+			return
+		}
+	}
+}
+
+// flushQueue writes the frames still queued and closes the connection, nothing can be queued anymore
+func (s *session) flushQueue() {
+	defer close(s.flushed)
+
+	for {
+		select {
+		case b := <-s.send:
+			queuedFrames.Add(-1)
+			if err := s.write(b); err != nil {
+				n := int64(len(s.send))
+				queuedFrames.Add(-n)
+				droppedFrames.Add(n)
+				_ = s.conn.closeNow()
+				return
+			}
+		default:
+			_ = s.conn.close(s.closeCode, s.closeReason)
+			return
+		}
+	}
+}
+
+// drain stops taking frames, lets the writer flush the ones already queued and close the connection with the given
+// status. It returns once the connection is closed, or drops it when ctx is done first.
+func (s *session) drain(ctx context.Context, code websocket.StatusCode, reason string) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.closeCode, s.closeReason = code, reason
+	close(s.flush)
+	s.mu.Unlock()
+
+	select {
+	case <-s.flushed:
+	case <-ctx.Done():
+		_ = s.conn.closeNow()
+	}
+}
+
+func (s *session) write(b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	return s.conn.write(ctx, b)
+}
+
+// close stops the writer and closes the connection with the given status, only the first call has any effect
+func (s *session) close(code websocket.StatusCode, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeLocked(code, reason)
+}
+
+func (s *session) closeLocked(code websocket.StatusCode, reason string) {
+	if !s.stopLocked() {
+		return
+	}
+
+	// the close handshake waits for the peer, don't hold the caller (usually a broadcast) on it
+	go func() {
+		_ = s.conn.close(code, reason)
+	}()
+}
+
+// stop stops the writer without touching the connection, for when the connection is already gone
+func (s *session) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopLocked()
+}
+
+func (s *session) stopLocked() bool {
+	if s.closed {
+		return false
+	}
+
+	s.closed = true
+	close(s.done)
+	return true
+}
@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/utils"
+	"github.com/labstack/echo/v4"
+	"nhooyr.io/websocket"
+)
+
+// defaultStreamHeartbeat keeps the proxies from timing out a quiet stream when no ping interval is configured
+const defaultStreamHeartbeat = 20 * time.Second
+
+// sseTransport writes the frames of a session as server-sent events, each event is a frame envelope
+type sseTransport struct {
+	res   *echo.Response
+	rc    *http.ResponseController
+	mu    sync.Mutex // for mutual exclusion while writing to the response
+	ended bool       // the handler returned, the response can't be written anymore
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newSSETransport(res *echo.Response) *sseTransport {
+	return &sseTransport{res: res, rc: http.NewResponseController(res.Writer), done: make(chan struct{})}
+}
+
+func (t *sseTransport) write(ctx context.Context, b []byte) error {
+	return t.send(ctx, "data: "+string(b)+"\n\n")
+}
+
+// ping is a comment line, ignored by the clients but it keeps the proxies on the way from closing the stream
+func (t *sseTransport) ping(ctx context.Context) error {
+	return t.send(ctx, ": ping\n\n")
+}
+
+// close sends a last "close" event with the same status a websocket would get, then ends the stream
+func (t *sseTransport) close(code websocket.StatusCode, reason string) error {
+	b, err := json.Marshal(struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}{int(code), reason})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	err = t.send(ctx, "event: close\ndata: "+string(b)+"\n\n")
+	_ = t.closeNow()
+	return err
+}
+
+func (t *sseTransport) closeNow() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// finish is called once the handler returns, nothing is written from then on
+func (t *sseTransport) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ended = true
+	_ = t.closeNow()
+}
+
+func (t *sseTransport) send(ctx context.Context, event string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ended {
+		return errSessionClosed
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := t.rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprint(t.res, event); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// HandleStream serves the channel in the route as server-sent events, for the clients that can't open a websocket.
+// The stream gets the same frames a websocket subscribed to the channel would, messages are sent with
+// HandlePostMessage.
+func (w *Handler) HandleStream(c echo.Context) error {
+	u, ok := c.Get("username").(string)
+	channel := c.Param("name")
+	if !ok || channel == "" {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	if code, msg := w.checkAccept(c.Request().Context(), u, channel); code != http.StatusOK {
+		return c.JSON(code, utils.ErrorMessage{ErrorMessage: msg})
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no") // proxies must pass the events through as they come
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	t := newSSETransport(res)
+	s := newSession(u, t)
+	s.login, _ = c.Get("login").(string)
+	w.register(c.Request().Context(), s)
+	defer func() {
+		w.unregister(s)
+		t.finish()
+	}()
+
+	w.sendPendingMentions(c.Request().Context(), s)
+	w.subscribe(s, channel, "", c.QueryParam("after"))
+
+	interval := w.keepAliveConfig.PingInterval
+	if interval <= 0 {
+		interval = defaultStreamHeartbeat
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil // the client went away
+		case <-t.done:
+			return nil // closed by the server: evicted or drained
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+			err := t.ping(ctx)
+			cancel()
+			if err != nil {
+				slog.Info("[stream ping failed]", "user", u, "session", s.id, "err", err)
+				return nil
+			}
+		}
+	}
+}
+
+// HandlePostMessage sends a message to the channel in the route, the way a websocket message frame does.
+// It answers with the ack data, the message itself arrives like any other. The Idempotency-Key header plays
+// the part of the frame id, a retry with the same key is acked again instead of being sent twice.
+func (w *Handler) HandlePostMessage(c echo.Context) error {
+	u, ok := c.Get("username").(string)
+	channel := c.Param("name")
+	if !ok || channel == "" {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
+	}
+
+	var data MessageData
+	if err := c.Bind(&data); err != nil {
+		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "invalid message data"})
+	}
+
+	// the archiver can't store messages of channels that don't exist, they must not be published
+	if errData := w.checkAccess(c.Request().Context(), channel, u); errData != nil {
+		return errorResponse(c, errData)
+	}
+
+	ack, errData := w.publishMessage(u, channel, c.Request().Header.Get("Idempotency-Key"), data)
+	if errData != nil {
+		return errorResponse(c, errData)
+	}
+
+	return c.JSON(http.StatusOK, ack)
+}
+
+// errorResponse answers a REST request with the status matching the error a frame would get
+func errorResponse(c echo.Context, errData *ErrorData) error {
+	if errData.Code == errCodeRateLimited {
+		c.Response().Header().Set("Retry-After", fmt.Sprint((errData.RetryAfterMs+999)/1000))
+	}
+
+	return c.JSON(errorStatus(errData), utils.ErrorMessage{ErrorMessage: errData.Message})
+}
+
+// errorStatus is the HTTP status matching the error a frame would get
+func errorStatus(errData *ErrorData) int {
+	switch errData.Code {
+	case errCodeInternal:
+		return http.StatusInternalServerError
+	case errCodeForbidden:
+		return http.StatusForbidden
+	case errCodeUnknownMessage, errCodeUnknownChannel:
+		return http.StatusNotFound
+	case errCodeRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadRequest
+	}
+}
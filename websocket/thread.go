@@ -0,0 +1,29 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ap-pauloafonso/investor-chat/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// threadRoot resolves the thread a reply goes to. Threads are a single level deep, so replying to a reply answers
+// in the thread of its parent.
+func (w *Handler) threadRoot(username, channel, parentID string) (string, *ErrorData) {
+	parent, err := w.archive.GetMessage(context.Background(), &pb.GetMessageRequest{Id: parentID, Username: username})
+	if status.Code(err) == codes.NotFound || (err == nil && (parent.Deleted || parent.Channel != channel)) {
+		return "", &ErrorData{Code: errCodeUnknownMessage, Message: "the message to reply to was not found in the channel"}
+	}
+	if err != nil {
+		slog.Error("error fetching the message to reply to", "id", parentID, "err", err)
+		return "", &ErrorData{Code: errCodeInternal, Message: "message could not be sent"}
+	}
+
+	if parent.ParentId != "" {
+		return parent.ParentId, nil
+	}
+
+	return parent.Id, nil
+}
@@ -0,0 +1,33 @@
+package websocket
+
+import (
+	"context"
+
+	"nhooyr.io/websocket"
+)
+
+// transport carries the frames of a session to its client, so websocket and server-sent events connections are
+// registered, broadcast to and drained the same way
+type transport interface {
+	// write sends a single frame, only the writer goroutine of the session calls it
+	write(ctx context.Context, b []byte) error
+	// close ends the connection telling the client why, closeNow drops it without a word
+	close(code websocket.StatusCode, reason string) error
+	closeNow() error
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t wsTransport) write(ctx context.Context, b []byte) error {
+	return t.conn.Write(ctx, websocket.MessageText, b)
+}
+
+func (t wsTransport) close(code websocket.StatusCode, reason string) error {
+	return t.conn.Close(code, reason)
+}
+
+func (t wsTransport) closeNow() error {
+	return t.conn.CloseNow()
+}
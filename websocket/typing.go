@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+)
+
+// typingInterval is the minimum time between two typing events relayed for the same user and channel,
+// clients send a typing frame on every key stroke
+const typingInterval = 2 * time.Second
+
+// throttle lets a key through at most once every interval
+type throttle struct {
+	every time.Duration
+	now   func() time.Time
+
+	last       map[string]time.Time
+	sync.Mutex // for mutual exclusion while operating over last
+}
+
+func newThrottle(every time.Duration) *throttle {
+	return &throttle{every: every, now: time.Now, last: map[string]time.Time{}}
+}
+
+func (t *throttle) allow(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.every {
+		return false
+	}
+	t.last[key] = now
+
+	// forget the keys that can't hold anything back anymore, so the map doesn't grow forever
+	if len(t.last) > 1024 {
+		for k, v := range t.last {
+			if now.Sub(v) >= t.every {
+				delete(t.last, k)
+			}
+		}
+	}
+
+	return true
+}
+
+// handleTyping relays a typing frame to every instance, typing frames are best effort and never acked
+func (w *Handler) handleTyping(s *session, f Frame) {
+	if f.Channel == "" {
+		w.sendError(s, "", f.ID, errCodeMissingChannel, "typing needs a channel")
+		return
+	}
+
+	if !w.hubs.isSubscribed(f.Channel, s) {
+		w.sendError(s, f.Channel, f.ID, errCodeNotSubscribed, "subscribe to the channel before typing")
+		return
+	}
+
+	if !w.typing.allow(s.username + "\x00" + f.Channel) {
+		return
+	}
+
+	j, err := json.Marshal(eventbus.TypingEvent{Channel: f.Channel, Username: s.username, Time: time.Now()})
+	if err != nil {
+		slog.Error("error serializing TypingEvent", "err", err)
+		return
+	}
+
+	if err := w.eventbus.PublishTypingEvent(string(j)); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// BroadcastTyping tells the other users of the channel that someone is typing
+func (w *Handler) BroadcastTyping(e eventbus.TypingEvent) error {
+	expiresAt := e.Time.Add(eventbus.TypingTTL)
+	if time.Now().After(expiresAt) {
+		return nil // it sat in the queue for too long, it would only show up already stale
+	}
+
+	h, ok := w.hubs.get(e.Channel)
+	if !ok {
+		return nil
+	}
+
+	frame, err := newFrame(FrameTyping, e.Channel, "", TypingData{Username: e.Username, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+
+	h.send(hubFrame{b: frame, except: e.Username})
+
+	return nil
+}
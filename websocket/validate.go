@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	defaultMaxMessageLength = 2000
+	defaultReadLimit        = 64 << 10
+)
+
+// Limits caps what a client can send, a zero field uses its default
+type Limits struct {
+	MaxMessageLength int   // characters in the text of a message or an edit, counted after normalization
+	ReadLimit        int64 // bytes in a single frame, a bigger one closes the connection with status 1009
+}
+
+func (l Limits) maxMessageLength() int {
+	if l.MaxMessageLength <= 0 {
+		return defaultMaxMessageLength
+	}
+	return l.MaxMessageLength
+}
+
+func (l Limits) readLimit() int64 {
+	if l.ReadLimit <= 0 {
+		return defaultReadLimit
+	}
+	return l.ReadLimit
+}
+
+// normalizeText returns the text the way it is stored: NFC normalized, with unix line breaks and trimmed.
+// Empty texts, texts over max characters and control characters other than line breaks and tabs are rejected.
+func normalizeText(text string, max int) (string, *ErrorData) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimSpace(norm.NFC.String(text))
+
+	if text == "" {
+		return "", &ErrorData{Code: errCodeEmptyMessage, Message: "message is empty"}
+	}
+
+	if n := utf8.RuneCountInString(text); n > max {
+		return "", &ErrorData{Code: errCodeMessageTooLong, Message: fmt.Sprintf("message has %d characters, the limit is %d", n, max)}
+	}
+
+	for _, r := range text {
+		if disallowedRune(r) {
+			return "", &ErrorData{Code: errCodeInvalidText, Message: fmt.Sprintf("message has a disallowed character %U", r)}
+		}
+	}
+
+	return text, nil
+}
+
+// disallowedRune reports the control characters that don't belong in a chat message, including the bidirectional
+// overrides that make a text display differently from what it says
+func disallowedRune(r rune) bool {
+	switch {
+	case r == '\n' || r == '\t':
+		return false
+	case unicode.IsControl(r):
+		return true
+	case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return false
+}
@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/channel"
 	"github.com/ap-pauloafonso/investor-chat/eventbus"
 	"github.com/ap-pauloafonso/investor-chat/pb"
+	"github.com/ap-pauloafonso/investor-chat/presence"
+	"github.com/ap-pauloafonso/investor-chat/ratelimit"
+	"github.com/ap-pauloafonso/investor-chat/readmarker"
+	"github.com/ap-pauloafonso/investor-chat/routing"
 	"github.com/ap-pauloafonso/investor-chat/user"
 	"github.com/ap-pauloafonso/investor-chat/utils"
 	"github.com/labstack/echo/v4"
@@ -14,111 +19,114 @@ import (
 	"net/http"
 	"nhooyr.io/websocket"
 	"regexp"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	errChannelNotFound = errors.New("channel not found")
+	errSessionClosed = errors.New("ws: session is closed")
 )
 
-type ChannelUserConnections struct {
-	users        map[string]*websocket.Conn
-	sync.RWMutex // for mutual exclusion while operating over users inside a channel
+type Handler struct {
+	archive         pb.ArchiveServiceClient
+	hubs            *hubRegistry
+	eventbus        Eventbus
+	presence        Presence
+	readMarkers     ReadMarkers
+	moderators      Moderators
+	access          Access
+	mentions        Mentions
+	rateLimiter     RateLimiter
+	router          Router
+	limits          Limits
+	keepAliveConfig KeepAlive
+	originPatterns  []string // hosts of the pages besides our own allowed to open a websocket, see websocket.AcceptOptions
+	typing          *throttle
+	draining        atomic.Bool // set by Drain, new connections are refused
+	received        *dedupCache // message ids published by this instance, to ack retries without publishing them again
+	broadcasted     *dedupCache // message ids broadcast by this instance, to drop the copies of retries
 }
 
-func (c *ChannelUserConnections) addUser(user string, conn *websocket.Conn) {
-	c.Lock()
-	defer c.Unlock()
-	c.users[user] = conn
+type Eventbus interface {
+	PublishUserMessageCommand(msg string) error
+	PublishBotCommandRequest(msg string) error
+	PublishTypingEvent(msg string) error
+	PublishMessageChangeCommand(msg string) error
+	PublishReactionCommand(msg string) error
 }
 
-func (c *ChannelUserConnections) removeUser(user string) {
-	c.Lock()
-	defer c.Unlock()
-	delete(c.users, user)
+type Presence interface {
+	Joined(channel, username string) error
+	Left(channel, username string) error
+	Members(channel string) []string
 }
 
-func (c *ChannelUserConnections) getUser(user string) (*websocket.Conn, bool) {
-	c.RLock()
-	defer c.RUnlock()
-	r, ok := c.users[user]
-	return r, ok
-
+type Moderators interface {
+	IsModerator(ctx context.Context, username string) (bool, error)
 }
 
-type ChannelConnections struct {
-	channels     map[string]*ChannelUserConnections
-	sync.RWMutex // for mutual exclusion while operating over a channel
+// Access tells whether a user can subscribe to a channel, direct channels are only open to their members.
+// It returns channel.ErrChannelNotFound for a channel that doesn't exist.
+type Access interface {
+	CanAccess(ctx context.Context, channel, username string) (bool, error)
 }
 
-func (c *ChannelConnections) addChannel(channelName string) {
-	c.Lock()
-	defer c.Unlock()
-
-	c.channels[channelName] = &ChannelUserConnections{
-		users: map[string]*websocket.Conn{},
-	}
+// RateLimiter tells whether a user can send one more message to a channel, the limits are shared by every instance
+type RateLimiter interface {
+	AllowMessage(ctx context.Context, username, channel string, botCommand bool) (ratelimit.Decision, error)
 }
 
-func (c *ChannelConnections) addUser(channel, user string, conn *websocket.Conn) {
-	slog.Info("trying to add user con map")
-	c.RLock()
-	channelUsers, ok := c.channels[channel]
-	c.RUnlock()
-	if !ok {
-		c.addChannel(channel)              // first user logged in this channel, create the channel entry on our map
-		channelUsers = c.channels[channel] // retry
-	}
-
-	channelUsers.addUser(user, conn)
-	slog.Info("user added to con map")
-
-}
-
-func (c *ChannelConnections) removeUser(channel, user string) {
-	c.RLock()
-	defer c.RUnlock()
-
-	users, ok := c.channels[channel]
-	if ok {
-		users.removeUser(user)
-	}
-
-}
-
-func (c *ChannelConnections) getChannelUsers(channel string) (*ChannelUserConnections, bool) {
-	c.RLock()
-	defer c.RUnlock()
-	r, ok := c.channels[channel]
-	return r, ok
-
-}
-
-type Handler struct {
-	archive            pb.ArchiveServiceClient
-	channelConnections ChannelConnections
-	eventbus           *eventbus.Eventbus
+type ReadMarkers interface {
+	MarkRead(ctx context.Context, username, channel string, at time.Time) error
 }
 
 type MessageObj struct {
+	ID       string
 	Username string
 	Channel  string
 	Message  string
 	Time     time.Time
+	ParentID string // set on replies, the message that started the thread
 }
 
-func NewWebSocketHandler(eventbus *eventbus.Eventbus, archive pb.ArchiveServiceClient) *Handler {
-
-	channels := make(map[string]*ChannelUserConnections)
+// Deps is what a Handler works with, Limits and KeepAlive left zero get their defaults
+type Deps struct {
+	Eventbus       Eventbus
+	Archive        pb.ArchiveServiceClient
+	Presence       Presence
+	ReadMarkers    ReadMarkers
+	Moderators     Moderators
+	Access         Access
+	Mentions       Mentions
+	RateLimiter    RateLimiter
+	Router         Router
+	Limits         Limits
+	KeepAlive      KeepAlive
+	OriginPatterns []string // hosts of the pages besides our own allowed to open a websocket, see websocket.AcceptOptions
+}
 
+func NewWebSocketHandler(d Deps) *Handler {
 	return &Handler{
-		channelConnections: ChannelConnections{channels: channels},
-		eventbus:           eventbus,
-		archive:            archive,
+		hubs:            newHubRegistry(),
+		eventbus:        d.Eventbus,
+		archive:         d.Archive,
+		presence:        d.Presence,
+		readMarkers:     d.ReadMarkers,
+		moderators:      d.Moderators,
+		access:          d.Access,
+		mentions:        d.Mentions,
+		rateLimiter:     d.RateLimiter,
+		router:          d.Router,
+		limits:          d.Limits,
+		keepAliveConfig: d.KeepAlive,
+		originPatterns:  d.OriginPatterns,
+		typing:          newThrottle(typingInterval),
+		received:        newDedupCache(dedupTTL),
+		broadcasted:     newDedupCache(dedupTTL),
 	}
 }
 
+// HandleRequest serves a connection bound to the channel in the route, frames without a channel default to it
 func (w *Handler) HandleRequest(c echo.Context) error {
 
 	// Extract the channel from the route parameter
@@ -128,124 +136,461 @@ func (w *Handler) HandleRequest(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
 	}
 
+	return w.accept(c, channelParam)
+}
+
+// HandleMultiplexRequest serves a connection that starts without channels,
+// the client picks them with subscribe/unsubscribe frames
+func (w *Handler) HandleMultiplexRequest(c echo.Context) error {
+	return w.accept(c, "")
+}
+
+func (w *Handler) accept(c echo.Context, defaultChannel string) error {
 	u, ok := c.Get("username").(string)
 	if !ok {
 		return c.JSON(http.StatusBadRequest, utils.ErrorMessage{ErrorMessage: "Bad Request"})
 	}
 
-	slog.Info("[user trying to connection]", "channel", channelParam, "user", u)
+	slog.Info("[user trying to connection]", "channel", defaultChannel, "user", u)
 
-	conn, err := websocket.Accept(c.Response(), c.Request(), nil)
+	if code, msg := w.checkAccept(c.Request().Context(), u, defaultChannel); code != http.StatusOK {
+		return c.JSON(code, utils.ErrorMessage{ErrorMessage: msg})
+	}
+
+	// a page from another site could open it with the user's cookie, only the allowed origins can
+	conn, err := websocket.Accept(c.Response(), c.Request(), &websocket.AcceptOptions{OriginPatterns: w.originPatterns})
 	if err != nil {
 		return err
 	}
+	conn.SetReadLimit(w.limits.readLimit())
 
-	w.channelConnections.addUser(channelParam, u, conn)
+	s := newSession(u, wsTransport{conn})
+	s.login, _ = c.Get("login").(string)
+	w.register(c.Request().Context(), s)
 
-	slog.Info("[user connected]", "channel", channelParam, "user", u)
+	ctx, cancel := context.WithCancel(context.Background())
+	keepAliveDone := make(chan struct{})
+	go func() {
+		defer close(keepAliveDone)
+		w.keepAlive(ctx, s, conn)
+	}()
 
 	defer func() {
-
+		// a ping in flight must not race with the close below
+		cancel()
+		<-keepAliveDone
 		defer utils.ExecAndPrintErr(conn.CloseNow)
-		w.channelConnections.removeUser(channelParam, u)
-		slog.Info("[user disconnected]", "channel", channelParam, "user", u)
-
+		w.unregister(s)
 	}()
 
-	go w.UserConnected(channelParam, u)
+	w.sendPendingMentions(c.Request().Context(), s)
+
+	if defaultChannel != "" {
+		w.subscribe(s, defaultChannel, "", c.QueryParam("after"))
+	}
+
+	return w.serve(ctx, s, conn, defaultChannel)
+}
+
+// checkAccept tells whether the user can connect, to the channel when there is one.
+// It answers http.StatusOK or the status and message to refuse the connection with.
+func (w *Handler) checkAccept(ctx context.Context, username, channel string) (int, string) {
+	if w.draining.Load() {
+		return http.StatusServiceUnavailable, "Service Unavailable"
+	}
+
+	if channel != "" {
+		if errData := w.checkAccess(ctx, channel, username); errData != nil {
+			return errorStatus(errData), errData.Message
+		}
+	}
+
+	return http.StatusOK, ""
+}
+
+// checkAccess tells whether the user can use the channel, it returns the error to answer with when they can't
+func (w *Handler) checkAccess(ctx context.Context, name, username string) *ErrorData {
+	ok, err := w.access.CanAccess(ctx, name, username)
+	if errors.Is(err, channel.ErrChannelNotFound) {
+		return &ErrorData{Code: errCodeUnknownChannel, Message: "channel not found"}
+	}
+	if err != nil {
+		slog.Error("error checking channel access", "channel", name, "user", username, "err", err)
+		return &ErrorData{Code: errCodeInternal, Message: "channel access could not be checked"}
+	}
+	if !ok {
+		return &ErrorData{Code: errCodeForbidden, Message: "this channel is private"}
+	}
+
+	return nil
+}
+
+// register adds a freshly opened session to the registry, whatever its transport
+func (w *Handler) register(ctx context.Context, s *session) {
+	w.hubs.addSession(s)
+
+	// not routable until the next refresh when it fails, the session works otherwise
+	if err := w.router.Connected(ctx, s.id, s.username); err != nil {
+		slog.Error("error registering session", "user", s.username, "session", s.id, "err", err)
+	}
+
+	// accepted while Drain was taking its snapshot of the sessions
+	if w.draining.Load() {
+		s.drain(ctx, websocket.StatusServiceRestart, drainReason)
+	}
+
+	slog.Info("[user connected]", "user", s.username, "session", s.id)
+}
 
+// unregister stops the session and removes it from every channel it was subscribed to
+func (w *Handler) unregister(s *session) {
+	s.stop()
+	for _, channel := range w.hubs.unsubscribeAll(s) {
+		w.userLeft(channel, s.username)
+	}
+	w.hubs.removeSession(s)
+	if err := w.router.Disconnected(context.Background(), s.id); err != nil {
+		slog.Error("error unregistering session", "user", s.username, "session", s.id, "err", err)
+	}
+	slog.Info("[user disconnected]", "user", s.username, "session", s.id)
+}
+
+// serve reads the frames sent by the client until the connection is closed
+func (w *Handler) serve(ctx context.Context, s *session, conn *websocket.Conn, defaultChannel string) error {
 	for {
 
-		_, p, err := conn.Read(context.Background())
+		typ, p, err := conn.Read(ctx)
 		if err != nil {
 			return err
 		}
 
-		t := time.Now()
+		s.touch()
 
-		j, err := json.Marshal(MessageObj{
-			u, channelParam, string(p), t,
-		})
-		if err != nil {
-			slog.Error("error serializing MessageObj", err)
+		if typ != websocket.MessageText {
+			w.sendError(s, "", "", errCodeBadFrame, "binary frames are not supported")
 			continue
 		}
 
-		// send the payload to queue
-		err = w.eventbus.PublishUserMessageCommand(string(j))
-		if err != nil {
+		f, errData := parseFrame(p)
+		if errData != nil {
+			w.sendError(s, f.Channel, f.ID, errData.Code, errData.Message)
+			continue
+		}
+
+		if f.Channel == "" {
+			f.Channel = defaultChannel
+		}
+
+		switch f.Type {
+		case FrameMessage:
+			w.handleChatMessage(s, f)
+		case FrameSubscribe:
+			w.handleSubscribe(s, f)
+		case FrameUnsubscribe:
+			w.handleUnsubscribe(s, f)
+		case FrameTyping:
+			w.handleTyping(s, f)
+		case FrameRead:
+			w.handleRead(s, f)
+		case FrameEdit:
+			w.handleEdit(s, f)
+		case FrameDelete:
+			w.handleDelete(s, f)
+		case FrameReact:
+			w.handleReact(s, f)
+		default:
+			w.sendError(s, f.Channel, f.ID, errCodeUnknownType, fmt.Sprintf("frame type %q is not supported", f.Type))
+		}
+
+	}
+}
+
+func (w *Handler) handleSubscribe(s *session, f Frame) {
+	if f.Channel == "" {
+		w.sendError(s, "", f.ID, errCodeMissingChannel, "subscribe needs a channel")
+		return
+	}
+
+	var data SubscribeData
+	if len(f.Data) > 0 {
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "invalid subscribe data")
+			return
+		}
+	}
+
+	// a channel that doesn't exist would get a hub and presence, and messages the archiver can't store
+	if errData := w.checkAccess(context.Background(), f.Channel, s.username); errData != nil {
+		w.writeFrame(s, FrameError, f.Channel, f.ID, errData)
+		return
+	}
+
+	if !w.subscribe(s, f.Channel, f.ID, data.After) {
+		w.sendError(s, f.Channel, f.ID, errCodeAlreadySubscribed, "already subscribed to this channel")
+	}
+}
+
+// subscribe adds the session to the channel, acks it when id is set and sends the channel history,
+// or only the messages after the given message id when the client already has the ones up to it
+func (w *Handler) subscribe(s *session, channel, id, after string) bool {
+	// only the reader of the session changes its subscriptions, nothing can subscribe it in between
+	if w.hubs.isSubscribed(channel, s) {
+		return false
+	}
+
+	// the history is fetched asynchronously, live messages must wait for it
+	s.startReplay(channel)
+
+	joined, ok := w.hubs.subscribe(channel, s)
+	if !ok {
+		s.cancelReplay(channel)
+		return false
+	}
+
+	if joined {
+		slog.Info("[user joined]", "channel", channel, "user", s.username)
+		if err := w.presence.Joined(channel, s.username); err != nil {
 			slog.Error(err.Error())
 		}
+	}
 
-		// stock bot, if it matches then we push the request to the queue
-		if okCheckStockCode, stockCode := checkBot(string(p)); okCheckStockCode {
-			stock, _ := json.Marshal(eventbus.BotCommandRequest{
-				Command: stockCode,
-				Channel: channelParam,
-				Time:    t,
-			})
-			err := w.eventbus.PublishBotCommandRequest(string(stock))
-			if err != nil {
-				slog.Error(err.Error())
-			}
+	if id != "" {
+		w.writeFrame(s, FrameAck, channel, id, nil)
+	}
+
+	w.writeFrame(s, FrameMembers, channel, "", MembersData{Members: w.presence.Members(channel)})
+
+	go w.sessionConnected(channel, s, after)
+
+	return true
+}
+
+func (w *Handler) handleUnsubscribe(s *session, f Frame) {
+	left, ok := w.hubs.unsubscribe(f.Channel, s)
+	if !ok {
+		w.sendError(s, f.Channel, f.ID, errCodeNotSubscribed, "not subscribed to this channel")
+		return
+	}
+	s.cancelReplay(f.Channel)
+
+	if left {
+		w.userLeft(f.Channel, s.username)
+	}
+
+	w.writeFrame(s, FrameAck, f.Channel, f.ID, nil)
+}
+
+// handleRead moves the read marker of the user in the channel and acks it
+func (w *Handler) handleRead(s *session, f Frame) {
+	if f.Channel == "" {
+		w.sendError(s, "", f.ID, errCodeMissingChannel, "read needs a channel")
+		return
+	}
+
+	var data ReadData
+	if len(f.Data) > 0 {
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "invalid read data")
+			return
 		}
+	}
 
+	err := w.readMarkers.MarkRead(context.Background(), s.username, f.Channel, data.At)
+	if errors.Is(err, readmarker.ErrChannelNotFound) {
+		w.sendError(s, f.Channel, f.ID, errCodeUnknownChannel, "channel not found")
+		return
 	}
+	if err != nil {
+		slog.Error(err.Error())
+		w.sendError(s, f.Channel, f.ID, errCodeInternal, "read marker could not be saved")
+		return
+	}
+
+	w.writeFrame(s, FrameAck, f.Channel, f.ID, nil)
 }
 
-type payload struct {
-	Username string
-	Msg      string
-	IsBot    bool
-	Time     time.Time
+// userLeft is called once the last session of a user in a channel is gone
+func (w *Handler) userLeft(channel, username string) {
+	slog.Info("[user left]", "channel", channel, "user", username)
+	if err := w.presence.Left(channel, username); err != nil {
+		slog.Error(err.Error())
+	}
 }
 
-func (w *Handler) BroadcastMessage(username, channel, msg string, isBoot bool, t time.Time) error {
-	channelUsers, okChannel := w.channelConnections.getChannelUsers(channel)
-	if !okChannel {
-		return errChannelNotFound
+// handleChatMessage publishes a chat message sent by the user and acks it
+func (w *Handler) handleChatMessage(s *session, f Frame) {
+	if f.Channel == "" {
+		w.sendError(s, "", f.ID, errCodeMissingChannel, "message needs a channel")
+		return
 	}
 
-	for _, userC := range channelUsers.users {
-		jsonBytes, err := json.Marshal(payload{
-			Username: username,
-			Msg:      msg,
-			IsBot:    isBoot,
-			Time:     t,
-		})
-		if err != nil {
-			return err
+	if !w.hubs.isSubscribed(f.Channel, s) {
+		w.sendError(s, f.Channel, f.ID, errCodeNotSubscribed, "subscribe to the channel before sending messages")
+		return
+	}
+
+	var data MessageData
+	if err := json.Unmarshal(f.Data, &data); err != nil {
+		w.sendError(s, f.Channel, f.ID, errCodeBadFrame, "invalid message data")
+		return
+	}
+
+	ack, errData := w.publishMessage(s.username, f.Channel, f.ID, data)
+	if errData != nil {
+		w.writeFrame(s, FrameError, f.Channel, f.ID, errData)
+		return
+	}
+
+	w.writeFrame(s, FrameAck, f.Channel, f.ID, ack)
+}
+
+// publishMessage validates the message of the user and publishes it to the channel, whatever transport it came from.
+// key is the idempotency key chosen by the client, without it every call is a new message.
+func (w *Handler) publishMessage(username, channel, key string, data MessageData) (AckData, *ErrorData) {
+	text, errData := normalizeText(data.Text, w.limits.maxMessageLength())
+	if errData != nil {
+		return AckData{}, errData
+	}
+
+	parentID := ""
+	if data.ParentID != "" {
+		if parentID, errData = w.threadRoot(username, channel, data.ParentID); errData != nil {
+			return AckData{}, errData
 		}
+	}
+
+	t := time.Now()
+
+	messageID := utils.NewID()
+	if key != "" {
+		messageID = messageIDFor(username, key)
 
-		err = userC.Write(context.Background(), websocket.MessageText, jsonBytes)
+		// a retry while the first attempt is in flight waits for it, so it is never acked for a message that failed
+		first, dup := w.received.claim(messageID, t)
+		if dup {
+			// a retry of a message that went through, ack it again without publishing it
+			return AckData{MessageID: messageID, Time: first}, nil
+		}
+	}
+
+	okCheckStockCode, stockCode := checkBot(text)
+	if errData := w.allowMessage(username, channel, okCheckStockCode); errData != nil {
+		w.received.forget(messageID) // it wasn't sent, the client can retry it later
+		return AckData{}, errData
+	}
+
+	j, err := json.Marshal(MessageObj{
+		messageID, username, channel, text, t, parentID,
+	})
+	if err != nil {
+		slog.Error("error serializing MessageObj", "err", err)
+		w.received.forget(messageID)
+		return AckData{}, &ErrorData{Code: errCodeInternal, Message: "message could not be sent"}
+	}
+
+	// send the payload to queue
+	err = w.eventbus.PublishUserMessageCommand(string(j))
+	if err != nil {
+		slog.Error(err.Error())
+		w.received.forget(messageID) // let the client retry
+		return AckData{}, &ErrorData{Code: errCodeInternal, Message: "message could not be sent"}
+	}
+	w.received.done(messageID)
+
+	// stock bot, if it matches then we push the request to the queue
+	if okCheckStockCode {
+		stock, _ := json.Marshal(eventbus.BotCommandRequest{
+			MessageID: messageID,
+			ParentID:  parentID,
+			Command:   stockCode,
+			Channel:   channel,
+			Time:      t,
+		})
+		err := w.eventbus.PublishBotCommandRequest(string(stock))
 		if err != nil {
-			slog.Error("error writing to user ws", err)
+			slog.Error(err.Error())
 		}
+	}
+
+	return AckData{MessageID: messageID, Time: t}, nil
+}
 
+// allowMessage checks the rate limits, a throttled client gets told when to retry. Edits, deletes and reactions take
+// from the same buckets as the messages. The limits fail open, chat keeps working when they can't be checked.
+func (w *Handler) allowMessage(username, channel string, botCommand bool) *ErrorData {
+	d, err := w.rateLimiter.AllowMessage(context.Background(), username, channel, botCommand)
+	if err != nil {
+		slog.Error("error checking rate limits", "user", username, "channel", channel, "err", err)
+		return nil
+	}
+	if d.Allowed {
+		return nil
 	}
 
-	return nil
+	return &ErrorData{
+		Code:         errCodeRateLimited,
+		Message:      "too many messages, slow down",
+		RetryAfterMs: d.RetryAfter.Milliseconds(),
+	}
+}
 
+// writeFrame encodes and queues a single frame to one session, failures are only logged
+func (w *Handler) writeFrame(s *session, t FrameType, channel, id string, data any) {
+	b, err := newFrame(t, channel, id, data)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	s.enqueue(b)
 }
 
-func (w *Handler) HandleChannelsUpdate(ctx context.Context, channels []string) error {
-	// update server channel connection map
-	for _, c := range channels {
-		if _, ok := w.channelConnections.getChannelUsers(c); !ok {
-			w.channelConnections.addChannel(c)
+func (w *Handler) sendError(s *session, channel, id, code, msg string) {
+	w.writeFrame(s, FrameError, channel, id, ErrorData{Code: code, Message: msg})
+}
+
+// BroadcastMessage sends the message to every session in the channel, a message id already broadcast is dropped.
+// parentID is set on replies to a thread. It returns once the hub of the channel has the message, not once
+// every session does.
+func (w *Handler) BroadcastMessage(id, parentID, username, channel, msg string, isBoot bool, t time.Time) error {
+	h, okChannel := w.hubs.get(channel)
+	if !okChannel {
+		return nil // nobody here is subscribed to the channel, e.g. a direct channel of users connected elsewhere
+	}
+
+	if id != "" {
+		if _, dup := w.broadcasted.seen(id, t); dup {
+			return nil
 		}
+	}
 
+	frame, err := newFrame(FrameMessage, channel, "", payload{
+		ID:       id,
+		ParentID: parentID,
+		Username: username,
+		Msg:      msg,
+		IsBot:    isBoot,
+		Time:     t,
+	})
+	if err != nil {
+		return err
 	}
 
-	// broadcast it to everyone connected in ws
-	for _, channeList := range w.channelConnections.channels {
-		for _, user := range channeList.users {
-			err := user.Write(ctx, websocket.MessageText, []byte("[channel_list_update]"))
-			if err != nil {
-				slog.Error("error writing [channel_list_update] to user", err)
-			}
+	h.send(hubFrame{b: frame, id: id, hold: true})
 
-		}
+	return nil
+
+}
+
+func (w *Handler) HandleChannelsUpdate(ctx context.Context, channels []string) error {
+	frame, err := newFrame(FrameChannelsUpdated, "", "", ChannelsUpdatedData{Channels: channels})
+	if err != nil {
+		return err
+	}
+
+	// broadcast it once to every connection, whatever it is subscribed to
+	for _, s := range w.hubs.allSessions() {
+		s.enqueue(frame)
 	}
 
 	return nil
@@ -256,8 +601,8 @@ func (w *Handler) PrintOnlineUsers() {
 	go func() {
 		for {
 			var args []any
-			for k, v := range w.channelConnections.channels {
-				args = append(args, k, v.users)
+			for k, v := range w.hubs.snapshot() {
+				args = append(args, k, v.sessionCount())
 			}
 			slog.Info("[online users]", args...)
 			time.Sleep(10 * time.Second)
@@ -266,44 +611,59 @@ func (w *Handler) PrintOnlineUsers() {
 
 }
 
-func (w *Handler) AddNewChannel(channel string) {
-	w.channelConnections.addChannel(channel)
+// LocalMembers returns the users connected to each channel on this instance
+func (w *Handler) LocalMembers() map[string][]string {
+	r := map[string][]string{}
+	for channel, h := range w.hubs.snapshot() {
+		for u := range h.sessionCount() {
+			r[channel] = append(r[channel], u)
+		}
+	}
+	return r
 }
 
-func (w *Handler) SendRecentMessages(channel, username string, msgs []user.Message) error {
-	channelUsers, okChannel := w.channelConnections.getChannelUsers(channel)
-	if !okChannel {
-		return errors.New("channel not found")
-	}
+// BroadcastPresence tells the sessions of each channel about the users that came online or went offline there
+func (w *Handler) BroadcastPresence(changes []presence.Change) {
+	for _, c := range changes {
+		h, ok := w.hubs.get(c.Channel)
+		if !ok {
+			continue
+		}
 
-	userC, ok := channelUsers.getUser(username)
-	if !ok {
-		return errors.New("user connection missing for broadcast recent messages")
-	}
+		frame, err := newFrame(FramePresence, c.Channel, "", PresenceData{Username: c.Username, Online: c.Online})
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
 
-	arr := make([]payload, len(msgs))
+		h.send(hubFrame{b: frame})
+	}
+}
 
-	for i, m := range msgs {
-		arr[i] = payload{
-			Username: m.User,
-			Msg:      m.Text,
-			IsBot:    false,
-			Time:     m.Timestamp,
+// NotifyDirectChannel tells the members of a new direct channel about it, on every session they have open wherever
+// they are. The members that aren't connected find it on their next listing.
+func (w *Handler) NotifyDirectChannel(ctx context.Context, e eventbus.DirectChannelEvent) error {
+	for i, member := range e.Members {
+		// the other member, the frame is for a two users conversation
+		with := e.Members[(i+1)%len(e.Members)]
+		err := w.SendToUser(ctx, member, "", FrameDirectOpened, DirectOpenedData{Channel: e.Channel, With: with})
+		if err != nil && !errors.Is(err, routing.ErrOffline) {
+			return err
 		}
 	}
 
-	marshal, err := json.Marshal(arr)
-	if err != nil {
-		return fmt.Errorf("error encoding array for recent messages: %w", err)
-	}
+	return nil
+}
 
-	err = userC.Write(context.Background(), websocket.MessageText, marshal)
+// SendRecentMessages sends the messages to every session the user has open in the channel, whatever instance they
+// are on
+func (w *Handler) SendRecentMessages(channel, username string, msgs []user.Message) error {
+	b, err := messagesFrame(FrameHistory, channel, msgs)
 	if err != nil {
-		return fmt.Errorf("ws: error writing recent messages to user : %w", err)
+		return err
 	}
 
-	return nil
-
+	return w.router.SendToUser(context.Background(), eventbus.UserDelivery{Username: username, Channel: channel, Frame: b})
 }
 
 func checkBot(msg string) (bool, string) {
@@ -318,33 +678,3 @@ func checkBot(msg string) (bool, string) {
 
 	return false, ""
 }
-
-func (w *Handler) UserConnected(channel, username string) {
-	// get recent messages using grpc
-	resp, err := w.archive.GetRecentMessages(context.Background(), &pb.GetRecentMessagesRequest{
-		Channel:     channel,
-		MaxMessages: 50,
-	})
-	if err != nil {
-		slog.Error("error sending recent messages", err)
-		return
-	}
-
-	// convert it back to our standard message object
-	r := make([]user.Message, len(resp.Messages))
-	for i := range resp.Messages {
-		item := resp.Messages[i]
-		r[i] = user.Message{
-			Channel:   item.Channel,
-			User:      item.User,
-			Text:      item.Text,
-			Timestamp: item.Timestamp.AsTime(),
-		}
-	}
-	// send it
-	err = w.SendRecentMessages(channel, username, r)
-	if err != nil {
-		slog.Error(err.Error())
-	}
-
-}
@@ -1,16 +1,33 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ap-pauloafonso/investor-chat/channel"
+	"github.com/ap-pauloafonso/investor-chat/eventbus"
+	"github.com/ap-pauloafonso/investor-chat/mention"
 	"github.com/ap-pauloafonso/investor-chat/pb"
+	"github.com/ap-pauloafonso/investor-chat/presence"
+	"github.com/ap-pauloafonso/investor-chat/ratelimit"
+	"github.com/ap-pauloafonso/investor-chat/readmarker"
+	"github.com/ap-pauloafonso/investor-chat/routing"
+	"github.com/ap-pauloafonso/investor-chat/user"
 	"github.com/labstack/echo/v4"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/http"
 	"net/http/httptest"
 	"nhooyr.io/websocket"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -41,6 +58,7 @@ func TestCheckBot(t *testing.T) {
 type MockArchiveService struct {
 	messages []*pb.Message
 	err      error
+	release  chan struct{} // when set, GetMessagesAfter waits for it
 }
 
 func (m *MockArchiveService) GetRecentMessages(_ context.Context, _ *pb.GetRecentMessagesRequest, _ ...grpc.CallOption) (*pb.GetRecentMessagesResponse, error) {
@@ -49,6 +67,41 @@ func (m *MockArchiveService) GetRecentMessages(_ context.Context, _ *pb.GetRecen
 	return &pb.GetRecentMessagesResponse{Messages: m.messages}, nil
 }
 
+func (m *MockArchiveService) GetMessage(_ context.Context, req *pb.GetMessageRequest, _ ...grpc.CallOption) (*pb.Message, error) {
+	for _, msg := range m.messages {
+		if msg.Id == req.Id {
+			return msg, nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "not found")
+}
+
+func (m *MockArchiveService) GetThread(_ context.Context, req *pb.GetThreadRequest, _ ...grpc.CallOption) (*pb.GetThreadResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not used by the websocket server")
+}
+
+func (m *MockArchiveService) GetMessagesBefore(_ context.Context, _ *pb.GetMessagesBeforeRequest, _ ...grpc.CallOption) (*pb.GetMessagesBeforeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not used by the websocket server")
+}
+
+func (m *MockArchiveService) GetMessagesAfter(_ context.Context, req *pb.GetMessagesAfterRequest, _ ...grpc.CallOption) (*pb.GetMessagesAfterResponse, error) {
+	if m.release != nil {
+		<-m.release
+	}
+
+	for i, msg := range m.messages {
+		if msg.Id != req.AfterId {
+			continue
+		}
+		r := m.messages[i+1:]
+		if len(r) > int(req.MaxMessages) {
+			return &pb.GetMessagesAfterResponse{Messages: r[:req.MaxMessages], Found: true, HasMore: true}, nil
+		}
+		return &pb.GetMessagesAfterResponse{Messages: r, Found: true}, nil
+	}
+	return &pb.GetMessagesAfterResponse{}, nil
+}
+
 func TestUserConnected(t *testing.T) {
 	archive := &MockArchiveService{
 		messages: []*pb.Message{{
@@ -67,7 +120,7 @@ func TestUserConnected(t *testing.T) {
 	}
 
 	// Create a new Handler for testing
-	wH := NewWebSocketHandler(nil, archive)
+	wH := newTestHandler(Deps{Archive: archive})
 
 	// Create an Echo instance
 	e := echo.New()
@@ -93,14 +146,15 @@ func TestUserConnected(t *testing.T) {
 		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
 	}
 
-	_, body, err := conn.Read(context.Background())
-	if err != nil {
-		return
+	f := readFrameOfType(t, conn, FrameHistory)
+
+	if f.Version != protocolVersion {
+		t.Fatalf("expected a v%d %s frame, got v%d %s", protocolVersion, FrameHistory, f.Version, f.Type)
 	}
 
 	var list []payload
 
-	err = json.Unmarshal(body, &list)
+	err = json.Unmarshal(f.Data, &list)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,3 +174,2360 @@ func TestUserConnected(t *testing.T) {
 	}
 
 }
+
+type mockEventbus struct {
+	sync.Mutex
+	messages    []string
+	botRequests []string
+	typing      []string
+	changes     []string
+	reactions   []string
+}
+
+func (m *mockEventbus) PublishUserMessageCommand(msg string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *mockEventbus) PublishBotCommandRequest(msg string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.botRequests = append(m.botRequests, msg)
+	return nil
+}
+
+func (m *mockEventbus) PublishMessageChangeCommand(msg string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.changes = append(m.changes, msg)
+	return nil
+}
+
+func (m *mockEventbus) PublishReactionCommand(msg string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.reactions = append(m.reactions, msg)
+	return nil
+}
+
+func (m *mockEventbus) PublishTypingEvent(msg string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.typing = append(m.typing, msg)
+	return nil
+}
+
+type mockPresence struct {
+	sync.Mutex
+	joined []string
+	left   []string
+}
+
+func (m *mockPresence) Joined(channel, username string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.joined = append(m.joined, channel+"/"+username)
+	return nil
+}
+
+func (m *mockPresence) Left(channel, username string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.left = append(m.left, channel+"/"+username)
+	return nil
+}
+
+func (m *mockPresence) Members(_ string) []string {
+	return []string{"paulo"}
+}
+
+// mockAccess lists the members of the private channels, the others are public
+// mockAccess lists the members of the private channels, a channel listed without members doesn't exist
+type mockAccess map[string][]string
+
+func (m mockAccess) CanAccess(_ context.Context, name, username string) (bool, error) {
+	members, private := m[name]
+	if !private {
+		return true, nil
+	}
+	if members == nil {
+		return false, channel.ErrChannelNotFound
+	}
+	for _, u := range members {
+		if u == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mockMentions hands over the pending summary of each user once
+type mockMentions struct {
+	pending map[string]mention.Summary
+	mu      sync.Mutex // for mutual exclusion while operating over pending
+}
+
+func (m *mockMentions) Pending(_ context.Context, username string) (mention.Summary, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	summary, ok := m.pending[username]
+	delete(m.pending, username)
+	return summary, ok, nil
+}
+
+// mockRateLimiter throttles the listed users, a "bot:" prefix only throttles their bot commands
+type mockRateLimiter map[string]time.Duration
+
+func (m mockRateLimiter) AllowMessage(_ context.Context, username, _ string, botCommand bool) (ratelimit.Decision, error) {
+	if retryAfter, ok := m[username]; ok {
+		return ratelimit.Decision{RetryAfter: retryAfter}, nil
+	}
+	if retryAfter, ok := m["bot:"+username]; ok && botCommand {
+		return ratelimit.Decision{RetryAfter: retryAfter}, nil
+	}
+	return ratelimit.Decision{Allowed: true}, nil
+}
+
+// newTestHandler builds a handler, the deps left nil are mocks that let everything through
+func newTestHandler(d Deps) *Handler {
+	if d.Eventbus == nil {
+		d.Eventbus = &mockEventbus{}
+	}
+	if d.Archive == nil {
+		d.Archive = &MockArchiveService{}
+	}
+	if d.Presence == nil {
+		d.Presence = &mockPresence{}
+	}
+	if d.ReadMarkers == nil {
+		d.ReadMarkers = &mockReadMarkers{}
+	}
+	if d.Moderators == nil {
+		d.Moderators = mockModerators{}
+	}
+	if d.Access == nil {
+		d.Access = mockAccess{}
+	}
+	if d.Mentions == nil {
+		d.Mentions = &mockMentions{}
+	}
+	if d.RateLimiter == nil {
+		d.RateLimiter = mockRateLimiter{}
+	}
+	if d.Router == nil {
+		d.Router = &mockRouter{}
+	}
+
+	return NewWebSocketHandler(d)
+}
+
+// mockCluster is the session registry and the per-instance queues of the instances living in a test
+type mockCluster struct {
+	sync.Mutex
+	instances map[string]*Handler
+	sessions  map[string][2]string    // session id -> username and instance
+	delivered []eventbus.UserDelivery // the deliveries a session got
+}
+
+func newMockCluster() *mockCluster {
+	return &mockCluster{instances: map[string]*Handler{}, sessions: map[string][2]string{}}
+}
+
+// mockRouter routes through the cluster, the zero value is an instance alone where nobody is reachable
+type mockRouter struct {
+	cluster  *mockCluster
+	instance string
+}
+
+func (m *mockRouter) Connected(_ context.Context, sessionID, username string) error {
+	if m.cluster == nil {
+		return nil
+	}
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	m.cluster.sessions[sessionID] = [2]string{username, m.instance}
+	return nil
+}
+
+func (m *mockRouter) Disconnected(_ context.Context, sessionID string) error {
+	if m.cluster == nil {
+		return nil
+	}
+	m.cluster.Lock()
+	defer m.cluster.Unlock()
+	delete(m.cluster.sessions, sessionID)
+	return nil
+}
+
+func (m *mockRouter) SendToUser(_ context.Context, d eventbus.UserDelivery) error {
+	if m.cluster == nil {
+		return routing.ErrOffline
+	}
+
+	m.cluster.Lock()
+	instances := map[string]*Handler{}
+	for _, s := range m.cluster.sessions {
+		if s[0] == d.Username {
+			instances[s[1]] = m.cluster.instances[s[1]]
+		}
+	}
+	m.cluster.Unlock()
+
+	if len(instances) == 0 {
+		return routing.ErrOffline
+	}
+	for _, h := range instances {
+		if h.DeliverToUser(d) {
+			m.cluster.Lock()
+			m.cluster.delivered = append(m.cluster.delivered, d)
+			m.cluster.Unlock()
+		}
+	}
+	return nil
+}
+
+// mockModerators lists the users that are moderators
+type mockModerators map[string]bool
+
+func (m mockModerators) IsModerator(_ context.Context, username string) (bool, error) {
+	return m[username], nil
+}
+
+type mockReadMarkers struct {
+	sync.Mutex
+	marked []string
+}
+
+func (m *mockReadMarkers) MarkRead(_ context.Context, username, channel string, _ time.Time) error {
+	if channel == "nope" {
+		return readmarker.ErrChannelNotFound
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.marked = append(m.marked, channel+"/"+username)
+	return nil
+}
+
+// readFrameOfType reads frames until one of the wanted type shows up
+func readFrameOfType(t *testing.T, conn *websocket.Conn, want FrameType) Frame {
+	t.Helper()
+	for {
+		if f := readFrame(t, conn); f.Type == want {
+			return f
+		}
+	}
+}
+
+// readFrame reads the next frame, whatever its type
+func readFrame(t *testing.T, conn *websocket.Conn) Frame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, body, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("error reading frame: %v", err)
+	}
+	var f Frame
+	if err := json.Unmarshal(body, &f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestHandleRequestFrames(t *testing.T) {
+	bus := &mockEventbus{}
+	wH := newTestHandler(Deps{Eventbus: bus})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	reqURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/channel1"
+	conn, _, err := websocket.Dial(context.Background(), reqURL, nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	t.Run("Chat Message Is Published And Acked", func(t *testing.T) {
+		err := conn.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"message","id":"c1","data":{"text":"/stock=aapl.us"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ack := readFrameOfType(t, conn, FrameAck)
+		if ack.ID != "c1" {
+			t.Errorf("expected ack for c1, got %q", ack.ID)
+		}
+
+		if len(bus.messages) != 1 {
+			t.Fatalf("expected 1 published message, got %d", len(bus.messages))
+		}
+		var obj MessageObj
+		if err := json.Unmarshal([]byte(bus.messages[0]), &obj); err != nil {
+			t.Fatal(err)
+		}
+		if obj.Message != "/stock=aapl.us" || obj.Channel != "channel1" || obj.Username != "paulo" {
+			t.Errorf("unexpected published message %+v", obj)
+		}
+		if len(bus.botRequests) != 1 {
+			t.Errorf("expected 1 bot request, got %d", len(bus.botRequests))
+		}
+	})
+
+	errorCases := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"Not Json", `hello`, errCodeBadFrame},
+		{"Unknown Type", `{"v":1,"type":"dance","id":"c2"}`, errCodeUnknownType},
+		{"Future Version", `{"v":99,"type":"message","id":"c3"}`, errCodeUnsupportedVersion},
+		{"Empty Message", `{"v":1,"type":"message","id":"c4","data":{"text":""}}`, errCodeEmptyMessage},
+		{"Blank Message", `{"v":1,"type":"message","id":"c5","data":{"text":" \n\t "}}`, errCodeEmptyMessage},
+		{"Long Message", `{"v":1,"type":"message","id":"c6","data":{"text":"` + strings.Repeat("a", defaultMaxMessageLength+1) + `"}}`, errCodeMessageTooLong},
+		{"Control Character", `{"v":1,"type":"message","id":"c7","data":{"text":"ding\u0007"}}`, errCodeInvalidText},
+		{"Blank Edit", `{"v":1,"type":"edit","id":"c8","data":{"messageId":"m1","text":"  "}}`, errCodeEmptyMessage},
+	}
+
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := conn.Write(context.Background(), websocket.MessageText, []byte(tc.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := readFrameOfType(t, conn, FrameError)
+			var data ErrorData
+			if err := json.Unmarshal(f.Data, &data); err != nil {
+				t.Fatal(err)
+			}
+			if data.Code != tc.code {
+				t.Errorf("expected error code %s, got %s", tc.code, data.Code)
+			}
+		})
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+		code string
+	}{
+		{"Trimmed", "  hello  \n", "hello", ""},
+		{"NFC", "cafe\u0301", "caf\u00e9", ""},
+		{"Line Breaks Kept", "one\r\ntwo\tthree", "one\ntwo\tthree", ""},
+		{"Emoji Sequences Kept", "\U0001F469\u200D\U0001F4BB", "\U0001F469\u200D\U0001F4BB", ""},
+		{"Empty", "\t\n ", "", errCodeEmptyMessage},
+		{"At The Limit", strings.Repeat("e\u0301", 20), strings.Repeat("é", 20), ""},
+		{"Over The Limit", strings.Repeat("é", 21), "", errCodeMessageTooLong},
+		{"Null", "a\x00b", "", errCodeInvalidText},
+		{"Escape", "\x1b[31mred", "", errCodeInvalidText},
+		{"Bidi Override", "invoice\u202Efdp.exe", "", errCodeInvalidText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errData := normalizeText(tt.text, 20)
+			if tt.code != "" {
+				if errData == nil || errData.Code != tt.code {
+					t.Errorf("expected %s, got %+v", tt.code, errData)
+				}
+				return
+			}
+			if errData != nil {
+				t.Fatalf("unexpected error %+v", errData)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	wH := newTestHandler(Deps{Limits: Limits{ReadLimit: 512}})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1", nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	frame := `{"v":1,"type":"message","id":"c1","data":{"text":"` + strings.Repeat("a", 1024) + `"}}`
+	if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if _, _, err = conn.Read(ctx); err != nil {
+			break
+		}
+	}
+	if code := websocket.CloseStatus(err); code != websocket.StatusMessageTooBig {
+		t.Errorf("expected the connection to be closed with %v, got %v", websocket.StatusMessageTooBig, err)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	wH := newTestHandler(Deps{OriginPatterns: []string{"app.example.com"}})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	testCases := []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		{"Same Origin", server.URL, true},
+		{"Allowed", "https://app.example.com", true},
+		// a page of another site opening the socket with the user's cookie
+		{"Cross Site", "https://evil.example.com", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &websocket.DialOptions{HTTPHeader: http.Header{"Origin": {tc.origin}}}
+			conn, res, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1", opts) //nolint
+			if !tc.allowed {
+				if err == nil {
+					conn.CloseNow() //nolint
+					t.Fatal("expected the connection to be refused")
+				}
+				if res == nil || res.StatusCode != http.StatusForbidden {
+					t.Errorf("expected %d, got %v", http.StatusForbidden, res)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+			}
+			defer conn.CloseNow() //nolint
+			readFrameOfType(t, conn, FrameHistory)
+		})
+	}
+}
+
+func TestHubs(t *testing.T) {
+	hubs := newHubRegistry()
+
+	desktop := &session{id: "s1", username: "paulo"}
+	laptop := &session{id: "s2", username: "paulo"}
+	hubs.addSession(desktop)
+	hubs.addSession(laptop)
+
+	if joined, _ := hubs.subscribe("channel1", desktop); !joined {
+		t.Error("expected the first session to join the user to the channel")
+	}
+	if joined, _ := hubs.subscribe("channel1", laptop); joined {
+		t.Error("expected the second session not to join the user again")
+	}
+	if _, ok := hubs.subscribe("channel1", laptop); ok {
+		t.Error("expected subscribing twice to be rejected")
+	}
+
+	h, _ := hubs.get("channel1")
+	if n := len(h.sessions("paulo")); n != 2 {
+		t.Fatalf("expected 2 sessions, got %d", n)
+	}
+
+	if left := hubs.unsubscribeAll(desktop); len(left) != 0 {
+		t.Error("expected the user to stay in the channel while a session is still open")
+	}
+	hubs.removeSession(desktop)
+	if left, _ := hubs.unsubscribe("channel1", laptop); !left {
+		t.Error("expected the user to leave the channel once the last session unsubscribed")
+	}
+	if n := len(h.sessions("")); n != 0 {
+		t.Errorf("expected no sessions left in the channel, got %d", n)
+	}
+	if n := len(hubs.allSessions()); n != 1 {
+		t.Errorf("expected the laptop session to still be open, got %d sessions", n)
+	}
+
+	t.Run("Stopped When Empty", func(t *testing.T) {
+		// the last session left channel1, its hub is gone and whatever still holds it doesn't block
+		if _, ok := hubs.get("channel1"); ok {
+			t.Error("expected the hub of channel1 to be stopped")
+		}
+		select {
+		case <-h.stopped:
+		default:
+			t.Fatal("expected the hub goroutine to be stopped")
+		}
+		h.send(hubFrame{b: []byte("{}")})
+		<-h.flush()
+		if n := len(h.sessionCount()); n != 0 {
+			t.Errorf("expected no sessions in a stopped hub, got %d", n)
+		}
+
+		// subscribing again starts a new one
+		if joined, _ := hubs.subscribe("channel1", laptop); !joined {
+			t.Error("expected the session to join the channel again")
+		}
+		if h2, ok := hubs.get("channel1"); !ok || h2 == h {
+			t.Error("expected a new hub for channel1")
+		}
+		hubs.unsubscribeAll(laptop)
+		if n := len(hubs.snapshot()); n != 0 {
+			t.Errorf("expected no hubs left, got %d", n)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				s := newSession(fmt.Sprintf("user%d", i%5), discardTransport{})
+				defer s.stop()
+				hubs.addSession(s)
+				for j := 0; j < 50; j++ {
+					channel := fmt.Sprintf("channel%d", j%3)
+					hubs.subscribe(channel, s)
+					if h, ok := hubs.get(channel); ok {
+						h.send(hubFrame{b: []byte("{}"), hold: j%2 == 0})
+						h.sessionCount()
+					}
+					hubs.unsubscribe(channel, s)
+				}
+				hubs.unsubscribeAll(s)
+				hubs.removeSession(s)
+			}(i)
+		}
+		wg.Wait()
+		hubs.flush()
+
+		for channel, h := range hubs.snapshot() {
+			if n := len(h.sessions("")); n != 0 {
+				t.Errorf("expected %s to be empty, got %d sessions", channel, n)
+			}
+		}
+	})
+}
+
+// discardTransport is a connection that takes every frame and goes nowhere
+type discardTransport struct{}
+
+func (discardTransport) write(context.Context, []byte) error      { return nil }
+func (discardTransport) close(websocket.StatusCode, string) error { return nil }
+func (discardTransport) closeNow() error                          { return nil }
+
+// countingTransport is a connection that takes every frame and counts it done in wg
+type countingTransport struct {
+	wg *sync.WaitGroup
+}
+
+func (c countingTransport) write(context.Context, []byte) error    { c.wg.Done(); return nil }
+func (countingTransport) close(websocket.StatusCode, string) error { return nil }
+func (countingTransport) closeNow() error                          { return nil }
+
+// BenchmarkBroadcast fans a message out to rooms of growing size, each op returns once every session wrote it
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{10, 1000, 5000} {
+		b.Run(fmt.Sprintf("%d sessions", n), func(b *testing.B) {
+			wH := newTestHandler(Deps{})
+			var written sync.WaitGroup
+			for i := 0; i < n; i++ {
+				s := newSession(fmt.Sprintf("user%d", i), countingTransport{&written})
+				defer s.stop()
+				wH.hubs.addSession(s)
+				wH.hubs.subscribe("general", s)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				written.Add(n)
+				if err := wH.BroadcastMessage(strconv.Itoa(i), "", "ana", "general", "hello", false, time.Now()); err != nil {
+					b.Fatal(err)
+				}
+				written.Wait()
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastChannels broadcasts to many rooms at once, they don't share anything on the way to the sessions
+func BenchmarkBroadcastChannels(b *testing.B) {
+	const channels, perChannel = 100, 100
+
+	wH := newTestHandler(Deps{})
+	written := make([]sync.WaitGroup, channels)
+	for c := 0; c < channels; c++ {
+		for i := 0; i < perChannel; i++ {
+			s := newSession(fmt.Sprintf("user%d", i), countingTransport{&written[c]})
+			defer s.stop()
+			wH.hubs.addSession(s)
+			wH.hubs.subscribe(fmt.Sprintf("channel%d", c), s)
+		}
+	}
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := int(next.Add(1) % channels)
+		channel := fmt.Sprintf("channel%d", c)
+		for pb.Next() {
+			written[c].Add(perChannel)
+			if err := wH.BroadcastMessage("", "", "ana", channel, "hello", false, time.Now()); err != nil {
+				b.Error(err)
+				return
+			}
+			written[c].Wait()
+		}
+	})
+}
+
+func TestBroadcastReachesEverySession(t *testing.T) {
+	wH := newTestHandler(Deps{})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	reqURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/channel1"
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.Dial(context.Background(), reqURL, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		// wait until the session is registered
+		readFrameOfType(t, conn, FrameHistory)
+		conns = append(conns, conn)
+	}
+
+	err := wH.BroadcastMessage("", "", "other", "channel1", "hello", false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, conn := range conns {
+		f := readFrameOfType(t, conn, FrameMessage)
+		var p payload
+		if err := json.Unmarshal(f.Data, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Msg != "hello" {
+			t.Errorf("session %d: expected hello, got %s", i, p.Msg)
+		}
+	}
+}
+
+func TestMultiplexedConnection(t *testing.T) {
+	bus := &mockEventbus{}
+	wH := newTestHandler(Deps{Eventbus: bus, Access: mockAccess{"nowhere": nil}})
+
+	e := echo.New()
+	e.GET("/ws", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleMultiplexRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	reqURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.Dial(context.Background(), reqURL, nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	send := func(frame string) {
+		t.Helper()
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, channel := range []string{"stocks", "crypto"} {
+		send(`{"v":1,"type":"subscribe","id":"sub-` + channel + `","channel":"` + channel + `"}`)
+		if ack := readFrameOfType(t, conn, FrameAck); ack.Channel != channel {
+			t.Fatalf("expected subscribe ack for %s, got %s", channel, ack.Channel)
+		}
+		if h := readFrameOfType(t, conn, FrameHistory); h.Channel != channel {
+			t.Fatalf("expected history for %s, got %s", channel, h.Channel)
+		}
+	}
+
+	for _, channel := range []string{"stocks", "crypto"} {
+		if err := wH.BroadcastMessage("", "", "other", channel, "hi "+channel, false, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if f := readFrameOfType(t, conn, FrameMessage); f.Channel != channel {
+			t.Errorf("expected message tagged with %s, got %s", channel, f.Channel)
+		}
+	}
+
+	send(`{"v":1,"type":"unsubscribe","id":"u1","channel":"crypto"}`)
+	readFrameOfType(t, conn, FrameAck)
+
+	send(`{"v":1,"type":"message","id":"m1","channel":"crypto","data":{"text":"hello"}}`)
+	f := readFrameOfType(t, conn, FrameError)
+	var data ErrorData
+	if err := json.Unmarshal(f.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Code != errCodeNotSubscribed {
+		t.Errorf("expected %s, got %s", errCodeNotSubscribed, data.Code)
+	}
+
+	send(`{"v":1,"type":"message","id":"m2","channel":"stocks","data":{"text":"hello"}}`)
+	if ack := readFrameOfType(t, conn, FrameAck); ack.ID != "m2" {
+		t.Errorf("expected ack for m2, got %s", ack.ID)
+	}
+	if len(bus.messages) != 1 {
+		t.Errorf("expected 1 published message, got %d", len(bus.messages))
+	}
+
+	send(`{"v":1,"type":"subscribe","id":"s3","channel":"nowhere"}`)
+	f = readFrameOfType(t, conn, FrameError)
+	if err := json.Unmarshal(f.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Code != errCodeUnknownChannel {
+		t.Errorf("expected %s, got %s", errCodeUnknownChannel, data.Code)
+	}
+	if _, ok := wH.hubs.get("nowhere"); ok {
+		t.Error("expected no hub for a channel that doesn't exist")
+	}
+
+	if err := wH.HandleChannelsUpdate(context.Background(), []string{"stocks", "crypto", "bonds"}); err != nil {
+		t.Fatal(err)
+	}
+	readFrameOfType(t, conn, FrameChannelsUpdated)
+	if _, ok := wH.hubs.get("bonds"); ok {
+		t.Error("expected no hub for a channel nobody subscribed to")
+	}
+}
+
+func TestSlowConsumerIsEvicted(t *testing.T) {
+	accepted := make(chan *websocket.Conn)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+		// keep reading so the close handshake can complete
+		_, _, _ = conn.Read(context.Background())
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), nil) //nolint
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseNow() //nolint
+
+	// no writer goroutine, so the queue is never drained
+	s := &session{id: "s1", username: "paulo", conn: wsTransport{<-accepted}, send: make(chan []byte, 1), done: make(chan struct{})}
+
+	evictionsBefore := slowConsumerEvictions.Value()
+
+	if !s.enqueue([]byte("1")) {
+		t.Fatal("expected the first frame to be queued")
+	}
+	if s.enqueue([]byte("2")) {
+		t.Fatal("expected the frame that doesn't fit to be rejected")
+	}
+	if s.enqueue([]byte("3")) {
+		t.Fatal("expected nothing to be queued after the eviction")
+	}
+
+	if n := slowConsumerEvictions.Value() - evictionsBefore; n != 1 {
+		t.Errorf("expected 1 eviction, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = client.Read(ctx)
+	if status := websocket.CloseStatus(err); status != statusSlowConsumer {
+		t.Errorf("expected close status %d, got %d (%v)", statusSlowConsumer, status, err)
+	}
+}
+
+func TestPresenceFrames(t *testing.T) {
+	p := &mockPresence{}
+	wH := newTestHandler(Deps{Presence: p})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1", nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	f := readFrameOfType(t, conn, FrameMembers)
+	var members MembersData
+	if err := json.Unmarshal(f.Data, &members); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members.Members, []string{"paulo"}) {
+		t.Errorf("unexpected members %v", members.Members)
+	}
+
+	p.Lock()
+	if !reflect.DeepEqual(p.joined, []string{"channel1/paulo"}) {
+		t.Errorf("expected the join to be announced, got %v", p.joined)
+	}
+	p.Unlock()
+
+	if got := wH.LocalMembers(); !reflect.DeepEqual(got, map[string][]string{"channel1": {"paulo"}}) {
+		t.Errorf("unexpected local members %v", got)
+	}
+
+	wH.BroadcastPresence([]presence.Change{{Channel: "channel1", Username: "ana", Online: true}})
+
+	f = readFrameOfType(t, conn, FramePresence)
+	var data PresenceData
+	if err := json.Unmarshal(f.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if f.Channel != "channel1" || data.Username != "ana" || !data.Online {
+		t.Errorf("unexpected presence frame %s %+v", f.Channel, data)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	now := time.Now()
+	th := newThrottle(2 * time.Second)
+	th.now = func() time.Time { return now }
+
+	if !th.allow("paulo") {
+		t.Fatal("expected the first event to go through")
+	}
+	if th.allow("paulo") {
+		t.Error("expected the second event to be throttled")
+	}
+	if !th.allow("ana") {
+		t.Error("expected other keys not to be throttled")
+	}
+
+	now = now.Add(2 * time.Second)
+	if !th.allow("paulo") {
+		t.Error("expected the event to go through once the interval passed")
+	}
+}
+
+func TestTypingFrames(t *testing.T) {
+	bus := &mockEventbus{}
+	wH := newTestHandler(Deps{Eventbus: bus})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", c.QueryParam("user"))
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	dial := func(user string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1?user="+user, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		readFrameOfType(t, conn, FrameHistory)
+		return conn
+	}
+
+	paulo := dial("paulo")
+	defer paulo.CloseNow() //nolint
+	ana := dial("ana")
+	defer ana.CloseNow() //nolint
+
+	for i := 0; i < 3; i++ {
+		if err := paulo.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"typing"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// typing frames aren't acked, a message frame right after tells when the typing ones were handled
+	if err := paulo.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"message","id":"m1","data":{"text":"hi"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	readFrameOfType(t, paulo, FrameAck)
+
+	bus.Lock()
+	published := bus.typing
+	bus.Unlock()
+	if len(published) != 1 {
+		t.Fatalf("expected the burst to be throttled to 1 event, got %d", len(published))
+	}
+
+	var event eventbus.TypingEvent
+	if err := json.Unmarshal([]byte(published[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if err := wH.BroadcastTyping(event); err != nil {
+		t.Fatal(err)
+	}
+
+	f := readFrameOfType(t, ana, FrameTyping)
+	var data TypingData
+	if err := json.Unmarshal(f.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if f.Channel != "channel1" || data.Username != "paulo" || !data.ExpiresAt.After(time.Now()) {
+		t.Errorf("unexpected typing frame %s %+v", f.Channel, data)
+	}
+
+	// stale events are dropped instead of showing an indicator that is already expired
+	event.Time = time.Now().Add(-time.Minute)
+	if err := wH.BroadcastTyping(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFrames(t *testing.T) {
+	markers := &mockReadMarkers{}
+	wH := newTestHandler(Deps{ReadMarkers: markers})
+
+	e := echo.New()
+	e.GET("/ws", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleMultiplexRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	send := func(frame string) {
+		t.Helper()
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(`{"v":1,"type":"read","id":"r1","channel":"stocks","data":{"at":"2023-10-01T10:00:00Z"}}`)
+	if ack := readFrameOfType(t, conn, FrameAck); ack.ID != "r1" {
+		t.Errorf("expected ack for r1, got %s", ack.ID)
+	}
+
+	send(`{"v":1,"type":"read","id":"r2","channel":"nope"}`)
+	f := readFrameOfType(t, conn, FrameError)
+	var data ErrorData
+	if err := json.Unmarshal(f.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != "r2" || data.Code != errCodeUnknownChannel {
+		t.Errorf("expected %s for r2, got %s for %s", errCodeUnknownChannel, data.Code, f.ID)
+	}
+
+	markers.Lock()
+	defer markers.Unlock()
+	if !reflect.DeepEqual(markers.marked, []string{"stocks/paulo"}) {
+		t.Errorf("unexpected read markers %v", markers.marked)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	p := &mockPresence{}
+	wH := newTestHandler(Deps{Presence: p, KeepAlive: KeepAlive{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  50 * time.Millisecond,
+		IdleTimeout:  200 * time.Millisecond,
+	}})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	reqURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/channel1"
+
+	waitForNoSessions := func(t *testing.T) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(wH.hubs.allSessions()) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the session to be reaped")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("Unanswered Ping", func(t *testing.T) {
+		reapedBefore := reapedConnections.Value()
+
+		// a client that never reads never answers the pings either, like a half-open connection
+		conn, _, err := websocket.Dial(context.Background(), reqURL, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		waitForNoSessions(t)
+
+		// the failed ping drops the connection before the reaper gets to count it
+		deadline := time.Now().Add(5 * time.Second)
+		for reapedConnections.Value() == reapedBefore && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := reapedConnections.Value() - reapedBefore; n != 1 {
+			t.Errorf("expected 1 reaped connection, got %d", n)
+		}
+
+		p.Lock()
+		defer p.Unlock()
+		if !reflect.DeepEqual(p.left, []string{"channel1/paulo"}) {
+			t.Errorf("expected the user to leave the channel, got %v", p.left)
+		}
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		conn, _, err := websocket.Dial(context.Background(), reqURL, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		// reading answers the pings, but the client never sends anything
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			_, _, err = conn.Read(ctx)
+			if err != nil {
+				break
+			}
+		}
+
+		if status := websocket.CloseStatus(err); status != statusReconnect {
+			t.Errorf("expected close status %d, got %d (%v)", statusReconnect, status, err)
+		}
+
+		waitForNoSessions(t)
+	})
+}
+
+func TestIdempotentMessages(t *testing.T) {
+	bus := &mockEventbus{}
+	wH := newTestHandler(Deps{Eventbus: bus})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1", nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+	readFrameOfType(t, conn, FrameHistory)
+
+	var acks []AckData
+	for i := 0; i < 2; i++ {
+		// the same frame id, like a client resending after a flaky network
+		err := conn.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"message","id":"k1","data":{"text":"hello"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, conn, FrameAck)
+		var ack AckData
+		if err := json.Unmarshal(f.Data, &ack); err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}
+
+	if acks[0].MessageID == "" || acks[0].MessageID != acks[1].MessageID || !acks[0].Time.Equal(acks[1].Time) {
+		t.Errorf("expected the retry to get the same ack, got %+v and %+v", acks[0], acks[1])
+	}
+
+	bus.Lock()
+	published := bus.messages
+	bus.Unlock()
+	if len(published) != 1 {
+		t.Fatalf("expected the message to be published once, got %d", len(published))
+	}
+
+	var obj MessageObj
+	if err := json.Unmarshal([]byte(published[0]), &obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.ID != acks[0].MessageID {
+		t.Errorf("expected the published message to carry %s, got %s", acks[0].MessageID, obj.ID)
+	}
+
+	// a copy coming back through the eventbus (e.g. the retry landed on another instance) is broadcast once
+	for i := 0; i < 2; i++ {
+		if err := wH.BroadcastMessage(obj.ID, obj.ParentID, obj.Username, obj.Channel, obj.Message, false, obj.Time); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wH.BroadcastMessage("", "", "other", "channel1", "last", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []string
+	for len(received) == 0 || received[len(received)-1] != "last" {
+		f := readFrameOfType(t, conn, FrameMessage)
+		var p payload
+		if err := json.Unmarshal(f.Data, &p); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, p.Msg)
+	}
+	if !reflect.DeepEqual(received, []string{"hello", "last"}) {
+		t.Errorf("expected the duplicate to be dropped, got %v", received)
+	}
+}
+
+func TestIdempotencyKeyInFlight(t *testing.T) {
+	d := newDedupCache(time.Minute)
+	at := time.Now()
+	if _, dup := d.claim("m1", at); dup {
+		t.Fatal("expected the first attempt to get the id")
+	}
+
+	retried := make(chan bool)
+	go func() {
+		_, dup := d.claim("m1", at.Add(time.Second))
+		retried <- dup
+	}()
+
+	select {
+	case <-retried:
+		t.Fatal("expected the retry to wait for the first attempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the first attempt failed, the retry is sent instead of being acked
+	d.forget("m1")
+	if <-retried {
+		t.Fatal("expected the retry to get the id")
+	}
+
+	d.done("m1")
+	first, dup := d.claim("m1", at)
+	if !dup || !first.Equal(at.Add(time.Second)) {
+		t.Errorf("expected a dup of the retry, got %v %v", dup, first)
+	}
+}
+
+func TestResume(t *testing.T) {
+	archived := func(ids ...string) []*pb.Message {
+		var r []*pb.Message
+		for _, id := range ids {
+			r = append(r, &pb.Message{Id: id, Channel: "channel1", User: "other", Text: "text " + id, Timestamp: timestamppb.Now()})
+		}
+		return r
+	}
+
+	ids := func(t *testing.T, f Frame) []string {
+		t.Helper()
+		var arr []payload
+		if err := json.Unmarshal(f.Data, &arr); err != nil {
+			t.Fatal(err)
+		}
+		var r []string
+		for _, p := range arr {
+			r = append(r, p.ID)
+		}
+		return r
+	}
+
+	serve := func(archive *MockArchiveService) (*Handler, string, func()) {
+		wH := newTestHandler(Deps{Archive: archive})
+		e := echo.New()
+		e.GET("/ws/:channel", func(c echo.Context) error {
+			c.Set("username", "paulo")
+			return wH.HandleRequest(c)
+		})
+		server := httptest.NewServer(e)
+		return wH, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/channel1", server.Close
+	}
+
+	t.Run("Replays Only The Gap", func(t *testing.T) {
+		_, reqURL, stop := serve(&MockArchiveService{messages: archived("m1", "m2", "m3")})
+		defer stop()
+
+		conn, _, err := websocket.Dial(context.Background(), reqURL+"?after=m1", nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		f := readFrameOfType(t, conn, FrameReplay)
+		if got := ids(t, f); !reflect.DeepEqual(got, []string{"m2", "m3"}) {
+			t.Errorf("expected m2 and m3 to be replayed, got %v", got)
+		}
+	})
+
+	t.Run("Unknown Position Falls Back To History", func(t *testing.T) {
+		_, reqURL, stop := serve(&MockArchiveService{messages: archived("m1", "m2")})
+		defer stop()
+
+		conn, _, err := websocket.Dial(context.Background(), reqURL+"?after=gone", nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		f := readFrameOfType(t, conn, FrameHistory)
+		if got := ids(t, f); !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+			t.Errorf("expected the whole history, got %v", got)
+		}
+	})
+
+	t.Run("Live Messages Wait For The Replay", func(t *testing.T) {
+		archive := &MockArchiveService{messages: archived("m1", "m2", "m3"), release: make(chan struct{})}
+		wH, reqURL, stop := serve(archive)
+		defer stop()
+
+		conn, _, err := websocket.Dial(context.Background(), reqURL+"?after=m1", nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		// the members frame is sent once the session is subscribed, while the replay is still being fetched
+		readFrameOfType(t, conn, FrameMembers)
+
+		// m3 is already archived and will be in the replay, m4 isn't
+		for _, id := range []string{"m3", "m4"} {
+			if err := wH.BroadcastMessage(id, "", "other", "channel1", "text "+id, false, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(archive.release)
+
+		f := readFrameOfType(t, conn, FrameReplay)
+		if got := ids(t, f); !reflect.DeepEqual(got, []string{"m2", "m3"}) {
+			t.Errorf("expected m2 and m3 to be replayed, got %v", got)
+		}
+
+		f = readFrameOfType(t, conn, FrameMessage)
+		var p payload
+		if err := json.Unmarshal(f.Data, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.ID != "m4" {
+			t.Errorf("expected m4 right after the replay, got %s", p.ID)
+		}
+	})
+}
+
+func TestEditAndDelete(t *testing.T) {
+	bus := &mockEventbus{}
+	archive := &MockArchiveService{messages: []*pb.Message{
+		{Id: "m1", Channel: "channel1", User: "paulo", Text: "AAPL at 100", Timestamp: timestamppb.Now()},
+		{Id: "m2", Channel: "channel1", User: "ana", Text: "hi", Timestamp: timestamppb.Now()},
+		{Id: "m3", Channel: "channel1", User: "paulo", Deleted: true, Timestamp: timestamppb.Now()},
+	}}
+	wH := newTestHandler(Deps{Eventbus: bus, Archive: archive, Moderators: mockModerators{"mod": true}})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", c.QueryParam("user"))
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	dial := func(user string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1?user="+user, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		readFrameOfType(t, conn, FrameHistory)
+		return conn
+	}
+
+	paulo := dial("paulo")
+	defer paulo.CloseNow() //nolint
+	mod := dial("mod")
+	defer mod.CloseNow() //nolint
+
+	send := func(conn *websocket.Conn, frame string) Frame {
+		t.Helper()
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			f := readFrame(t, conn)
+			if f.Type == FrameAck || f.Type == FrameError {
+				return f
+			}
+		}
+	}
+
+	errorCode := func(f Frame) string {
+		t.Helper()
+		if f.Type != FrameError {
+			return ""
+		}
+		var data ErrorData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		return data.Code
+	}
+
+	t.Run("Author Edits", func(t *testing.T) {
+		f := send(paulo, `{"v":1,"type":"edit","id":"e1","data":{"messageId":"m1","text":"AAPL at 190"}}`)
+		if f.Type != FrameAck {
+			t.Fatalf("expected an ack, got %s", errorCode(f))
+		}
+	})
+
+	t.Run("Others Can't", func(t *testing.T) {
+		f := send(paulo, `{"v":1,"type":"delete","id":"d1","data":{"messageId":"m2"}}`)
+		if code := errorCode(f); code != errCodeForbidden {
+			t.Errorf("expected %s, got %q", errCodeForbidden, code)
+		}
+	})
+
+	t.Run("Moderator Deletes", func(t *testing.T) {
+		f := send(mod, `{"v":1,"type":"delete","id":"d2","data":{"messageId":"m2"}}`)
+		if f.Type != FrameAck {
+			t.Fatalf("expected an ack, got %s", errorCode(f))
+		}
+	})
+
+	t.Run("Unknown Or Deleted Message", func(t *testing.T) {
+		for _, id := range []string{"nope", "m3"} {
+			f := send(paulo, `{"v":1,"type":"edit","id":"e2","data":{"messageId":"`+id+`","text":"x"}}`)
+			if code := errorCode(f); code != errCodeUnknownMessage {
+				t.Errorf("%s: expected %s, got %q", id, errCodeUnknownMessage, code)
+			}
+		}
+	})
+
+	t.Run("Changes Are Broadcast", func(t *testing.T) {
+		bus.Lock()
+		changes := bus.changes
+		bus.Unlock()
+		if len(changes) != 2 {
+			t.Fatalf("expected 2 published changes, got %d", len(changes))
+		}
+
+		for _, c := range changes {
+			var change eventbus.MessageChangeCommand
+			if err := json.Unmarshal([]byte(c), &change); err != nil {
+				t.Fatal(err)
+			}
+			if err := wH.BroadcastMessageChange(change); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f := readFrameOfType(t, paulo, FrameMessageEdited)
+		var edited MessageEditedData
+		if err := json.Unmarshal(f.Data, &edited); err != nil {
+			t.Fatal(err)
+		}
+		if edited.ID != "m1" || edited.Text != "AAPL at 190" || edited.EditedBy != "paulo" {
+			t.Errorf("unexpected edit %+v", edited)
+		}
+
+		f = readFrameOfType(t, paulo, FrameMessageDeleted)
+		var deleted MessageDeletedData
+		if err := json.Unmarshal(f.Data, &deleted); err != nil {
+			t.Fatal(err)
+		}
+		if deleted.ID != "m2" || deleted.DeletedBy != "mod" {
+			t.Errorf("unexpected delete %+v", deleted)
+		}
+	})
+}
+
+func TestReactions(t *testing.T) {
+	bus := &mockEventbus{}
+	archive := &MockArchiveService{messages: []*pb.Message{
+		{Id: "m1", Channel: "channel1", User: "ana", Text: "NVDA earnings beat", Timestamp: timestamppb.Now(),
+			Reactions: []*pb.Reaction{{Emoji: "📉", Count: 1}}},
+		{Id: "m2", Channel: "channel1", User: "ana", Deleted: true, Timestamp: timestamppb.Now()},
+	}}
+	wH := newTestHandler(Deps{Eventbus: bus, Archive: archive})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1", nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	t.Run("History Has Totals", func(t *testing.T) {
+		f := readFrameOfType(t, conn, FrameHistory)
+		var history []payload
+		if err := json.Unmarshal(f.Data, &history); err != nil {
+			t.Fatal(err)
+		}
+		if len(history) == 0 || len(history[0].Reactions) != 1 || history[0].Reactions[0].Count != 1 {
+			t.Errorf("expected the reaction totals in the history, got %+v", history)
+		}
+	})
+
+	send := func(frame string) Frame {
+		t.Helper()
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			f := readFrame(t, conn)
+			if f.Type == FrameAck || f.Type == FrameError {
+				return f
+			}
+		}
+	}
+
+	t.Run("Rejected", func(t *testing.T) {
+		for _, frame := range []string{
+			`{"v":1,"type":"react","id":"r1","data":{"messageId":"m1","emoji":"lol"}}`,
+			`{"v":1,"type":"react","id":"r2","data":{"messageId":"m1","emoji":""}}`,
+			`{"v":1,"type":"react","id":"r3","data":{"messageId":"m2","emoji":"👍"}}`,
+			`{"v":1,"type":"react","id":"r4","data":{"messageId":"nope","emoji":"👍"}}`,
+		} {
+			if f := send(frame); f.Type != FrameError {
+				t.Errorf("expected an error for %s", frame)
+			}
+		}
+	})
+
+	t.Run("Toggle Is Published", func(t *testing.T) {
+		if f := send(`{"v":1,"type":"react","id":"r5","data":{"messageId":"m1","emoji":"👍🏽"}}`); f.Type != FrameAck {
+			t.Fatalf("expected an ack, got %s", f.Type)
+		}
+
+		bus.Lock()
+		reactions := bus.reactions
+		bus.Unlock()
+		if len(reactions) != 1 {
+			t.Fatalf("expected 1 published reaction, got %d", len(reactions))
+		}
+
+		var cmd eventbus.ReactionCommand
+		if err := json.Unmarshal([]byte(reactions[0]), &cmd); err != nil {
+			t.Fatal(err)
+		}
+		if cmd.MessageID != "m1" || cmd.Channel != "channel1" || cmd.Username != "paulo" || cmd.Emoji != "👍🏽" {
+			t.Errorf("unexpected command %+v", cmd)
+		}
+	})
+
+	t.Run("Broadcast", func(t *testing.T) {
+		err := wH.BroadcastReaction(eventbus.ReactionEvent{MessageID: "m1", Channel: "channel1", Emoji: "👍🏽", Username: "paulo", Added: true, Count: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, conn, FrameReaction)
+		var data ReactionData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.MessageID != "m1" || !data.Added || data.Count != 1 {
+			t.Errorf("unexpected reaction %+v", data)
+		}
+	})
+}
+
+func TestThreadReplies(t *testing.T) {
+	bus := &mockEventbus{}
+	archive := &MockArchiveService{messages: []*pb.Message{
+		{Id: "root", Channel: "channel1", User: "ana", Text: "AAPL?", Timestamp: timestamppb.Now(), ReplyCount: 1},
+		{Id: "reply", ParentId: "root", Channel: "channel1", User: "ana", Text: "buy", Timestamp: timestamppb.Now()},
+		{Id: "elsewhere", Channel: "channel2", User: "ana", Text: "hi", Timestamp: timestamppb.Now()},
+	}}
+	wH := newTestHandler(Deps{Eventbus: bus, Archive: archive})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", "paulo")
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+"/ws/channel1", nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+	readFrameOfType(t, conn, FrameHistory)
+
+	send := func(frame string) Frame {
+		t.Helper()
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			f := readFrame(t, conn)
+			if f.Type == FrameAck || f.Type == FrameError {
+				return f
+			}
+		}
+	}
+
+	t.Run("Replies Go To The Root", func(t *testing.T) {
+		for i, parent := range []string{"root", "reply"} {
+			f := send(`{"v":1,"type":"message","id":"t` + strconv.Itoa(i) + `","data":{"text":"sell","parentId":"` + parent + `"}}`)
+			if f.Type != FrameAck {
+				t.Fatalf("expected an ack, got %s", f.Type)
+			}
+		}
+
+		bus.Lock()
+		messages := bus.messages
+		bus.Unlock()
+		for _, m := range messages {
+			var obj MessageObj
+			if err := json.Unmarshal([]byte(m), &obj); err != nil {
+				t.Fatal(err)
+			}
+			if obj.ParentID != "root" {
+				t.Errorf("expected the reply in the root thread, got %q", obj.ParentID)
+			}
+		}
+	})
+
+	t.Run("Parent Must Be In The Channel", func(t *testing.T) {
+		for _, parent := range []string{"elsewhere", "nope"} {
+			f := send(`{"v":1,"type":"message","id":"x","data":{"text":"sell","parentId":"` + parent + `"}}`)
+			if f.Type != FrameError {
+				t.Errorf("%s: expected an error", parent)
+			}
+		}
+	})
+
+	t.Run("Broadcast Carries The Parent", func(t *testing.T) {
+		if err := wH.BroadcastMessage("r2", "root", "other", "channel1", "hold", false, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, conn, FrameMessage)
+		var p payload
+		if err := json.Unmarshal(f.Data, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.ParentID != "root" {
+			t.Errorf("expected the parent id in the frame, got %+v", p)
+		}
+	})
+}
+
+func TestDirectChannels(t *testing.T) {
+	access := mockAccess{"dm:1": {"paulo", "ana"}}
+	cluster := newMockCluster()
+	wH := newTestHandler(Deps{Access: access, Router: &mockRouter{cluster, "server1"}})
+	cluster.instances["server1"] = wH
+
+	e := echo.New()
+	route := func(c echo.Context) error {
+		c.Set("username", c.QueryParam("user"))
+		if c.Param("channel") == "" {
+			return wH.HandleMultiplexRequest(c)
+		}
+		return wH.HandleRequest(c)
+	}
+	e.GET("/ws", route)
+	e.GET("/ws/:channel", route)
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(path string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.Dial(context.Background(), url+path, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		return conn
+	}
+
+	t.Run("Others Can't Open The Channel", func(t *testing.T) {
+		_, resp, err := websocket.Dial(context.Background(), url+"/ws/dm:1?user=eve", nil) //nolint
+		if err == nil {
+			t.Fatal("expected the connection to be refused")
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected a 403, got %+v", resp)
+		}
+	})
+
+	t.Run("Others Can't Subscribe", func(t *testing.T) {
+		conn := dial("/ws?user=eve")
+		defer conn.CloseNow() //nolint
+
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"subscribe","id":"s1","channel":"dm:1"}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, conn, FrameError)
+		var data ErrorData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Code != errCodeForbidden {
+			t.Errorf("expected %s, got %s", errCodeForbidden, data.Code)
+		}
+	})
+
+	t.Run("Members Are Told", func(t *testing.T) {
+		ana := dial("/ws?user=ana")
+		defer ana.CloseNow() //nolint
+		eve := dial("/ws?user=eve")
+		defer eve.CloseNow() //nolint
+
+		// the sessions are registered once the server answers on them
+		for _, conn := range []*websocket.Conn{ana, eve} {
+			if err := conn.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"unsubscribe","id":"u1","channel":"x"}`)); err != nil {
+				t.Fatal(err)
+			}
+			readFrameOfType(t, conn, FrameError)
+		}
+
+		// paulo isn't connected, the channel is in the next listing of paulo
+		if err := wH.NotifyDirectChannel(context.Background(), eventbus.DirectChannelEvent{Channel: "dm:1", Members: []string{"paulo", "ana"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, ana, FrameDirectOpened)
+		var data DirectOpenedData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Channel != "dm:1" || data.With != "paulo" {
+			t.Errorf("unexpected frame %+v", data)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, _, err := eve.Read(ctx); err == nil {
+			t.Error("expected nothing for a user outside the conversation")
+		}
+	})
+}
+
+func TestMentions(t *testing.T) {
+	at := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	mentions := &mockMentions{pending: map[string]mention.Summary{
+		"ana": {Count: 1, Mentions: []mention.Mention{{MessageID: "m1", Channel: "general", By: "paulo", Text: "hi @ana", Time: at}}},
+	}}
+	cluster := newMockCluster()
+	wH := newTestHandler(Deps{Mentions: mentions, Router: &mockRouter{cluster, "server1"}})
+	cluster.instances["server1"] = wH
+
+	e := echo.New()
+	e.GET("/ws", func(c echo.Context) error {
+		c.Set("username", c.QueryParam("user"))
+		return wH.HandleMultiplexRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(user string) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.Dial(context.Background(), url+"/ws?user="+user, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		return conn
+	}
+
+	// the sessions are registered once the server answers on them
+	ready := func(conn *websocket.Conn) {
+		t.Helper()
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"unsubscribe","id":"u1","channel":"x"}`)); err != nil {
+			t.Fatal(err)
+		}
+		readFrameOfType(t, conn, FrameError)
+	}
+
+	t.Run("Summary On Connect", func(t *testing.T) {
+		conn := dial("ana")
+		defer conn.CloseNow() //nolint
+
+		f := readFrame(t, conn)
+		if f.Type != FrameMentions {
+			t.Fatalf("expected the summary first, got %s", f.Type)
+		}
+		var data mention.Summary
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Count != 1 || len(data.Mentions) != 1 || data.Mentions[0].MessageID != "m1" {
+			t.Errorf("unexpected summary %+v", data)
+		}
+
+		// delivered, the first frame of the next connection is the answer to its own
+		again := dial("ana")
+		defer again.CloseNow() //nolint
+		if err := again.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"unsubscribe","id":"u1","channel":"x"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if f := readFrame(t, again); f.Type != FrameError {
+			t.Errorf("expected no summary, got %s", f.Type)
+		}
+	})
+
+	t.Run("Live Notification", func(t *testing.T) {
+		ana := dial("ana")
+		defer ana.CloseNow() //nolint
+		eve := dial("eve")
+		defer eve.CloseNow() //nolint
+		ready(ana)
+		ready(eve)
+
+		event := eventbus.MentionEvent{Username: "ana", MessageID: "m2", Channel: "general", By: "paulo", Text: "@ana look", Time: at}
+		if err := wH.NotifyMention(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, ana, FrameMention)
+		if f.Channel != "general" {
+			t.Errorf("expected the frame to be tagged with general, got %q", f.Channel)
+		}
+		var data mention.Mention
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.MessageID != "m2" || data.By != "paulo" || data.Text != "@ana look" {
+			t.Errorf("unexpected mention %+v", data)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, _, err := eve.Read(ctx); err == nil {
+			t.Error("expected nothing for a user who wasn't mentioned")
+		}
+
+		event.Username = "bob"
+		if err := wH.NotifyMention(context.Background(), event); !errors.Is(err, routing.ErrOffline) {
+			t.Errorf("expected %v for a user connected nowhere, got %v", routing.ErrOffline, err)
+		}
+	})
+}
+
+func TestRateLimits(t *testing.T) {
+	bus := &mockEventbus{}
+	limiter := mockRateLimiter{"spammer": 1500 * time.Millisecond, "bot:paulo": 8 * time.Second}
+	archive := &MockArchiveService{messages: []*pb.Message{
+		{Id: "m1", Channel: "general", User: "spammer", Text: "buy", Timestamp: timestamppb.Now()},
+		{Id: "m2", Channel: "general", User: "paulo", Text: "hold", Timestamp: timestamppb.Now()},
+	}}
+	wH := newTestHandler(Deps{Eventbus: bus, Archive: archive, RateLimiter: limiter})
+
+	e := echo.New()
+	e.GET("/ws/:channel", func(c echo.Context) error {
+		c.Set("username", c.QueryParam("user"))
+		return wH.HandleRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/general?user="
+
+	sendFrame := func(t *testing.T, user, id, frame string) Frame {
+		t.Helper()
+		conn, _, err := websocket.Dial(context.Background(), url+user, nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+
+		if err := conn.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if f := readFrame(t, conn); f.ID == id {
+				return f
+			}
+		}
+	}
+
+	send := func(t *testing.T, user, id, text string) Frame {
+		t.Helper()
+		return sendFrame(t, user, id, `{"v":1,"type":"message","id":"`+id+`","data":{"text":"`+text+`"}}`)
+	}
+
+	rateLimited := func(t *testing.T, f Frame, retryAfterMs int64) {
+		t.Helper()
+		if f.Type != FrameError {
+			t.Fatalf("expected an error, got %s", f.Type)
+		}
+		var data ErrorData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Code != errCodeRateLimited || data.RetryAfterMs != retryAfterMs {
+			t.Errorf("expected %s after %dms, got %+v", errCodeRateLimited, retryAfterMs, data)
+		}
+	}
+
+	t.Run("Throttled User", func(t *testing.T) {
+		rateLimited(t, send(t, "spammer", "s1", "buy buy buy"), 1500)
+
+		bus.Lock()
+		defer bus.Unlock()
+		if len(bus.messages) != 0 {
+			t.Errorf("expected nothing published, got %d messages", len(bus.messages))
+		}
+	})
+
+	t.Run("Edits, Deletes And Reactions", func(t *testing.T) {
+		rateLimited(t, sendFrame(t, "spammer", "e1", `{"v":1,"type":"edit","id":"e1","data":{"messageId":"m1","text":"sell"}}`), 1500)
+		rateLimited(t, sendFrame(t, "spammer", "d1", `{"v":1,"type":"delete","id":"d1","data":{"messageId":"m1"}}`), 1500)
+		rateLimited(t, sendFrame(t, "spammer", "r1", `{"v":1,"type":"react","id":"r1","data":{"messageId":"m1","emoji":"🚀"}}`), 1500)
+
+		// refused before the limits are checked, it doesn't take from the bucket
+		f := sendFrame(t, "spammer", "e2", `{"v":1,"type":"edit","id":"e2","data":{"messageId":"m2","text":"sell"}}`)
+		var data ErrorData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Code != errCodeForbidden {
+			t.Errorf("expected %s for the message of another user, got %+v", errCodeForbidden, data)
+		}
+
+		f = sendFrame(t, "spammer", "r2", `{"v":1,"type":"react","id":"r2","data":{"messageId":"unknown","emoji":"🚀"}}`)
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Code != errCodeUnknownMessage {
+			t.Errorf("expected %s for a message that doesn't exist, got %+v", errCodeUnknownMessage, data)
+		}
+
+		bus.Lock()
+		defer bus.Unlock()
+		if len(bus.changes) != 0 || len(bus.reactions) != 0 {
+			t.Errorf("expected nothing published, got %d changes and %d reactions", len(bus.changes), len(bus.reactions))
+		}
+	})
+
+	t.Run("Bot Commands Are Limited Apart", func(t *testing.T) {
+		rateLimited(t, send(t, "paulo", "b1", "/stock=aapl.us"), 8000)
+
+		if f := send(t, "paulo", "b2", "just chatting"); f.Type != FrameAck {
+			t.Errorf("expected a plain message to go through, got %s", f.Type)
+		}
+
+		bus.Lock()
+		defer bus.Unlock()
+		if len(bus.messages) != 1 || len(bus.botRequests) != 0 {
+			t.Errorf("expected 1 message and no bot requests, got %d and %d", len(bus.messages), len(bus.botRequests))
+		}
+	})
+}
+
+func TestDrain(t *testing.T) {
+	cluster := newMockCluster()
+	wH := newTestHandler(Deps{Router: &mockRouter{cluster, "server1"}})
+	cluster.instances["server1"] = wH
+
+	e := echo.New()
+	e.GET("/ws", func(c echo.Context) error {
+		c.Set("username", "ana")
+		return wH.HandleMultiplexRequest(c)
+	})
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	conn, _, err := websocket.Dial(context.Background(), url, nil) //nolint
+	if err != nil {
+		t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+	}
+	defer conn.CloseNow() //nolint
+
+	// the session is registered once the server answers on it
+	if err := conn.Write(context.Background(), websocket.MessageText, []byte(`{"v":1,"type":"unsubscribe","id":"u1","channel":"x"}`)); err != nil {
+		t.Fatal(err)
+	}
+	readFrameOfType(t, conn, FrameError)
+
+	// queued right before the drain, it must still reach the client
+	if err := wH.NotifyMention(context.Background(), eventbus.MentionEvent{Username: "ana", MessageID: "m1", Channel: "general", By: "paulo", Text: "@ana bye"}); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		wH.Drain(ctx)
+	}()
+
+	if f := readFrame(t, conn); f.Type != FrameMention {
+		t.Errorf("expected the queued mention, got %s", f.Type)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = conn.Read(ctx)
+	if code := websocket.CloseStatus(err); code != websocket.StatusServiceRestart {
+		t.Errorf("expected the connection to be closed with %v, got %v", websocket.StatusServiceRestart, err)
+	}
+	<-drained
+
+	_, resp, err := websocket.Dial(context.Background(), url, nil) //nolint
+	if err == nil {
+		t.Fatal("expected new connections to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %v", http.StatusServiceUnavailable, resp)
+	}
+}
+
+// readEvent reads the next server-sent event, skipping the heartbeat comments
+func readEvent(t *testing.T, r *bufio.Reader) (event string, data []byte) {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && data != nil:
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = []byte(strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	bus := &mockEventbus{}
+	access := mockAccess{"dm:1": {"paulo", "ana"}, "nowhere": nil}
+	wH := newTestHandler(Deps{Eventbus: bus, Access: access})
+
+	e := echo.New()
+	withUser := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("username", c.QueryParam("user"))
+			return next(c)
+		}
+	}
+	e.GET("/api/channels/:name/stream", wH.HandleStream, withUser)
+	e.POST("/api/channels/:name/messages", wH.HandlePostMessage, withUser)
+
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	post := func(t *testing.T, user, channel, body string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/api/channels/"+channel+"/messages?user="+user, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() //nolint
+		return resp
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/channels/general/stream?user=paulo", nil)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close() //nolint
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	events := bufio.NewReader(stream.Body)
+
+	next := func(t *testing.T, typ FrameType) Frame {
+		t.Helper()
+		for {
+			_, data := readEvent(t, events)
+			var f Frame
+			if err := json.Unmarshal(data, &f); err != nil {
+				t.Fatal(err)
+			}
+			if f.Type == typ {
+				return f
+			}
+		}
+	}
+
+	t.Run("History Then Live Messages", func(t *testing.T) {
+		next(t, FrameHistory)
+
+		if err := wH.BroadcastMessage("m1", "", "ana", "general", "hello stream", false, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		f := next(t, FrameMessage)
+		var data payload
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if f.Channel != "general" || data.Msg != "hello stream" {
+			t.Errorf("unexpected message %s %+v", f.Channel, data)
+		}
+	})
+
+	t.Run("Post A Message", func(t *testing.T) {
+		if resp := post(t, "paulo", "general", `{"text":"  sent over http "}`); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+
+		bus.Lock()
+		defer bus.Unlock()
+		if len(bus.messages) != 1 {
+			t.Fatalf("expected 1 published message, got %d", len(bus.messages))
+		}
+		var obj MessageObj
+		if err := json.Unmarshal([]byte(bus.messages[0]), &obj); err != nil {
+			t.Fatal(err)
+		}
+		if obj.Message != "sent over http" || obj.Channel != "general" || obj.Username != "paulo" {
+			t.Errorf("unexpected published message %+v", obj)
+		}
+	})
+
+	t.Run("Idempotency Key", func(t *testing.T) {
+		send := func() AckData {
+			t.Helper()
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/channels/general/messages?user=paulo", strings.NewReader(`{"text":"once"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "retry-1")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close() //nolint
+			var ack AckData
+			if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+				t.Fatal(err)
+			}
+			return ack
+		}
+
+		first, retry := send(), send()
+		if first.MessageID == "" || first.MessageID != retry.MessageID {
+			t.Errorf("expected the retry to be acked with the same id, got %q and %q", first.MessageID, retry.MessageID)
+		}
+
+		bus.Lock()
+		defer bus.Unlock()
+		if len(bus.messages) != 2 {
+			t.Errorf("expected the retry not to be published, got %d published messages", len(bus.messages))
+		}
+	})
+
+	t.Run("Rejected Posts", func(t *testing.T) {
+		if resp := post(t, "paulo", "general", `{"text":" "}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for an empty message, got %d", resp.StatusCode)
+		}
+		if resp := post(t, "eve", "dm:1", `{"text":"hi"}`); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403 outside a direct channel, got %d", resp.StatusCode)
+		}
+		if resp := post(t, "paulo", "nowhere", `{"text":"hi"}`); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404 for a channel that doesn't exist, got %d", resp.StatusCode)
+		}
+
+		bus.Lock()
+		defer bus.Unlock()
+		if len(bus.messages) != 2 {
+			t.Errorf("expected nothing more published, got %d published messages", len(bus.messages))
+		}
+	})
+
+	t.Run("Private And Unknown Streams", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/channels/dm:1/stream?user=eve")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() //nolint
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", resp.StatusCode)
+		}
+
+		resp, err = http.Get(server.URL + "/api/channels/nowhere/stream?user=paulo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() //nolint
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404 for a channel that doesn't exist, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Drain Closes The Stream", func(t *testing.T) {
+		drainCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		go wH.Drain(drainCtx)
+
+		for {
+			event, data := readEvent(t, events)
+			if event != "close" {
+				continue
+			}
+			var c struct{ Code int }
+			if err := json.Unmarshal(data, &c); err != nil {
+				t.Fatal(err)
+			}
+			if c.Code != int(websocket.StatusServiceRestart) {
+				t.Errorf("expected %d, got %d", websocket.StatusServiceRestart, c.Code)
+			}
+			return
+		}
+	})
+}
+
+func TestSendToUser(t *testing.T) {
+	cluster := newMockCluster()
+
+	// ana is on server1, paulo on server2
+	dial := map[string]*websocket.Conn{}
+	urls := map[string]string{}
+	for _, c := range []struct{ instance, user string }{{"server1", "ana"}, {"server2", "paulo"}} {
+		wH := newTestHandler(Deps{Router: &mockRouter{cluster, c.instance}})
+		cluster.instances[c.instance] = wH
+
+		user := c.user
+		e := echo.New()
+		e.GET("/ws/:channel", func(c echo.Context) error {
+			c.Set("username", user)
+			c.Set("login", c.Request().Header.Get("X-Login"))
+			return wH.HandleRequest(c)
+		})
+		server := httptest.NewServer(e)
+		defer server.Close()
+		urls[user] = "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/general"
+
+		conn, _, err := websocket.Dial(context.Background(), urls[user], nil) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer conn.CloseNow() //nolint
+		readFrameOfType(t, conn, FrameHistory)
+		dial[user] = conn
+	}
+	server1 := cluster.instances["server1"]
+
+	t.Run("Another Instance", func(t *testing.T) {
+		err := server1.SendToUser(context.Background(), "paulo", "", FrameDirectOpened, DirectOpenedData{Channel: "dm:1", With: "ana"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, dial["paulo"], FrameDirectOpened)
+		var data DirectOpenedData
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Channel != "dm:1" || data.With != "ana" {
+			t.Errorf("unexpected frame data %+v", data)
+		}
+	})
+
+	t.Run("Recent Messages", func(t *testing.T) {
+		msgs := []user.Message{{ID: "m1", Channel: "general", User: "ana", Text: "hi", Timestamp: time.Now()}}
+		if err := server1.SendRecentMessages("general", "paulo", msgs); err != nil {
+			t.Fatal(err)
+		}
+
+		f := readFrameOfType(t, dial["paulo"], FrameHistory)
+		if f.Channel != "general" {
+			t.Errorf("expected the history of general, got %q", f.Channel)
+		}
+	})
+
+	t.Run("Mention On Another Instance", func(t *testing.T) {
+		event := eventbus.MentionEvent{Username: "paulo", MessageID: "m2", Channel: "random", By: "ana", Text: "@paulo hey"}
+		if err := server1.NotifyMention(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+
+		// paulo only watches general, mentions reach paulo anyway
+		f := readFrameOfType(t, dial["paulo"], FrameMention)
+		if f.Channel != "random" {
+			t.Errorf("expected the frame to be tagged with random, got %q", f.Channel)
+		}
+
+		cluster.Lock()
+		last := cluster.delivered[len(cluster.delivered)-1]
+		cluster.Unlock()
+		if last.Username != "paulo" || last.Mention != "m2" {
+			t.Errorf("expected the delivery to carry the mention, got %+v", last)
+		}
+	})
+
+	t.Run("Mention To A Closed Session", func(t *testing.T) {
+		// the registry still lists a session that closed, the instance has nobody to hand the mention to
+		cluster.Lock()
+		cluster.sessions["gone"] = [2]string{"bob", "server1"}
+		before := len(cluster.delivered)
+		cluster.Unlock()
+		defer func() {
+			cluster.Lock()
+			delete(cluster.sessions, "gone")
+			cluster.Unlock()
+		}()
+
+		event := eventbus.MentionEvent{Username: "bob", MessageID: "m3", Channel: "general", By: "ana", Text: "@bob hey"}
+		if err := server1.NotifyMention(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+
+		cluster.Lock()
+		defer cluster.Unlock()
+		if len(cluster.delivered) != before {
+			t.Errorf("expected the mention not to be delivered, got %+v", cluster.delivered[before:])
+		}
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		err := server1.SendToUser(context.Background(), "nobody", "", FrameDirectOpened, DirectOpenedData{})
+		if !errors.Is(err, routing.ErrOffline) {
+			t.Errorf("expected %v, got %v", routing.ErrOffline, err)
+		}
+	})
+
+	t.Run("Kick Login", func(t *testing.T) {
+		// ana logs in on her phone too, then logs out of it from another instance
+		phone, _, err := websocket.Dial(context.Background(), urls["ana"], &websocket.DialOptions{HTTPHeader: http.Header{"X-Login": {"phone"}}}) //nolint
+		if err != nil {
+			t.Fatalf("Failed to connect to the WebSocket endpoint: %v", err)
+		}
+		defer phone.CloseNow() //nolint
+		readFrameOfType(t, phone, FrameHistory)
+
+		if err := cluster.instances["server2"].KickLogin(context.Background(), "ana", "phone", "logged out"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			_, _, err := phone.Read(ctx)
+			if err == nil {
+				continue
+			}
+			if code := websocket.CloseStatus(err); code != statusKicked {
+				t.Errorf("expected the connection to be closed with %v, got %v", statusKicked, err)
+			}
+			break
+		}
+
+		// the other login of ana is still connected
+		if err := server1.SendToUser(context.Background(), "ana", "", FrameDirectOpened, DirectOpenedData{Channel: "dm:2", With: "paulo"}); err != nil {
+			t.Fatal(err)
+		}
+		readFrameOfType(t, dial["ana"], FrameDirectOpened)
+	})
+
+	t.Run("Kick", func(t *testing.T) {
+		if err := server1.KickUser(context.Background(), "paulo", "banned"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for {
+			_, _, err := dial["paulo"].Read(ctx)
+			if err == nil {
+				continue
+			}
+			if code := websocket.CloseStatus(err); code != statusKicked {
+				t.Errorf("expected the connection to be closed with %v, got %v", statusKicked, err)
+			}
+			break
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			cluster.Lock()
+			n := len(cluster.sessions)
+			cluster.Unlock()
+			if n == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected only the session of ana to be left, got %d sessions", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}